@@ -2,4 +2,11 @@ module github.com/finwarman/protohackers
 
 go 1.21.6
 
-require github.com/alecthomas/participle/v2 v2.1.1
+require (
+	github.com/alecthomas/participle/v2 v2.1.1
+	github.com/finwarman/protohackers/budgetchat v0.0.0-00010101000000-000000000000
+)
+
+// budget-chat is its own module, in this repository (it uses src/lib, see
+// src/03-budget-chat/go.mod)
+replace github.com/finwarman/protohackers/budgetchat => ./src/03-budget-chat
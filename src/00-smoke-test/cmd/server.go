@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+
+	smoketest "github.com/finwarman/protohackers/src/00-smoke-test"
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/metrics"
+	"github.com/finwarman/protohackers/src/lib/server"
+)
+
+const TCP_PORT = smoketest.DEFAULT_TCP_PORT
+
+func main() {
+	logOpts := logging.RegisterFlags(flag.CommandLine)
+	metricsAddr := metrics.RegisterFlags(flag.CommandLine)
+	options := smoketest.RegisterFlags(flag.CommandLine)
+	serverSettings := server.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	logging.Setup(*logOpts)
+
+	settings, err := serverSettings()
+	if err != nil {
+		slog.Error("invalid server settings", "error", err)
+		os.Exit(1)
+	}
+
+	// Serve until interrupted (SIGINT/SIGTERM)
+	ctx, stop := server.NotifyContext(context.Background())
+	defer stop()
+
+	// Serve metrics over HTTP, if enabled (-metrics-addr)
+	if addr, err := metrics.Start(ctx, *metricsAddr); err != nil {
+		slog.Error("metrics failed", "error", err)
+		os.Exit(1)
+	} else if addr != nil {
+		slog.Info("serving metrics", "addr", "http://"+addr.String()+metrics.METRICS_PATH)
+	}
+
+	if err := smoketest.StartServer(ctx, TCP_PORT, *options, settings); err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+}
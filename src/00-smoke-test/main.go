@@ -1,44 +1,183 @@
-package main
+package smoketest
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"strings"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/metrics"
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
-const TCP_PORT = 25565
+// Default tcp port for server
+const DEFAULT_TCP_PORT = 25565
+
+// Default unix socket path, for -echo-network unix
+const DEFAULT_SOCKET_PATH = "/tmp/protohackers-smoke-test.sock"
+
+// Networks the echo server can use (see Options.Network)
+const NETWORK_TCP = "tcp"
+const NETWORK_UDP = "udp"
+const NETWORK_UNIX = "unix"
+
+// Problem name, for logs and metrics
+const PROBLEM = "smoke-test"
+
+// Logger for this problem
+var logger = logging.Named(PROBLEM)
+
+// Returned (and logged) when a client reaches Options.MaxBytes
+var ErrByteLimit = errors.New("byte limit reached")
+
+// Buckets for bytes echoed per connection, 1KiB to 64MiB
+var ECHOED_BUCKETS = []float64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 16 << 20, 64 << 20}
+
+// Bytes echoed back on each connection
+var echoedBytes = metrics.NewHistogram("protohackers_smoke_echoed_bytes",
+	"Bytes echoed back per connection", ECHOED_BUCKETS)
 
-func main() {
-	StartServer(TCP_PORT)
+// Options for the echo server
+type Options struct {
+	Network    string // NETWORK_TCP (the default), NETWORK_UDP or NETWORK_UNIX
+	SocketPath string // Unix socket to listen on, empty for DEFAULT_SOCKET_PATH
+	MaxBytes   int64  // Disconnect clients after echoing this many bytes, 0 for no limit
+
+	// Changes to the echo (see transform.go)
+	Transforms []string      // Content transforms, applied in order (e.g. TRANSFORM_UPPERCASE)
+	Delay      time.Duration // Hold back each piece of the echo this long
+	Jitter     time.Duration // Plus up to this long, at random
+	Rate       int64         // Throttle the echo to this many bytes per second, 0 for no limit (tcp and unix only)
+}
+
+// RegisterFlags adds -echo-network, -echo-socket, -echo-max-bytes and the
+// transform flags (-echo-transform, -echo-delay, -echo-jitter and
+// -echo-rate) to the flag set, returning the options they populate
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	options := &Options{}
+	fs.StringVar(&options.Network, "echo-network", NETWORK_TCP,
+		"network for the smoke-test echo server: tcp, udp (datagram echo) or unix (see -echo-socket)")
+	fs.StringVar(&options.SocketPath, "echo-socket", DEFAULT_SOCKET_PATH,
+		"unix socket `path` for -echo-network unix")
+	fs.Int64Var(&options.MaxBytes, "echo-max-bytes", 0,
+		"disconnect smoke-test clients after echoing this many bytes (0 for no limit, tcp and unix only)")
+
+	fs.Func("echo-transform", "comma-separated `transforms` for the smoke-test echo, applied in order: "+TransformNames(),
+		func(s string) error {
+			options.Transforms = strings.Split(s, ",")
+			return checkTransforms(options.Transforms)
+		})
+	fs.DurationVar(&options.Delay, "echo-delay", 0, "hold back each piece of the smoke-test echo this long")
+	fs.DurationVar(&options.Jitter, "echo-jitter", 0, "add up to this much random delay to -echo-delay")
+	fs.Int64Var(&options.Rate, "echo-rate", 0,
+		"throttle the smoke-test echo to this many bytes per second (0 for no limit, tcp and unix only)")
+	return options
 }
 
-func StartServer(port int) {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// Server is an echo server, on any of the networks
+type Server interface {
+	Addr() net.Addr
+	Serve(ctx context.Context) error
+	Close() error
+}
+
+// StartServer runs the server on the given port, until the context is cancelled
+func StartServer(ctx context.Context, port int, options Options, settings server.Settings) error {
+	srv, err := NewServer(port, options, settings)
 	if err != nil {
-		fmt.Println("listen: ", err.Error())
-		os.Exit(1)
+		return err
 	}
 
-	fmt.Printf("listening on port %d\n", port)
+	return srv.Serve(ctx)
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println("accept: ", err.Error())
-			os.Exit(1)
-		}
+// NewServer creates an echo server listening on the given port (0 picks
+// a free port, see Addr), or unix socket, depending on options.Network (with
+// the timeouts, limits and TLS from settings, only its limits for UDP)
+func NewServer(port int, options Options, settings server.Settings) (Server, error) {
+	if err := checkTransforms(options.Transforms); err != nil {
+		return nil, err
+	}
 
-		fmt.Println("connection from ", conn.RemoteAddr())
+	config := server.Config{Name: PROBLEM, Port: port, Logger: logger, Settings: settings}
 
-		go HandleConnection(conn)
+	switch options.Network {
+	case NETWORK_TCP, "":
+	case NETWORK_UDP:
+		return newUDPServer(port, options, settings.Limits)
+	case NETWORK_UNIX:
+		config.Network = server.NETWORK_UNIX
+		config.SocketPath = options.SocketPath
+		if config.SocketPath == "" {
+			config.SocketPath = DEFAULT_SOCKET_PATH
+		}
+	default:
+		return nil, fmt.Errorf("unknown echo network %q (want tcp, udp or unix)", options.Network)
 	}
+
+	return server.Listen(config, server.HandlerFunc(func(conn net.Conn) {
+		HandleConnection(conn, options)
+	}))
 }
 
-func HandleConnection(conn net.Conn) {
+// HandleConnection echoes everything the client sends (transformed, if
+// configured), until it closes (or half-closes) its side, then finishes
+// sending and closes ours
+func HandleConnection(conn net.Conn, options Options) {
 	defer conn.Close()
 
-	if _, err := io.Copy(conn, conn); err != nil {
-		fmt.Println("copy: ", err.Error())
+	log := logging.ForConn(logger, conn)
+	start := time.Now()
+
+	echoed, err := echo(conn, options)
+	echoedBytes.Observe(float64(echoed))
+	log.Info("echoed", "bytes", echoed, "duration", time.Since(start).Round(time.Millisecond))
+
+	switch {
+	case err == nil:
+		// Half-closed clients are still waiting for the end of the echo,
+		// so tell them it's done (not all connections can half-close)
+		if err := closeWrite(conn); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			log.Debug("close write", "error", err)
+		}
+	case errors.Is(err, ErrByteLimit):
+		log.Info("disconnecting", "reason", err, "max_bytes", options.MaxBytes)
+	default:
+		server.LogReadError(log, err)
+	}
+}
+
+// echo copies everything read from conn back to it (through the
+// transforms), until the client closes (or half-closes) its side, or
+// MaxBytes have been echoed, returning the bytes read
+func echo(conn net.Conn, options Options) (int64, error) {
+	var reader io.Reader = conn
+	if options.MaxBytes > 0 {
+		reader = io.LimitReader(conn, options.MaxBytes)
+	}
+
+	// (Without transforms, this is a plain io.Copy)
+	writer := newEchoWriter(conn, options, true)
+	echoed, err := io.Copy(writer, reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && options.MaxBytes > 0 && echoed == options.MaxBytes {
+		err = ErrByteLimit
+	}
+	return echoed, err
+}
+
+// closeWrite shuts down the sending side of conn, if it can half-close
+func closeWrite(conn net.Conn) error {
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
 	}
+	return errors.ErrUnsupported
 }
@@ -1,23 +1,38 @@
-package main
+package smoketest
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
-const TEST_TCP_PORT = 44444
+// startTestServer starts the server on a free port, returning the address
+// to connect to (the server is stopped when the test completes)
+func startTestServer(t *testing.T, options Options) string {
+	srv, err := NewServer(0, options, server.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	go srv.Serve(context.Background())
+	t.Cleanup(func() { srv.Close() })
 
-var TEST_CONNECT_STR = fmt.Sprintf("localhost:%d", TEST_TCP_PORT)
+	return srv.Addr().String()
+}
 
 func TestEchoServer(t *testing.T) {
-	go StartServer(TEST_TCP_PORT)      // Start the server in a goroutine
-	time.Sleep(time.Millisecond * 500) // (Wait for the server to start)
+	addr := startTestServer(t, Options{})
 
 	// Connect to the server
-	conn, err := net.Dial("tcp", TEST_CONNECT_STR)
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
@@ -25,7 +40,7 @@ func TestEchoServer(t *testing.T) {
 
 	// Send a message
 	message := "Hello, server!\n"
-	fmt.Print(conn, message)
+	fmt.Fprint(conn, message)
 
 	// Read the response
 	response, err := bufio.NewReader(conn).ReadString('\n')
@@ -38,3 +53,242 @@ func TestEchoServer(t *testing.T) {
 		t.Fatalf("Expected '%s', got '%s'", message, response)
 	}
 }
+
+// dialHalfClose connects to the server, sends data, then half-closes,
+// returning everything echoed back before the server closed its side
+func dialHalfClose(t *testing.T, addr string, data []byte) ([]byte, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// (Send while reading, so neither side's buffers fill up)
+	go func() {
+		_, _ = conn.Write(data)
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	return io.ReadAll(conn)
+}
+
+func TestHalfClose(t *testing.T) {
+	addr := startTestServer(t, Options{})
+	before := echoedBytes.Count()
+
+	// Everything is echoed after the client half-closes, then the server
+	// closes its side (rather than waiting, or dropping the connection)
+	message := []byte("Hello, server!\nNo newline at the end")
+	response, err := dialHalfClose(t, addr, message)
+	if err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if !bytes.Equal(response, message) {
+		t.Fatalf("Expected '%s', got '%s'", message, response)
+	}
+
+	// An immediate half-close is echoed as nothing
+	if response, err := dialHalfClose(t, addr, nil); err != nil || len(response) != 0 {
+		t.Fatalf("Expected an empty echo, got '%s' (%v)", response, err)
+	}
+
+	// (Each connection is counted once it's done)
+	deadline := time.Now().Add(time.Second)
+	for echoedBytes.Count() != before+2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 connections counted, got %d", echoedBytes.Count()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLargePayload(t *testing.T) {
+	addr := startTestServer(t, Options{})
+
+	payload := make([]byte, 8<<20)
+	_, _ = rand.Read(payload)
+
+	response, err := dialHalfClose(t, addr, payload)
+	if err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if !bytes.Equal(response, payload) {
+		t.Fatalf("Expected %d bytes echoed intact, got %d bytes", len(payload), len(response))
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	addr := startTestServer(t, Options{MaxBytes: 1 << 20})
+
+	// Within the limit, everything is echoed
+	small := bytes.Repeat([]byte("x"), 1000)
+	if response, err := dialHalfClose(t, addr, small); err != nil || !bytes.Equal(response, small) {
+		t.Fatalf("Expected %d bytes echoed, got %d (%v)", len(small), len(response), err)
+	}
+
+	// Over it, the client is disconnected after the limit (and may be reset,
+	// with data still unread)
+	payload := make([]byte, 4<<20)
+	_, _ = rand.Read(payload)
+	response, _ := dialHalfClose(t, addr, payload)
+	if len(response) > 1<<20 || !bytes.Equal(response, payload[:len(response)]) {
+		t.Fatalf("Expected at most 1MiB echoed intact, got %d bytes", len(response))
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	startTestServer(t, Options{Network: NETWORK_UNIX, SocketPath: path})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	// The same echo (and half-close) as over TCP
+	message := "Hello, socket!"
+	_, _ = io.WriteString(conn, message)
+	_ = conn.(*net.UnixConn).CloseWrite()
+
+	response, err := io.ReadAll(conn)
+	if err != nil || string(response) != message {
+		t.Fatalf("Expected '%s', got '%s' (%v)", message, response, err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	addr := startTestServer(t, Options{Network: NETWORK_UDP})
+
+	// (Listening on all interfaces, so connect over loopback)
+	_, port, _ := net.SplitHostPort(addr)
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// Each datagram comes back as it was sent, including empty ones
+	buffer := make([]byte, MAX_DATAGRAM_BYTES)
+	for _, message := range []string{"hello", "", "two\nlines\n", string(bytes.Repeat([]byte("x"), 60000))} {
+		_, _ = conn.Write([]byte(message))
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read echo of %d bytes: %v", len(message), err)
+		}
+		if string(buffer[:n]) != message {
+			t.Fatalf("Expected %d bytes echoed intact, got %d", len(message), n)
+		}
+	}
+}
+
+func TestUnknownNetwork(t *testing.T) {
+	if _, err := NewServer(0, Options{Network: "sctp"}, server.Settings{}); err == nil {
+		t.Fatalf("Expected error for an unknown network")
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		transforms []string
+		input      string
+		expected   string
+	}{
+		{nil, "Hello\n", "Hello\n"},
+		{[]string{TRANSFORM_UPPERCASE}, "Hello, wörld!\n", "HELLO, WöRLD!\n"},
+		{[]string{TRANSFORM_REVERSE}, "Hello\nwörld\r\n\nend", "olleH\ndlröw\r\n\ndne"},
+		{[]string{TRANSFORM_HEX}, "Hello\n", "00000000  48 65 6c 6c 6f 0a                                 |Hello.|\n"},
+		{[]string{TRANSFORM_REVERSE, TRANSFORM_UPPERCASE}, "abc\ndef", "CBA\nFED"},
+	}
+
+	for _, test := range tests {
+		// (Written a byte at a time, so transforms must cope with split input)
+		var output bytes.Buffer
+		writer := newEchoWriter(&output, Options{Transforms: test.transforms}, true)
+		for i := 0; i < len(test.input); i++ {
+			if _, err := writer.Write([]byte{test.input[i]}); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+
+		if output.String() != test.expected {
+			t.Fatalf("Expected %v of %q to be %q, got %q", test.transforms, test.input, test.expected, output.String())
+		}
+	}
+
+	if _, err := NewServer(0, Options{Transforms: []string{"rot13"}}, server.Settings{}); err == nil {
+		t.Fatalf("Expected error for an unknown transform")
+	}
+}
+
+func TestTransformServer(t *testing.T) {
+	addr := startTestServer(t, Options{Transforms: []string{TRANSFORM_UPPERCASE, TRANSFORM_REVERSE}})
+
+	// Lines are echoed as they complete, and a partial line once the client half-closes
+	response, err := dialHalfClose(t, addr, []byte("hello\nworld"))
+	if err != nil || string(response) != "OLLEH\nDLROW" {
+		t.Fatalf("Expected transformed echo, got '%s' (%v)", response, err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	delay := 100 * time.Millisecond
+	addr := startTestServer(t, Options{Delay: delay, Jitter: delay})
+
+	start := time.Now()
+	response, err := dialHalfClose(t, addr, []byte("hello"))
+	if err != nil || string(response) != "hello" {
+		t.Fatalf("Expected echo, got '%s' (%v)", response, err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("Expected echo to be delayed by at least %v, took %v", delay, elapsed)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	rate := int64(100 << 10)
+	addr := startTestServer(t, Options{Rate: rate})
+
+	// 50KiB at 100KiB/s takes about half a second (the first chunk is sent straight away)
+	payload := bytes.Repeat([]byte("x"), 50<<10)
+	start := time.Now()
+	response, err := dialHalfClose(t, addr, payload)
+	if err != nil || !bytes.Equal(response, payload) {
+		t.Fatalf("Expected %d bytes echoed, got %d (%v)", len(payload), len(response), err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected throttled echo to take at least 400ms, took %v", elapsed)
+	}
+}
+
+func TestUDPTransforms(t *testing.T) {
+	addr := startTestServer(t, Options{Network: NETWORK_UDP, Transforms: []string{TRANSFORM_REVERSE}})
+
+	_, port, _ := net.SplitHostPort(addr)
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// Each datagram is transformed on its own
+	buffer := make([]byte, MAX_DATAGRAM_BYTES)
+	for message, expected := range map[string]string{"hello": "olleh", "ab\ncd\n": "ba\ndc\n"} {
+		_, _ = conn.Write([]byte(message))
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil || string(buffer[:n]) != expected {
+			t.Fatalf("Expected '%s', got '%s' (%v)", expected, buffer[:n], err)
+		}
+	}
+}
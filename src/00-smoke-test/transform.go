@@ -0,0 +1,245 @@
+package smoketest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/finwarman/protohackers/src/lib/lines"
+)
+
+// Echo transforms, so the smoke-test server can act as a controllable
+// test peer (e.g. a fake upstream for mob-in-the-middle).
+//
+// The echo is written through a chain of writers: the content transforms
+// (in the order given), then any delay, then the bandwidth throttle, then
+// the connection. Closing the chain flushes anything held back (e.g. a
+// partial line being reversed), without closing the connection.
+
+// Content transforms (see Options.Transforms)
+const TRANSFORM_UPPERCASE = "uppercase" // ASCII letters to upper case
+const TRANSFORM_REVERSE = "reverse"     // Reverse each line (by character)
+const TRANSFORM_HEX = "hex"             // Hex dump, like `hexdump -C`
+
+// Longest line reversed in one piece, longer lines are reversed in pieces
+const MAX_REVERSE_LENGTH = lines.DEFAULT_MAX_LENGTH
+
+// How often a throttled echo is sent, in chunks of Rate/THROTTLE_CHUNKS_PER_SECOND
+const THROTTLE_CHUNKS_PER_SECOND = 10
+
+// transform wraps the rest of the chain with another writer
+type transform func(w io.WriteCloser) io.WriteCloser
+
+// Content transforms, by name
+var TRANSFORMS = map[string]transform{
+	TRANSFORM_UPPERCASE: func(w io.WriteCloser) io.WriteCloser { return &uppercaseWriter{w} },
+	TRANSFORM_REVERSE:   func(w io.WriteCloser) io.WriteCloser { return &reverseWriter{w: w} },
+	TRANSFORM_HEX: func(w io.WriteCloser) io.WriteCloser {
+		return &flushCloser{WriteCloser: hex.Dumper(w), next: w}
+	},
+}
+
+// TransformNames lists the available content transforms, for help text
+func TransformNames() string {
+	return strings.Join([]string{TRANSFORM_UPPERCASE, TRANSFORM_REVERSE, TRANSFORM_HEX}, ", ")
+}
+
+// checkTransforms returns an error for any unknown transform names
+func checkTransforms(names []string) error {
+	for _, name := range names {
+		if _, ok := TRANSFORMS[name]; !ok {
+			return fmt.Errorf("unknown echo transform %q (want %s)", name, TransformNames())
+		}
+	}
+	return nil
+}
+
+// newEchoWriter returns the chain of writers the echo goes through, ending
+// with w. Closing it flushes the chain, but doesn't close w.
+// (The transforms must already have been checked, see checkTransforms)
+func newEchoWriter(w io.Writer, options Options, throttle bool) io.WriteCloser {
+	var chain io.WriteCloser = nopCloser{w}
+
+	if throttle && options.Rate > 0 {
+		chain = &throttledWriter{w: chain, rate: options.Rate}
+	}
+	if options.Delay > 0 || options.Jitter > 0 {
+		chain = &delayedWriter{w: chain, options: options}
+	}
+	for i := len(options.Transforms) - 1; i >= 0; i-- {
+		chain = TRANSFORMS[options.Transforms[i]](chain)
+	}
+	return chain
+}
+
+// transformDatagram applies the content transforms to a single datagram
+// (delays and throttling are up to the caller)
+func transformDatagram(data []byte, options Options) []byte {
+	var buffer bytes.Buffer
+	chain := newEchoWriter(&buffer, Options{Transforms: options.Transforms}, false)
+	_, _ = chain.Write(data)
+	_ = chain.Close()
+	return buffer.Bytes()
+}
+
+// delay returns how long to hold back the next piece of the echo
+// (Options.Delay, plus up to Options.Jitter)
+func (o Options) delay() time.Duration {
+	if o.Jitter <= 0 {
+		return o.Delay
+	}
+	return o.Delay + time.Duration(rand.Int63n(int64(o.Jitter)+1))
+}
+
+//
+// === WRITERS === //
+//
+
+// nopCloser is the end of the chain, where Close does nothing
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// flushCloser closes a writer (flushing it), then the rest of the chain
+type flushCloser struct {
+	io.WriteCloser
+	next io.WriteCloser
+}
+
+func (f *flushCloser) Close() error {
+	if err := f.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return f.next.Close()
+}
+
+// uppercaseWriter upper-cases ASCII letters (leaving any other bytes,
+// so multi-byte characters split across writes aren't mangled)
+type uppercaseWriter struct{ w io.WriteCloser }
+
+func (u *uppercaseWriter) Write(p []byte) (int, error) {
+	upper := make([]byte, len(p))
+	for i, b := range p {
+		if 'a' <= b && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+		upper[i] = b
+	}
+	return u.w.Write(upper)
+}
+
+func (u *uppercaseWriter) Close() error { return u.w.Close() }
+
+// reverseWriter reverses each line, holding back partial lines until
+// their newline arrives (or the chain is closed)
+type reverseWriter struct {
+	w    io.WriteCloser
+	line []byte
+}
+
+func (r *reverseWriter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if b == '\n' {
+			if err := r.flush(true); err != nil {
+				return i, err
+			}
+			continue
+		}
+		r.line = append(r.line, b)
+		if len(r.line) == MAX_REVERSE_LENGTH {
+			if err := r.flush(false); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes the held back line reversed (with a newline, if it ended,
+// keeping any carriage return before it at the end)
+func (r *reverseWriter) flush(newline bool) error {
+	line, ending := r.line, []byte(nil)
+	if newline {
+		ending = []byte("\n")
+		if bytes.HasSuffix(line, []byte("\r")) {
+			line, ending = line[:len(line)-1], []byte("\r\n")
+		}
+	}
+	reversed := append(reverseRunes(line), ending...)
+	r.line = r.line[:0]
+	if len(reversed) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(reversed)
+	return err
+}
+
+func (r *reverseWriter) Close() error {
+	if err := r.flush(false); err != nil {
+		return err
+	}
+	return r.w.Close()
+}
+
+// reverseRunes reverses a string by character (invalid UTF-8 bytes are
+// treated as a character each)
+func reverseRunes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	end := len(reversed)
+	for len(b) > 0 {
+		_, size := utf8.DecodeRune(b)
+		end -= size
+		copy(reversed[end:], b[:size])
+		b = b[size:]
+	}
+	return reversed
+}
+
+// delayedWriter holds back each write, by the delay plus up to the jitter
+type delayedWriter struct {
+	w       io.WriteCloser
+	options Options
+}
+
+func (d *delayedWriter) Write(p []byte) (int, error) {
+	time.Sleep(d.options.delay())
+	return d.w.Write(p)
+}
+
+func (d *delayedWriter) Close() error { return d.w.Close() }
+
+// throttledWriter limits writes to rate bytes per second on average,
+// writing in small chunks (idle time isn't saved up for a later burst)
+type throttledWriter struct {
+	w    io.WriteCloser
+	rate int64
+	next time.Time // when the next byte can be sent
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	chunkSize := max(int(t.rate/THROTTLE_CHUNKS_PER_SECOND), 1)
+
+	written := 0
+	for written < len(p) {
+		if now := time.Now(); t.next.Before(now) {
+			t.next = now
+		}
+		time.Sleep(time.Until(t.next))
+
+		chunk := p[written:min(written+chunkSize, len(p))]
+		n, err := t.w.Write(chunk)
+		written += n
+		t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Close() error { return t.w.Close() }
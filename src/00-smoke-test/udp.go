@@ -0,0 +1,110 @@
+package smoketest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/limiter"
+	"github.com/finwarman/protohackers/src/lib/server"
+)
+
+// Datagram echo, for -echo-network udp.
+//
+// Each datagram is sent straight back to where it came from, after any
+// content transforms and delay (see transform.go), truncated to
+// MAX_DATAGRAM_BYTES. There are no connections, so Options.MaxBytes and
+// Rate don't apply, but the per-IP rate limit does (see lib/limiter).
+
+// Largest datagram echoed (the most UDP can carry), longer ones are truncated
+const MAX_DATAGRAM_BYTES = 65535
+
+// udpServer echoes datagrams
+type udpServer struct {
+	conn    net.PacketConn
+	options Options
+	limiter *limiter.Limiter // per-IP packet rate limit
+}
+
+// newUDPServer creates a datagram echo server listening on the given UDP port
+// (0 picks a free port, see Addr), limiting packets from each IP
+func newUDPServer(port int, options Options, limits limiter.Config) (*udpServer, error) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("listen error: on UDP port %d: %w", port, err)
+	}
+
+	logger.Info("listening", "protocol", "udp", "addr", conn.LocalAddr().String())
+
+	return &udpServer{
+		conn:    conn,
+		options: options,
+		limiter: limiter.New(PROBLEM, limits),
+	}, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *udpServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stops the server
+func (s *udpServer) Close() error {
+	return s.conn.Close()
+}
+
+// Serve echoes datagrams until the context is cancelled (or Close is called)
+func (s *udpServer) Serve(ctx context.Context) error {
+	defer s.conn.Close()
+
+	// Stop blocking in ReadFrom once the context is cancelled
+	stop := context.AfterFunc(ctx, func() { s.conn.Close() })
+	defer stop()
+
+	buffer := make([]byte, MAX_DATAGRAM_BYTES)
+	for {
+		n, remoteAddr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				logger.Info("shutting down")
+				return nil
+			}
+			logger.Warn("read error", "error", err)
+			continue
+		}
+
+		server.BytesReceived.Add(float64(n), PROBLEM)
+
+		// Drop packets over the rate limit, without replying
+		// (UDP source addresses can be spoofed, so replies could be abused)
+		if err := s.limiter.Allow(remoteAddr); err != nil {
+			logger.Debug("dropped packet", "remote_addr", remoteAddr.String(), "reason", err)
+			continue
+		}
+
+		start := time.Now()
+		echo := transformDatagram(buffer[:n], s.options)
+		if len(echo) > MAX_DATAGRAM_BYTES {
+			echo = echo[:MAX_DATAGRAM_BYTES]
+		}
+
+		// (Delayed echoes are sent in the background, so others aren't held up)
+		if delay := s.options.delay(); delay > 0 {
+			time.AfterFunc(delay, func() { s.send(echo, remoteAddr) })
+		} else {
+			s.send(echo, remoteAddr)
+		}
+		server.RequestDuration.Since(start, PROBLEM)
+	}
+}
+
+// send echoes a datagram back to where it came from
+func (s *udpServer) send(data []byte, addr net.Addr) {
+	n, err := s.conn.WriteTo(data, addr)
+	server.BytesSent.Add(float64(n), PROBLEM)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Warn("couldn't echo datagram", "remote_addr", addr.String(), "error", err)
+	}
+}
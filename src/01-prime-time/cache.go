@@ -0,0 +1,201 @@
+package primetime
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/finwarman/protohackers/src/lib/metrics"
+)
+
+// Primality lookups for isPrime requests, shared by every connection.
+//
+// Numbers below the sieve limit are looked up in a sieve of Eratosthenes,
+// built once at startup (one bit per odd number, so 1MiB for the default
+// limit). Anything larger is looked up in an LRU cache of recent results,
+// and only tested (see IsPrime) on a miss.
+
+// Default sieve limit: primes below this are looked up, not tested
+const DEFAULT_SIEVE_LIMIT = 1 << 24
+
+// Largest sieve limit allowed (a 64MiB sieve, taking a few seconds to build)
+const MAX_SIEVE_LIMIT = 1 << 30
+
+// Default number of results kept in the LRU cache
+const DEFAULT_CACHE_SIZE = 100_000
+
+// CacheOptions configure the sieve and cache, 0 disables either
+type CacheOptions struct {
+	SieveLimit uint64 // Look up numbers below this in the sieve
+	CacheSize  int    // Keep this many recent results for larger numbers
+}
+
+// DefaultCacheOptions are used by the shared checker (built on first use),
+// and can be changed from the command line (see RegisterFlags)
+var DefaultCacheOptions = CacheOptions{SieveLimit: DEFAULT_SIEVE_LIMIT, CacheSize: DEFAULT_CACHE_SIZE}
+
+// registerCacheFlags adds -prime-sieve-limit and -prime-cache-size to the
+// flag set, setting DefaultCacheOptions
+func registerCacheFlags(fs *flag.FlagSet) {
+	fs.Uint64Var(&DefaultCacheOptions.SieveLimit, "prime-sieve-limit", DefaultCacheOptions.SieveLimit,
+		fmt.Sprintf("look up prime-time numbers below this in a sieve (0 to disable, at most %d)", MAX_SIEVE_LIMIT))
+	fs.IntVar(&DefaultCacheOptions.CacheSize, "prime-cache-size", DefaultCacheOptions.CacheSize,
+		"prime-time primality results to cache, for larger numbers (0 to disable)")
+}
+
+// Primality lookups, by result: "sieve", "hit" or "miss" (in the cache)
+var cacheLookups = metrics.NewCounter("protohackers_primetime_cache_lookups_total",
+	"Primality lookups, by where they were answered: sieve, hit or miss (in the cache)", "result")
+
+// Checker answers primality lookups from a sieve and cache, falling back
+// to testing (safe for concurrent use)
+type Checker struct {
+	sieve *Sieve
+	cache *lruCache
+}
+
+// NewChecker builds a checker (including the sieve, which takes a moment)
+func NewChecker(options CacheOptions) (*Checker, error) {
+	if options.SieveLimit > MAX_SIEVE_LIMIT {
+		return nil, fmt.Errorf("sieve limit %d is over the maximum of %d", options.SieveLimit, MAX_SIEVE_LIMIT)
+	}
+	return &Checker{sieve: NewSieve(options.SieveLimit), cache: newLRUCache(options.CacheSize)}, nil
+}
+
+// The checker shared by every connection, see DefaultCacheOptions
+var sharedChecker = sync.OnceValues(func() (*Checker, error) {
+	return NewChecker(DefaultCacheOptions)
+})
+
+// IsPrime reports whether n is prime, see IsPrime
+func (c *Checker) IsPrime(n *big.Int) bool {
+	if n.Sign() <= 0 {
+		return false
+	}
+	if n.IsUint64() && n.Uint64() < c.sieve.Limit() {
+		cacheLookups.Inc("sieve")
+		return c.sieve.IsPrime(n.Uint64())
+	}
+
+	// (Keyed by the number's bytes, as it's always positive)
+	key := string(n.Bytes())
+	if isPrime, ok := c.cache.get(key); ok {
+		cacheLookups.Inc("hit")
+		return isPrime
+	}
+	cacheLookups.Inc("miss")
+
+	isPrime := IsPrime(n)
+	c.cache.add(key, isPrime)
+	return isPrime
+}
+
+//
+// === SIEVE === //
+//
+
+// Sieve records which numbers below a limit are prime
+type Sieve struct {
+	limit     uint64
+	composite []uint64 // bit i is set if 2i+1 is composite
+}
+
+// NewSieve finds the primes below limit
+func NewSieve(limit uint64) *Sieve {
+	s := &Sieve{limit: limit, composite: make([]uint64, (limit/2+63)/64)}
+	for p := uint64(3); p*p < limit; p += 2 {
+		if !s.IsPrime(p) {
+			continue
+		}
+		// (Smaller multiples were crossed off by smaller primes)
+		for multiple := p * p; multiple < limit; multiple += 2 * p {
+			i := multiple / 2
+			s.composite[i/64] |= 1 << (i % 64)
+		}
+	}
+	return s
+}
+
+// Limit returns the sieve's limit, it only knows about numbers below this
+func (s *Sieve) Limit() uint64 {
+	return s.limit
+}
+
+// IsPrime reports whether n (below the limit) is prime
+func (s *Sieve) IsPrime(n uint64) bool {
+	switch {
+	case n < 2:
+		return false
+	case n == 2:
+		return true
+	case n%2 == 0:
+		return false
+	}
+	i := n / 2
+	return s.composite[i/64]&(1<<(i%64)) == 0
+}
+
+//
+// === CACHE === //
+//
+
+// lruCache holds the most recently used primality results
+type lruCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List               // most recently used first
+	entries map[string]*list.Element // key -> element holding a *cacheEntry
+}
+
+type cacheEntry struct {
+	key     string
+	isPrime bool
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns a cached result, marking it as recently used
+func (c *lruCache) get(key string) (isPrime, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).isPrime, true
+}
+
+// add caches a result, evicting the least recently used beyond the size
+func (c *lruCache) add(key string, isPrime bool) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, isPrime: isPrime})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// len returns the number of cached results
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -1,77 +1,168 @@
-package main
+package primetime
 
 import (
-	"bufio"
-	"fmt"
-	"io"
-	"math/big"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"net"
-	"os"
-	"strings"
+	"time"
 
-	"github.com/finwarman/protohackers/src/lib/json"
+	"github.com/finwarman/protohackers/src/lib/dispatch"
+	"github.com/finwarman/protohackers/src/lib/lines"
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/metrics"
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
-const TCP_PORT = 25565
+// Default tcp port for server
+const DEFAULT_TCP_PORT = 25565
 
-func main() {
-	StartServer(TCP_PORT)
+// Longest request line accepted, see OVERSIZE_POLICY. This is what limits
+// the size of numbers, to about 1000 digits for isPrime (3300 bits, which
+// take up to around 0.5s to test, see primes.go)
+const MAX_LINE_LENGTH = 1024
+
+// Oversize requests get a malformed response
+const OVERSIZE_POLICY = lines.MALFORMED
+
+// Problem name, for logs and metrics
+const PROBLEM = "prime-time"
+
+// Logger for this problem
+var logger = logging.Named(PROBLEM)
+
+// Options for the prime-time server
+type Options struct {
+	// Answer each connection's requests on this many workers at once
+	// (responses are still sent in order, see pipeline.go), 0 or 1 to
+	// answer them one at a time
+	Workers int
+
+	// Disconnect clients after their first malformed request (answering it
+	// straight away, without waiting for any requests before it)
+	AbortOnMalformed bool
+
+	// Read requests exactly as the spec says: numbers must be valid JSON,
+	// and are only integers if written as one (so 3.0 and 1e3 aren't prime)
+	Strict bool
+
+	// What to do about repeated keys (e.g. two "number"s), last wins by default
+	DuplicateKeys dispatch.DuplicatePolicy
 }
 
-func StartServer(port int) {
-	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+// RegisterFlags adds -prime-workers, -prime-abort-on-malformed,
+// -prime-strict and -prime-duplicate-keys to the flag set, returning the
+// options they populate (plus -prime-sieve-limit and -prime-cache-size,
+// see DefaultCacheOptions)
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	registerCacheFlags(fs)
+
+	options := &Options{}
+	fs.IntVar(&options.Workers, "prime-workers", 0,
+		"answer up to this many prime-time requests per connection at once, responding in order (0 for one at a time)")
+	fs.BoolVar(&options.AbortOnMalformed, "prime-abort-on-malformed", false,
+		"disconnect prime-time clients after their first malformed request")
+	fs.BoolVar(&options.Strict, "prime-strict", false,
+		"only accept JSON numbers, and only treat ones written as integers as integers (3.0 isn't prime)")
+	fs.Func("prime-duplicate-keys", "`policy` for keys repeated in prime-time requests: last (default), first or reject",
+		func(s string) (err error) {
+			options.DuplicateKeys, err = dispatch.ParseDuplicatePolicy(s)
+			return err
+		})
+	return options
+}
+
+// StartServer runs the server on the given port, until the context is cancelled
+func StartServer(ctx context.Context, port int, options Options, settings server.Settings) error {
+	srv, err := NewServer(port, options, settings)
 	if err != nil {
-		fmt.Println("listen: ", err.Error())
-		os.Exit(1)
+		return err
 	}
 
-	fmt.Printf("listening on port %d\n", port)
+	return srv.Serve(ctx)
+}
 
-	// Create a goroutine with a connection handler,
-	// for each new connection. (Must handle at least 5)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println("accept: ", err.Error())
-			os.Exit(1)
-		}
+// NewServer creates a prime-time server listening on the given port
+// (0 picks a free port, see Addr)
+func NewServer(port int, options Options, settings server.Settings) (*server.Server, error) {
+	// Build the shared sieve now, rather than on the first request
+	if _, err := sharedChecker(); err != nil {
+		return nil, err
+	}
 
-		fmt.Println("connection from ", conn.RemoteAddr())
+	config := server.Config{Name: PROBLEM, Host: "localhost", Port: port, Logger: logger, Settings: settings}
 
-		go HandleConnection(conn)
+	// Clients over the limits get a malformed response
+	config.Reject = func(conn net.Conn, err error) {
+		_, _ = conn.Write([]byte(string(MALFORMED_RESPONSE) + "\n"))
 	}
+
+	// Handle each new connection in its own goroutine (must handle at least 5)
+	return server.Listen(config, server.HandlerFunc(func(conn net.Conn) {
+		HandleConnection(conn, options)
+	}))
 }
 
-func HandleConnection(conn net.Conn) {
+func HandleConnection(conn net.Conn, options Options) {
 	defer conn.Close()
 
-	// Buffer for storing received data
-	reader := bufio.NewReader(conn)
+	log := logging.ForConn(logger, conn)
+
+	// Reads requests, one per line
+	reader := lines.NewReader(conn, MAX_LINE_LENGTH, OVERSIZE_POLICY)
+
+	// Answers them
+	d := dispatcher.WithOptions(dispatch.Options{Strict: options.Strict, DuplicateKeys: options.DuplicateKeys})
+
+	// Answer several requests at once, if enabled
+	if options.Workers > 1 {
+		handlePipelined(conn, reader, d, log, options)
+		return
+	}
 
 	// While connection is open, check for data to read
 	for {
-		// Read data until newline character
-		data, err := reader.ReadString('\n')
+		data, err := reader.ReadLine()
+		if err == lines.ErrTooLong {
+			// Oversize requests are malformed (the rest of the line is skipped)
+			log.Debug("malformed request: line too long", "max_length", MAX_LINE_LENGTH)
+			requestsTotal.Inc(UNKNOWN_METHOD, "malformed")
+			if _, err := conn.Write([]byte(string(MALFORMED_RESPONSE) + "\n")); err != nil {
+				log.Warn("write error", "error", err)
+				break
+			}
+			if options.AbortOnMalformed {
+				log.Info("disconnecting", "reason", "malformed request")
+				break
+			}
+			continue
+		}
 		if err != nil {
-			if err != io.EOF {
-				fmt.Println("read error:", err.Error())
+			server.LogReadError(log, err)
+
+			// Timed out: say goodbye with a malformed response
+			if server.IsTimeout(err) {
+				_, _ = conn.Write([]byte(string(MALFORMED_RESPONSE) + "\n"))
 			}
 			break
 		}
 
-		// Trim newline character
-		data = strings.TrimSuffix(data, "\n")
-
-		// [Debug] Print received data to STDOUT
-		fmt.Printf("received: %s\n", data)
+		log.Debug("received", "data", data)
 
 		// Handle JSON request
-		response := handleJSON(data)
-		fmt.Printf("sending response: %s\n", response)
+		start := time.Now()
+		response, err := handleJSON(d, data, log)
+		server.RequestDuration.Since(start, PROBLEM)
+		log.Debug("sending response", "response", string(response))
 
 		// Send response, terminated with newline
 		if _, err := conn.Write([]byte(string(response) + "\n")); err != nil {
-			fmt.Println("write error:", err.Error())
+			log.Warn("write error", "error", err)
+			break
+		}
+		if err != nil && options.AbortOnMalformed {
+			log.Info("disconnecting", "reason", "malformed request")
 			break
 		}
 	}
@@ -79,11 +170,63 @@ func HandleConnection(conn net.Conn) {
 
 var MALFORMED_RESPONSE []byte = []byte("[]")
 
-// Validate JSON request:
+// Requests handled, by method and result: "prime" or "not_prime" (for
+// isPrime), "ok" (for the other methods), "malformed" or "over_limit"
+var requestsTotal = metrics.NewCounter("protohackers_primetime_requests_total",
+	"Requests handled, by method (unknown for unparseable requests and unknown methods) and result", "method", "result")
+
+// Method label for requests without a known method (so clients can't add labels)
+const UNKNOWN_METHOD = "unknown"
+
+// Requests are answered by method, see isPrime (and methods.go for the others)
+var dispatcher = newDispatcher()
+
+func newDispatcher() *dispatch.Dispatcher {
+	d := dispatch.New(MALFORMED_RESPONSE)
+	d.Register(dispatch.Method{
+		Name:    "isPrime",
+		Params:  []dispatch.Param{{Name: "number", Type: dispatch.NUMBER}},
+		Handler: isPrime,
+	})
+	d.Register(METHODS...)
+	return d
+}
+
+// handleJSON answers a request, or returns a malformed response and why
+// (see lib/dispatch, which validates requests against each method's schema)
+func handleJSON(d *dispatch.Dispatcher, data string, log *slog.Logger) ([]byte, error) {
+	response, method, err := d.Handle(data, log)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrOverLimit):
+		log.Info("malformed request: over method limits", "method", method, "error", err)
+	default:
+		log.Debug("malformed request", "method", method, "error", err, "data", data)
+	}
+
+	label := method
+	if !d.Has(method) {
+		label = UNKNOWN_METHOD
+	}
+	switch {
+	case errors.Is(err, ErrOverLimit):
+		requestsTotal.Inc(label, "over_limit")
+	case err != nil:
+		requestsTotal.Inc(label, "malformed")
+	case method != "isPrime":
+		requestsTotal.Inc(label, "ok")
+	}
+	// (isPrime's results are counted as it answers, see isPrime)
+	return response, err
+}
+
+// isPrime validates JSON request:
 // Input must:
 //   - Be valid JSON
 //   - Have `/method` = "isPrime"
-//   - Type of `/number` is number
+//   - Type of `/number` is number (integers of any size are exact, see primes.go,
+//     and results are cached, see cache.go)
 //   - Extraneous fields are ignored
 //
 // Uses the JSON parser `github.comfinwarman/protohacker/src/lib/json` -
@@ -96,58 +239,28 @@ var MALFORMED_RESPONSE []byte = []byte("[]")
 // If request is malformed, send a malformed response
 //
 //	e.g. '[]'
-func handleJSON(data string) []byte {
-	parsedValue, err := json.ParseJSON(data)
-	if err != nil {
-		fmt.Printf("parsing error:\n%v\n\ninput data:%s\n\n", err, data)
-		return MALFORMED_RESPONSE
+func isPrime(params dispatch.Params) (any, error) {
+	number := params.Integer("number")
+	if number == nil {
+		// wrong number format, but not malformed
+		requestsTotal.Inc("isPrime", "not_prime")
+		return isPrimeResponse{Method: "isPrime", Prime: false}, nil
 	}
 
-	fmt.Printf("parsed JSON value:\n%v\n", parsedValue)
-
-	parsedValueMapGeneric := json.ConvertToNative(parsedValue)
-
-	// Convert to `string: object`
-	parsedValueMap, ok := parsedValueMapGeneric.(map[string]interface{})
-	if !ok {
-		fmt.Println("incorrect type or invalid object ")
-		return MALFORMED_RESPONSE
-	}
-
-	// get parsedValueMap["method"] string
-	method, ok := parsedValueMap["method"].(string)
-	if !ok {
-		fmt.Println("`/method` not found or not type string")
-		return MALFORMED_RESPONSE
-	} else {
-		fmt.Printf("got method: %s\n", method)
-	}
-
-	// validate method used
-	if method != "isPrime" {
-		fmt.Println("`/method` was not `isPrime`")
-		return MALFORMED_RESPONSE
-	}
-
-	// wrong number format, but not malformed
-	float, ok := parsedValueMap["number"].(float64)
-	if ok {
-		fmt.Printf("`/number` was a float %f, not int\n", float)
-		return []byte("{\"method\":\"isPrime\",\"prime\":false}")
+	checker, err := sharedChecker()
+	if err != nil {
+		return nil, err
 	}
-
-	// get parsedValueMap["number"] int
-	number, ok := parsedValueMap["number"].(int)
-	if !ok {
-		fmt.Println("`/number` not found or not type number (int)")
-		return MALFORMED_RESPONSE
+	prime := checker.IsPrime(number)
+	if prime {
+		requestsTotal.Inc("isPrime", "prime")
 	} else {
-		fmt.Printf("got number: %d\n", number)
+		requestsTotal.Inc("isPrime", "not_prime")
 	}
+	return isPrimeResponse{Method: "isPrime", Prime: prime}, nil
+}
 
-	// return properly-formed response
-	isPrime := big.NewInt(int64(number)).ProbablyPrime(0)
-	returnJSONStr := fmt.Sprintf("{\"method\":\"isPrime\",\"prime\":%t}", isPrime)
-
-	return []byte(returnJSONStr)
+type isPrimeResponse struct {
+	Method string `json:"method"`
+	Prime  bool   `json:"prime"`
 }
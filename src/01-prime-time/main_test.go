@@ -1,24 +1,48 @@
-package main
+package primetime
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/finwarman/protohackers/src/lib/dispatch"
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
-const TEST_TCP_PORT = 44444
+// startTestServer starts the server on a free port, returning the address
+// to connect to (the server is stopped when the test completes)
+func startTestServer(t *testing.T, options Options) string {
+	return startTestServerWith(t, options, server.Settings{})
+}
 
-var TEST_CONNECT_STR = fmt.Sprintf("localhost:%d", TEST_TCP_PORT)
+// startTestServerWith starts the server with the given settings (timeouts,
+// limits, ...), see startTestServer
+func startTestServerWith(t *testing.T, options Options, settings server.Settings) string {
+	srv, err := NewServer(0, options, settings)
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	go srv.Serve(context.Background())
+	t.Cleanup(func() { srv.Close() })
+
+	return srv.Addr().String()
+}
 
 func TestEchoServer(t *testing.T) {
-	go StartServer(TEST_TCP_PORT)      // Start the server in a goroutine
-	time.Sleep(time.Millisecond * 500) // (Wait for the server to start)
+	addr := startTestServer(t, Options{})
 
 	// Connect to the server
-	conn, err := net.Dial("tcp", TEST_CONNECT_STR)
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
@@ -41,6 +65,15 @@ func TestEchoServer(t *testing.T) {
 		{"{\"method\":\"isPrime\",\"number\":7.123}\n", "false"},
 		{"{\"method\":\"isPrime\",\"number\":13441.123}\n", "false"},
 
+		// Integers beyond int64, and float64's exact range
+		{"{\"method\":\"isPrime\",\"number\":18446744073709551557}\n", "true"},
+		{"{\"method\":\"isPrime\",\"number\":9007199254740993}\n", "false"},
+		{"{\"method\":\"isPrime\",\"number\":18446744073709551617}\n", "false"},
+		{"{\"method\":\"isPrime\",\"number\":170141183460469231731687303715884105727}\n", "true"},
+		{"{\"method\":\"isPrime\",\"number\":-170141183460469231731687303715884105727}\n", "false"},
+		{"{\"method\":\"isPrime\",\"number\":5.0}\n", "true"},
+		{"{\"method\":\"isPrime\",\"number\":1e2}\n", "false"},
+
 		{"{\"method\":\"isPrime\",\"number\":\"abc\"}\n", "malformed"},
 		{"{\"method\":\"something\",\"number\":\"abc\"}\n", "malformed"},
 		{"{\"method\":\"isPrime\",\"number\":\"123\"}\n", "malformed"},
@@ -68,3 +101,584 @@ func TestEchoServer(t *testing.T) {
 		}
 	}
 }
+
+func TestIdleTimeout(t *testing.T) {
+	settings := server.Settings{Timeouts: server.Timeouts{Idle: 100 * time.Millisecond}}
+	addr := startTestServerWith(t, Options{}, settings)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// A silent client is sent a malformed response, then disconnected
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+
+	response, err := reader.ReadString('\n')
+	if err != nil || response != string(MALFORMED_RESPONSE)+"\n" {
+		t.Fatalf("Expected malformed response on timeout, got %q (%v)", response, err)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected EOF after timeout, got %v", err)
+	}
+}
+
+func TestOversizeRequest(t *testing.T) {
+	addr := startTestServer(t, Options{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// An oversize request is malformed, but the next line is still handled
+	oversize := `{"method":"isPrime","number":7,"padding":"` + strings.Repeat("x", MAX_LINE_LENGTH) + `"}`
+	fmt.Fprint(conn, oversize+"\n")
+	fmt.Fprint(conn, `{"method":"isPrime","number":7}`+"\n")
+
+	for _, expected := range []string{"[]\n", `{"method":"isPrime","prime":true}` + "\n"} {
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read from connection: %v", err)
+		}
+		if response != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, response)
+		}
+	}
+}
+
+func TestIsPrime64(t *testing.T) {
+	primes := []uint64{2, 3, 5, 37, 41, 7919, 2147483647, 2305843009213693951, 18446744073709551557}
+	composites := []uint64{0, 1, 4, 9, 561, 1105, 2047, 1373653, 25326001, 3215031751,
+		2152302898747, 3474749660383, 341550071728321, 3825123056546413051,
+		4611686018427387903, 18446744073709551615}
+
+	// (Including strong pseudoprimes to the first few bases, and Carmichael numbers)
+	for _, p := range primes {
+		if !IsPrime64(p) {
+			t.Fatalf("Expected %d to be prime", p)
+		}
+	}
+	for _, c := range composites {
+		if IsPrime64(c) {
+			t.Fatalf("Expected %d not to be prime", c)
+		}
+	}
+
+	// Agrees with big.Int's test (exact below 2^64) across a range of sizes
+	for i := uint64(0); i < 10_000; i++ {
+		for _, n := range []uint64{i, 1<<32 + i, 1<<63 + i, math.MaxUint64 - i} {
+			if expected := new(big.Int).SetUint64(n).ProbablyPrime(0); IsPrime64(n) != expected {
+				t.Fatalf("Expected IsPrime64(%d) to be %t", n, expected)
+			}
+		}
+	}
+}
+
+func TestIsPrime(t *testing.T) {
+	mersenne := func(p uint) *big.Int {
+		n := new(big.Int).Lsh(big.NewInt(1), p)
+		return n.Sub(n, big.NewInt(1))
+	}
+
+	tests := []struct {
+		n        *big.Int
+		expected bool
+	}{
+		{big.NewInt(-7), false},
+		{big.NewInt(0), false},
+		{big.NewInt(97), true},
+		{mersenne(89), true},
+		{mersenne(521), true},
+		{mersenne(523), false},
+		{new(big.Int).Mul(mersenne(89), mersenne(107)), false},
+		{new(big.Int).Lsh(big.NewInt(1), 10_000), false}, // (even)
+		{new(big.Int).Mul(big.NewInt(3), mersenne(4423)), false},
+		{mersenne(2203), true},
+		{mersenne(2207), false}, // (no small factors)
+	}
+
+	for _, test := range tests {
+		if isPrime := IsPrime(test.n); isPrime != test.expected {
+			t.Fatalf("Expected IsPrime to be %t for a %d bit number, got %t",
+				test.expected, test.n.BitLen(), isPrime)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	addr := startTestServer(t, Options{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{`{"method":"factorize","number":60}`, `{"method":"factorize","factors":[2,2,3,5]}`},
+		{`{"method":"factorize","number":1}`, `{"method":"factorize","factors":[]}`},
+		{`{"method":"factorize","number":18446743979220271189}`, `{"method":"factorize","factors":[4294967279,4294967291]}`},
+		{`{"method":"factorize","number":6.0}`, `{"method":"factorize","factors":[2,3]}`},
+		{`{"method":"factorize","number":0}`, "[]"},
+		{`{"method":"factorize","number":-6}`, "[]"},
+		{`{"method":"factorize","number":6.5}`, "[]"},
+		{`{"method":"factorize","number":18446744073709551616}`, "[]"}, // (over 64 bits)
+
+		{`{"method":"nextPrime","number":13}`, `{"method":"nextPrime","prime":17}`},
+		{`{"method":"nextPrime","number":-100}`, `{"method":"nextPrime","prime":2}`},
+		{`{"method":"nextPrime","number":2}`, `{"method":"nextPrime","prime":3}`},
+		{`{"method":"nextPrime","number":18446744073709551557}`, `{"method":"nextPrime","prime":18446744073709551629}`},
+		{`{"method":"nextPrime","number":"13"}`, "[]"},
+		{`{"method":"nextPrime","number":1e200}`, "[]"}, // (over MAX_NEXT_PRIME_BITS)
+
+		{`{"method":"primeCount","min":1,"max":10}`, `{"method":"primeCount","count":4}`},
+		{`{"method":"primeCount","min":-50,"max":100}`, `{"method":"primeCount","count":25}`},
+		{`{"method":"primeCount","min":10,"max":1}`, `{"method":"primeCount","count":0}`},
+		{`{"method":"primeCount","min":0,"max":1000000}`, "[]"}, // (over MAX_RANGE_WIDTH)
+		{`{"method":"primeCount","min":0}`, "[]"},
+
+		{`{"method":"primesInRange","min":1,"max":10}`, `{"method":"primesInRange","primes":[2,3,5,7],"truncated":false}`},
+		{`{"method":"primesInRange","min":18446744073709551550,"max":18446744073709551615}`,
+			`{"method":"primesInRange","primes":[18446744073709551557],"truncated":false}`},
+		{`{"method":"primesInRange","min":-10,"max":-1}`, `{"method":"primesInRange","primes":[],"truncated":false}`},
+		{`{"method":"primesInRange","min":1,"max":18446744073709551616}`, "[]"},
+
+		{`{"method":"isComposite","number":4}`, "[]"},
+	}
+
+	for _, test := range tests {
+		fmt.Fprint(conn, test.message+"\n")
+
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read from connection: %v", err)
+		}
+		if response != test.expected+"\n" {
+			t.Fatalf("Expected '%s' for %s, got '%s'", test.expected, test.message, response)
+		}
+	}
+}
+
+func TestFactorize64(t *testing.T) {
+	// Factors multiply back to the number, and are all prime
+	for _, base := range []uint64{0, 1 << 32, 1 << 62, math.MaxUint64 - 2000} {
+		for n := base + 1; n <= base+1000; n++ {
+			product := uint64(1)
+			for _, factor := range Factorize64(n) {
+				if !IsPrime64(factor) {
+					t.Fatalf("Expected only prime factors of %d, got %d", n, factor)
+				}
+				product *= factor
+			}
+			if product != n {
+				t.Fatalf("Expected the factors of %d to multiply back to it, got %d", n, product)
+			}
+		}
+	}
+}
+
+func TestPrimesInRangeLimits(t *testing.T) {
+	// The first MAX_RANGE_RESULTS primes, with more cut off
+	params := dispatch.Params{"min": big.NewInt(0), "max": big.NewInt(MAX_RANGE_WIDTH - 1)}
+	response, err := primesInRange(params)
+	if err != nil {
+		t.Fatalf("Failed to list primes: %v", err)
+	}
+	// (7919 is the 1000th prime)
+	primes := response.(primesInRangeResponse)
+	if len(primes.Primes) != MAX_RANGE_RESULTS || primes.Primes[len(primes.Primes)-1] != 7919 || !primes.Truncated {
+		t.Fatalf("Expected %d primes, truncated, got %+v", MAX_RANGE_RESULTS, primes)
+	}
+
+	// (The widest range near 2^64 is still quick)
+	start := time.Now()
+	params = dispatch.Params{
+		"min": new(big.Int).SetUint64(math.MaxUint64 - MAX_RANGE_WIDTH + 1),
+		"max": new(big.Int).SetUint64(math.MaxUint64),
+	}
+	if _, err := primeCount(params); err != nil {
+		t.Fatalf("Failed to count primes: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the widest range to take under a second, took %s", elapsed)
+	}
+
+	params["min"] = new(big.Int).SetUint64(math.MaxUint64 - MAX_RANGE_WIDTH)
+	if _, err := primeCount(params); !errors.Is(err, ErrOverLimit) {
+		t.Fatalf("Expected ErrOverLimit for a range too wide, got %v", err)
+	}
+}
+
+// Registers a "testSleep" method, which answers after `/ms` milliseconds
+var registerSleep = sync.OnceFunc(func() {
+	dispatcher.Register(dispatch.Method{
+		Name:   "testSleep",
+		Params: []dispatch.Param{{Name: "ms", Type: dispatch.INTEGER}},
+		Handler: func(params dispatch.Params) (any, error) {
+			ms := params.Integer("ms").Int64()
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+			return map[string]any{"method": "testSleep", "ms": ms}, nil
+		},
+	})
+})
+
+// exchange sends requests all at once, then reads a response for each
+// (or until the connection closes), returning them and how long they took
+func exchange(t *testing.T, addr string, requests ...string) ([]string, time.Duration) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	fmt.Fprint(conn, strings.Join(requests, "\n")+"\n")
+
+	reader := bufio.NewReader(conn)
+	var responses []string
+	for range requests {
+		response, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read from connection: %v", err)
+		}
+		responses = append(responses, strings.TrimSuffix(response, "\n"))
+	}
+	return responses, time.Since(start)
+}
+
+func TestPipelined(t *testing.T) {
+	registerSleep()
+	addr := startTestServer(t, Options{Workers: 4})
+
+	// Responses come back in order, even when later requests finish first
+	responses, elapsed := exchange(t, addr,
+		`{"method":"testSleep","ms":300}`,
+		`{"method":"isPrime","number":7}`,
+		`{"method":"testSleep","ms":200}`,
+		`{"method":"testSleep","ms":200}`,
+		`nonsense`,
+		`{"method":"isPrime","number":8}`,
+	)
+	expected := []string{
+		`{"method":"testSleep","ms":300}`,
+		`{"method":"isPrime","prime":true}`,
+		`{"method":"testSleep","ms":200}`,
+		`{"method":"testSleep","ms":200}`,
+		"[]",
+		`{"method":"isPrime","prime":false}`,
+	}
+	if strings.Join(responses, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected responses in order %q, got %q", expected, responses)
+	}
+
+	// (Sleeping at the same time, not one after another)
+	if elapsed > 600*time.Millisecond {
+		t.Fatalf("Expected requests to be answered concurrently, took %s", elapsed)
+	}
+}
+
+func TestPipelinedBackpressure(t *testing.T) {
+	addr := startTestServer(t, Options{Workers: 2})
+
+	// More requests than can be read ahead are all still answered
+	requests := make([]string, 4*MAX_PIPELINED)
+	for i := range requests {
+		requests[i] = fmt.Sprintf(`{"method":"isPrime","number":%d}`, i)
+	}
+	responses, _ := exchange(t, addr, requests...)
+	if len(responses) != len(requests) {
+		t.Fatalf("Expected %d responses, got %d", len(requests), len(responses))
+	}
+	for i, response := range responses {
+		if expected := fmt.Sprintf(`{"method":"isPrime","prime":%t}`, IsPrime64(uint64(i))); response != expected {
+			t.Fatalf("Expected response %d to be %s, got %s", i, expected, response)
+		}
+	}
+}
+
+func TestAbortOnMalformed(t *testing.T) {
+	registerSleep()
+
+	// One at a time: answered up to the malformed request, then disconnected
+	addr := startTestServer(t, Options{AbortOnMalformed: true})
+	responses, _ := exchange(t, addr,
+		`{"method":"isPrime","number":7}`,
+		`{"method":"isPrime"}`,
+		`{"method":"isPrime","number":7}`,
+	)
+	if expected := []string{`{"method":"isPrime","prime":true}`, "[]"}; strings.Join(responses, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected %q, then a disconnect, got %q", expected, responses)
+	}
+
+	// Pipelined: the malformed response comes straight away, without
+	// waiting for requests in flight before it
+	addr = startTestServer(t, Options{Workers: 4, AbortOnMalformed: true})
+	responses, elapsed := exchange(t, addr,
+		`{"method":"testSleep","ms":1000}`,
+		`{"method":"isPrime","number":"7"}`,
+		`{"method":"isPrime","number":7}`,
+	)
+	if len(responses) != 1 || responses[0] != "[]" {
+		t.Fatalf("Expected only a malformed response, then a disconnect, got %q", responses)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected to be disconnected without waiting for requests in flight, took %s", elapsed)
+	}
+
+	// (Including oversize requests)
+	responses, _ = exchange(t, addr,
+		`{"method":"testSleep","ms":1000}`,
+		strings.Repeat("x", MAX_LINE_LENGTH+1),
+	)
+	if len(responses) != 1 || responses[0] != "[]" {
+		t.Fatalf("Expected only a malformed response, then a disconnect, got %q", responses)
+	}
+}
+
+func TestSieve(t *testing.T) {
+	for _, limit := range []uint64{0, 1, 2, 3, 10, 1000, 100_001} {
+		sieve := NewSieve(limit)
+		for n := uint64(0); n < limit; n++ {
+			if sieve.IsPrime(n) != IsPrime64(n) {
+				t.Fatalf("Expected the sieve up to %d to agree that IsPrime64(%d) is %t", limit, n, IsPrime64(n))
+			}
+		}
+	}
+}
+
+func TestChecker(t *testing.T) {
+	checker, err := NewChecker(CacheOptions{SieveLimit: 1000, CacheSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+
+	// Small numbers are answered from the sieve, larger ones are cached
+	for _, n := range []int64{-7, 0, 997, 999, 1009, 1011, 1013, 1009} {
+		if isPrime := checker.IsPrime(big.NewInt(n)); isPrime != IsPrime64(uint64(max(n, 0))) {
+			t.Fatalf("Expected IsPrime(%d) to be %t, got %t", n, IsPrime64(uint64(max(n, 0))), isPrime)
+		}
+	}
+	if size := checker.cache.len(); size != 2 {
+		t.Fatalf("Expected the cache to be full with 2 results, got %d", size)
+	}
+
+	// (The least recently used result was evicted)
+	if _, ok := checker.cache.get(string(big.NewInt(1011).Bytes())); ok {
+		t.Fatalf("Expected 1011 to have been evicted")
+	}
+	if _, ok := checker.cache.get(string(big.NewInt(1009).Bytes())); !ok {
+		t.Fatalf("Expected 1009 to still be cached")
+	}
+
+	// Numbers of any size are answered (and cached)
+	huge := new(big.Int).Lsh(big.NewInt(1), 2203)
+	huge.Sub(huge, big.NewInt(1)) // (a Mersenne prime)
+	if !checker.IsPrime(huge) {
+		t.Fatalf("Expected 2^2203-1 to be prime")
+	}
+	if isPrime, ok := checker.cache.get(string(huge.Bytes())); !ok || !isPrime {
+		t.Fatalf("Expected 2^2203-1 to be cached as prime")
+	}
+
+	if _, err := NewChecker(CacheOptions{SieveLimit: MAX_SIEVE_LIMIT + 1}); err == nil {
+		t.Fatalf("Expected an error for a sieve over the limit")
+	}
+}
+
+//
+// === BENCHMARKS === //
+//
+
+// benchmarkChecker compares testing each number directly with the checker
+// (sieve and cache), cycling through the numbers
+func benchmarkChecker(b *testing.B, numbers []*big.Int) {
+	b.Run("direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = IsPrime(numbers[i%len(numbers)])
+		}
+	})
+	b.Run("checker", func(b *testing.B) {
+		checker, _ := NewChecker(DefaultCacheOptions)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = checker.IsPrime(numbers[i%len(numbers)])
+		}
+	})
+}
+
+// Small numbers, as sent by load tests (all in the sieve)
+func BenchmarkSmallNumbers(b *testing.B) {
+	numbers := make([]*big.Int, 10_000)
+	for i := range numbers {
+		numbers[i] = big.NewInt(int64(i * 997 % DEFAULT_SIEVE_LIMIT))
+	}
+	benchmarkChecker(b, numbers)
+}
+
+// A few large numbers, repeated (all cached after the first round)
+func BenchmarkRepeatedLargeNumbers(b *testing.B) {
+	numbers := make([]*big.Int, 100)
+	for i := range numbers {
+		n := new(big.Int).Lsh(big.NewInt(1), 127)
+		numbers[i] = n.Add(n, big.NewInt(int64(2*i+1)))
+	}
+	benchmarkChecker(b, numbers)
+}
+
+// Distinct 64-bit numbers (all misses, the cache's worst case)
+func BenchmarkDistinctNumbers(b *testing.B) {
+	numbers := make([]*big.Int, 1<<20)
+	for i := range numbers {
+		numbers[i] = new(big.Int).SetUint64(math.MaxUint64 - uint64(i))
+	}
+	benchmarkChecker(b, numbers)
+}
+
+// Whole requests, from parsing to the response
+func BenchmarkHandleJSON(b *testing.B) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	requests := []string{
+		`{"method":"isPrime","number":7919}`,
+		`{"method":"isPrime","number":123456}`,
+		`{"method":"isPrime","number":170141183460469231731687303715884105727}`,
+	}
+	for i := 0; i < b.N; i++ {
+		_, _ = handleJSON(dispatcher, requests[i%len(requests)], log)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	loose := dispatcher.WithOptions(dispatch.Options{})
+	strict := dispatcher.WithOptions(dispatch.Options{Strict: true})
+
+	const PRIME = `{"method":"isPrime","prime":true}`
+	const NOT_PRIME = `{"method":"isPrime","prime":false}`
+	const MALFORMED = "[]"
+
+	// (A 2203 bit Mersenne prime, 664 digits)
+	huge := new(big.Int).Lsh(big.NewInt(1), 2203)
+	huge.Sub(huge, big.NewInt(1))
+
+	// Every edge case in the spec, with the response in each mode
+	tests := []struct {
+		name    string
+		request string
+		loose   string
+		strict  string
+	}{
+		// Well-formed requests
+		{"prime", `{"method":"isPrime","number":7}`, PRIME, PRIME},
+		{"composite", `{"method":"isPrime","number":8}`, NOT_PRIME, NOT_PRIME},
+		{"two", `{"method":"isPrime","number":2}`, PRIME, PRIME},
+		{"one", `{"method":"isPrime","number":1}`, NOT_PRIME, NOT_PRIME},
+		{"zero", `{"method":"isPrime","number":0}`, NOT_PRIME, NOT_PRIME},
+		{"negative zero", `{"method":"isPrime","number":-0}`, NOT_PRIME, NOT_PRIME},
+		{"negative prime", `{"method":"isPrime","number":-7}`, NOT_PRIME, NOT_PRIME},
+		{"over 64 bits", `{"method":"isPrime","number":170141183460469231731687303715884105727}`, PRIME, PRIME},
+		{"over 2048 bits", `{"method":"isPrime","number":` + huge.String() + `}`, PRIME, PRIME},
+		{"extra fields", `{"method":"isPrime","number":7,"extra":{"a":[1,2]}}`, PRIME, PRIME},
+		{"fields reordered", `{"number":7,"method":"isPrime"}`, PRIME, PRIME},
+		{"whitespace", ` { "method" : "isPrime" , "number" : 7 } `, PRIME, PRIME},
+
+		// Non-integers can't be prime (but strict mode goes by how they're written)
+		{"fraction", `{"method":"isPrime","number":7.5}`, NOT_PRIME, NOT_PRIME},
+		{"whole fraction", `{"method":"isPrime","number":7.0}`, PRIME, NOT_PRIME},
+		{"exponent", `{"method":"isPrime","number":7e0}`, PRIME, NOT_PRIME},
+		{"exponent with sign", `{"method":"isPrime","number":70E-1}`, PRIME, NOT_PRIME},
+		{"negative exponent", `{"method":"isPrime","number":7e-1}`, NOT_PRIME, NOT_PRIME},
+		{"huge exponent", `{"method":"isPrime","number":1e400}`, NOT_PRIME, NOT_PRIME},
+
+		// Numbers JSON doesn't allow (the parser's lexer does)
+		{"leading zero", `{"method":"isPrime","number":07}`, PRIME, MALFORMED},
+		{"leading dot", `{"method":"isPrime","number":.5}`, NOT_PRIME, MALFORMED},
+		{"trailing dot", `{"method":"isPrime","number":7.}`, PRIME, MALFORMED},
+		{"underscores", `{"method":"isPrime","number":1_009}`, NOT_PRIME, MALFORMED}, // (loosely, 0)
+		{"hex", `{"method":"isPrime","number":0x7}`, NOT_PRIME, MALFORMED},           // (loosely, 0)
+		{"invalid in extra field", `{"method":"isPrime","number":7,"extra":[01]}`, PRIME, MALFORMED},
+		{"plus sign", `{"method":"isPrime","number":+7}`, MALFORMED, MALFORMED},
+		{"NaN", `{"method":"isPrime","number":NaN}`, MALFORMED, MALFORMED},
+
+		// Malformed requests
+		{"number as string", `{"method":"isPrime","number":"7"}`, MALFORMED, MALFORMED},
+		{"number as bool", `{"method":"isPrime","number":true}`, MALFORMED, MALFORMED},
+		{"number as null", `{"method":"isPrime","number":null}`, MALFORMED, MALFORMED},
+		{"number as array", `{"method":"isPrime","number":[7]}`, MALFORMED, MALFORMED},
+		{"number as object", `{"method":"isPrime","number":{"n":7}}`, MALFORMED, MALFORMED},
+		{"no number", `{"method":"isPrime"}`, MALFORMED, MALFORMED},
+		{"no method", `{"number":7}`, MALFORMED, MALFORMED},
+		{"method as number", `{"method":1,"number":7}`, MALFORMED, MALFORMED},
+		{"method wrong case", `{"method":"IsPrime","number":7}`, MALFORMED, MALFORMED},
+		{"unknown method", `{"method":"isComposite","number":8}`, MALFORMED, MALFORMED},
+		{"array", `["isPrime",7]`, MALFORMED, MALFORMED},
+		{"string", `"isPrime"`, MALFORMED, MALFORMED},
+		{"bare number", `7`, MALFORMED, MALFORMED},
+		{"null", `null`, MALFORMED, MALFORMED},
+		{"empty", ``, MALFORMED, MALFORMED},
+		{"unterminated", `{"method":"isPrime","number":7`, MALFORMED, MALFORMED},
+		{"trailing comma", `{"method":"isPrime","number":7,}`, MALFORMED, MALFORMED},
+		{"trailing data", `{"method":"isPrime","number":7}x`, MALFORMED, MALFORMED},
+		{"two requests", `{"method":"isPrime","number":7}{"method":"isPrime","number":7}`, MALFORMED, MALFORMED},
+		{"unquoted keys", `{method:"isPrime",number:7}`, MALFORMED, MALFORMED},
+	}
+
+	for _, test := range tests {
+		for _, mode := range []struct {
+			name       string
+			dispatcher *dispatch.Dispatcher
+			expected   string
+		}{{"loose", loose, test.loose}, {"strict", strict, test.strict}} {
+			response, _ := handleJSON(mode.dispatcher, test.request, log)
+			if string(response) != mode.expected {
+				t.Errorf("%s (%s): expected %s for %s, got %s", test.name, mode.name, mode.expected, test.request, response)
+			}
+		}
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		request string
+		last    string
+		first   string
+		reject  string
+	}{
+		{`{"method":"isPrime","number":8,"number":7}`,
+			`{"method":"isPrime","prime":true}`, `{"method":"isPrime","prime":false}`, "[]"},
+		{`{"method":"isComposite","method":"isPrime","number":7}`,
+			`{"method":"isPrime","prime":true}`, "[]", "[]"},
+		{`{"method":"isPrime","number":7,"number":"seven"}`,
+			"[]", `{"method":"isPrime","prime":true}`, "[]"},
+		{`{"method":"isPrime","number":7,"extra":1,"extra":2}`,
+			`{"method":"isPrime","prime":true}`, `{"method":"isPrime","prime":true}`, "[]"},
+	}
+
+	for _, test := range tests {
+		for policy, expected := range map[dispatch.DuplicatePolicy]string{
+			"":                         test.last,
+			dispatch.DUPLICATES_LAST:   test.last,
+			dispatch.DUPLICATES_FIRST:  test.first,
+			dispatch.DUPLICATES_REJECT: test.reject,
+		} {
+			d := dispatcher.WithOptions(dispatch.Options{DuplicateKeys: policy})
+			if response, _ := handleJSON(d, test.request, log); string(response) != expected {
+				t.Fatalf("Expected %s for %s with policy %q, got %s", expected, test.request, policy, response)
+			}
+		}
+	}
+}
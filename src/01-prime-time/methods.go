@@ -0,0 +1,160 @@
+package primetime
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/finwarman/protohackers/src/lib/dispatch"
+)
+
+// Number theory methods, besides isPrime, on the same line-delimited JSON
+// protocol (parsed and validated the same way, see lib/dispatch):
+//
+//	{"method":"factorize","number":60}         -> {"method":"factorize","factors":[2,2,3,5]}
+//	{"method":"nextPrime","number":13}         -> {"method":"nextPrime","prime":17}
+//	{"method":"primeCount","min":1,"max":10}    -> {"method":"primeCount","count":4}
+//	{"method":"primesInRange","min":1,"max":10} -> {"method":"primesInRange","primes":[2,3,5,7],"truncated":false}
+//
+// Ranges are inclusive. Parameters must be integers (any size, floats like
+// 5.0 count), or the request is malformed. Each method has its own limits,
+// so no single request can tie up the CPU: requests over them are
+// malformed too (and logged).
+
+// Largest number (in bits) to find the next prime after (a few ms at this
+// size, as trial division rules out most of the ~350 numbers between primes)
+const MAX_NEXT_PRIME_BITS = 512
+
+// Widest range (max - min + 1) for primeCount and primesInRange
+const MAX_RANGE_WIDTH = 100_000
+
+// Most primes returned by primesInRange (the rest are cut off, with
+// "truncated":true)
+const MAX_RANGE_RESULTS = 1000
+
+// Request parameters are over the method's limits
+var ErrOverLimit = errors.New("over method limits")
+
+// Parameters for the range methods
+var RANGE_PARAMS = []dispatch.Param{
+	{Name: "min", Type: dispatch.INTEGER},
+	{Name: "max", Type: dispatch.INTEGER},
+}
+
+// Methods besides isPrime
+var METHODS = []dispatch.Method{
+	{Name: "factorize", Params: []dispatch.Param{{Name: "number", Type: dispatch.INTEGER}}, Handler: factorize},
+	{Name: "nextPrime", Params: []dispatch.Param{{Name: "number", Type: dispatch.INTEGER}}, Handler: nextPrime},
+	{Name: "primeCount", Params: RANGE_PARAMS, Handler: primeCount},
+	{Name: "primesInRange", Params: RANGE_PARAMS, Handler: primesInRange},
+}
+
+type factorizeResponse struct {
+	Method  string   `json:"method"`
+	Factors []uint64 `json:"factors"`
+}
+
+type nextPrimeResponse struct {
+	Method string   `json:"method"`
+	Prime  *big.Int `json:"prime"`
+}
+
+type primeCountResponse struct {
+	Method string `json:"method"`
+	Count  int    `json:"count"`
+}
+
+type primesInRangeResponse struct {
+	Method    string   `json:"method"`
+	Primes    []uint64 `json:"primes"`
+	Truncated bool     `json:"truncated"`
+}
+
+// factorize returns the prime factors of a positive number (with repeats,
+// smallest first, and none for 1)
+func factorize(params dispatch.Params) (any, error) {
+	number := params.Integer("number")
+	if number.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: `/number` must be positive", dispatch.ErrInvalidParams)
+	}
+	// Only up to 64 bits (Pollard's rho takes a few ms at this size, but
+	// could take hours for the product of two 64 bit primes)
+	if !number.IsUint64() {
+		return nil, fmt.Errorf("%w: can't factorize a %d bit number", ErrOverLimit, number.BitLen())
+	}
+
+	// (An empty list for 1, rather than null)
+	factors := append([]uint64{}, Factorize64(number.Uint64())...)
+	return factorizeResponse{Method: "factorize", Factors: factors}, nil
+}
+
+// nextPrime returns the smallest prime greater than the number
+func nextPrime(params dispatch.Params) (any, error) {
+	number := params.Integer("number")
+	if number.BitLen() > MAX_NEXT_PRIME_BITS {
+		return nil, fmt.Errorf("%w: can't search after a %d bit number", ErrOverLimit, number.BitLen())
+	}
+
+	return nextPrimeResponse{Method: "nextPrime", Prime: NextPrime(number)}, nil
+}
+
+// primeCount returns how many primes there are in the range
+func primeCount(params dispatch.Params) (any, error) {
+	low, high, empty, err := rangeParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	if !empty {
+		PrimesInRange(low, high, func(uint64) bool {
+			count++
+			return true
+		})
+	}
+	return primeCountResponse{Method: "primeCount", Count: count}, nil
+}
+
+// primesInRange returns the primes in the range, up to MAX_RANGE_RESULTS
+func primesInRange(params dispatch.Params) (any, error) {
+	low, high, empty, err := rangeParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	primes, truncated := []uint64{}, false
+	if !empty {
+		PrimesInRange(low, high, func(p uint64) bool {
+			if len(primes) == MAX_RANGE_RESULTS {
+				truncated = true
+				return false
+			}
+			primes = append(primes, p)
+			return true
+		})
+	}
+	return primesInRangeResponse{Method: "primesInRange", Primes: primes, Truncated: truncated}, nil
+}
+
+// rangeParams returns the range to search from `/min` to `/max` (with
+// negative numbers left out, as they're never prime), or empty if there's
+// nothing to search
+func rangeParams(params dispatch.Params) (low, high uint64, empty bool, err error) {
+	from, to := params.Integer("min"), params.Integer("max")
+
+	if to.Sign() < 0 || to.Cmp(from) < 0 {
+		return 0, 0, true, nil
+	}
+	if !to.IsUint64() {
+		return 0, 0, false, fmt.Errorf("%w: `/max` is over 64 bits", ErrOverLimit)
+	}
+	if from.Sign() < 0 {
+		from = big.NewInt(0)
+	}
+
+	low, high = from.Uint64(), to.Uint64()
+	if high-low >= MAX_RANGE_WIDTH {
+		return 0, 0, false, fmt.Errorf("%w: range is wider than %d", ErrOverLimit, MAX_RANGE_WIDTH)
+	}
+	return low, high, false, nil
+}
@@ -0,0 +1,190 @@
+package primetime
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/dispatch"
+	"github.com/finwarman/protohackers/src/lib/lines"
+	"github.com/finwarman/protohackers/src/lib/server"
+)
+
+// Pipelined requests, for Options.Workers > 1.
+//
+// Requests are read as the client sends them, answered by a pool of
+// Options.Workers workers (per connection), and the responses written
+// strictly in request order. So one slow request (e.g. a huge primality
+// test) doesn't stop the requests behind it being worked on, only being
+// answered, with up to MAX_PIPELINED responses held back behind it.
+//
+// With Options.AbortOnMalformed, the first malformed request is answered
+// straight away (ahead of any requests still in flight, whose responses
+// are dropped), and the client is disconnected.
+
+// Most requests read ahead of the responses written, per connection (then
+// reading waits for the oldest response to be sent)
+const MAX_PIPELINED = 256
+
+// request is a request in flight
+type request struct {
+	data     string
+	response chan []byte // (buffered) the response, once ready
+}
+
+// pipeline answers one connection's requests concurrently
+type pipeline struct {
+	conn       net.Conn
+	dispatcher *dispatch.Dispatcher
+	log        *slog.Logger
+	options    Options
+
+	// Cancelled once no more responses will be written
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex // held while writing a response
+	aborted bool       // stop writing responses
+}
+
+// handlePipelined answers requests until the client disconnects (waiting
+// for every response to be sent), or a malformed request aborts it
+func handlePipelined(conn net.Conn, reader *lines.Reader, d *dispatch.Dispatcher, log *slog.Logger, options Options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &pipeline{conn: conn, dispatcher: d, log: log, options: options, ctx: ctx, cancel: cancel}
+
+	jobs := make(chan *request)
+	pending := make(chan *request, MAX_PIPELINED)
+
+	for i := 0; i < options.Workers; i++ {
+		go func() {
+			for req := range jobs {
+				p.answer(req)
+			}
+		}()
+	}
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		p.writeResponses(pending)
+	}()
+
+	err := p.readRequests(reader, jobs, pending)
+	close(jobs)
+	close(pending)
+	<-written
+
+	if err != nil && ctx.Err() == nil {
+		server.LogReadError(log, err)
+
+		// Timed out: say goodbye with a malformed response
+		if server.IsTimeout(err) {
+			_ = p.write(MALFORMED_RESPONSE)
+		}
+	}
+}
+
+// readRequests queues requests for the workers, and their responses for
+// the writer (in order), until the connection ends or is aborted
+func (p *pipeline) readRequests(reader *lines.Reader, jobs, pending chan<- *request) error {
+	for {
+		data, err := reader.ReadLine()
+		req := &request{data: data, response: make(chan []byte, 1)}
+
+		switch {
+		case err == lines.ErrTooLong:
+			// Oversize requests are malformed (the rest of the line is skipped)
+			p.log.Debug("malformed request: line too long", "max_length", MAX_LINE_LENGTH)
+			requestsTotal.Inc(UNKNOWN_METHOD, "malformed")
+			if p.options.AbortOnMalformed {
+				p.abort()
+				return nil
+			}
+			req.response <- MALFORMED_RESPONSE
+		case err != nil:
+			return err
+		default:
+			p.log.Debug("received", "data", data)
+		}
+
+		select {
+		case pending <- req:
+		case <-p.ctx.Done():
+			return nil
+		}
+		if len(req.response) > 0 {
+			continue // (already answered)
+		}
+		select {
+		case jobs <- req:
+		case <-p.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// answer handles a request on a worker, aborting the connection if it's
+// malformed (and that's enabled)
+func (p *pipeline) answer(req *request) {
+	start := time.Now()
+	response, err := handleJSON(p.dispatcher, req.data, p.log)
+	server.RequestDuration.Since(start, PROBLEM)
+
+	if err != nil && p.options.AbortOnMalformed {
+		p.abort()
+	}
+	req.response <- response
+}
+
+// writeResponses sends each response once it's ready, in request order
+func (p *pipeline) writeResponses(pending <-chan *request) {
+	for req := range pending {
+		select {
+		case response := <-req.response:
+			p.log.Debug("sending response", "response", string(response))
+			if err := p.write(response); err != nil {
+				p.log.Warn("write error", "error", err)
+				p.stop()
+				return
+			}
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// write sends a response, terminated with newline (unless aborted)
+func (p *pipeline) write(response []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.aborted {
+		return nil
+	}
+	_, err := p.conn.Write([]byte(string(response) + "\n"))
+	return err
+}
+
+// abort sends a malformed response straight away, then disconnects
+func (p *pipeline) abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.aborted {
+		return
+	}
+	p.aborted = true
+	p.log.Info("disconnecting", "reason", "malformed request")
+	_, _ = p.conn.Write([]byte(string(MALFORMED_RESPONSE) + "\n"))
+	p.stop()
+}
+
+// stop ends the connection, without waiting for requests in flight
+func (p *pipeline) stop() {
+	p.cancel()
+	_ = p.conn.Close()
+}
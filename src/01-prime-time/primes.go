@@ -0,0 +1,255 @@
+package primetime
+
+import (
+	"math"
+	"math/big"
+	"math/bits"
+	"slices"
+)
+
+// Primality testing, exact for any number that fits in 64 bits.
+//
+//   - Up to 2^64: Miller-Rabin with the first 12 primes as bases, which is
+//     deterministic (no composite below 3.3 * 10^24 passes all of them)
+//   - Above that: trial division by small primes, then big.Int's
+//     ProbablyPrime, i.e. Baillie-PSW plus PROBABLE_PRIME_ROUNDS rounds of
+//     Miller-Rabin with random bases. This is probabilistic: no composite is
+//     known to pass Baillie-PSW, and each extra round lets through at most
+//     1/4 of composites, so the chance of a wrong answer is under 4^-20
+//     even for numbers chosen to fool it.
+//
+// There's no limit on size here, testing takes around 0.1s at 2048 bits and
+// grows with the cube, so requests are kept short instead (see
+// MAX_LINE_LENGTH).
+
+// Miller-Rabin bases that are deterministic for every 64-bit number
+var DETERMINISTIC_BASES = []uint64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37}
+
+// Random Miller-Rabin rounds, on top of Baillie-PSW, for numbers over 64 bits
+const PROBABLE_PRIME_ROUNDS = 20
+
+// Primes used for trial division before the probabilistic test
+var SMALL_PRIMES = []uint64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97}
+
+// IsPrime reports whether n is prime (negative numbers, 0 and 1 aren't),
+// exactly up to 64 bits, and probabilistically above that
+func IsPrime(n *big.Int) bool {
+	if n.Sign() <= 0 {
+		return false
+	}
+	if n.IsUint64() {
+		return IsPrime64(n.Uint64())
+	}
+
+	// (Anything this large is only prime if it's odd, with no small factors)
+	if n.Bit(0) == 0 {
+		return false
+	}
+	var remainder big.Int
+	for _, p := range SMALL_PRIMES {
+		if remainder.Mod(n, new(big.Int).SetUint64(p)).Sign() == 0 {
+			return false
+		}
+	}
+	return n.ProbablyPrime(PROBABLE_PRIME_ROUNDS)
+}
+
+// IsPrime64 reports whether n is prime, using deterministic Miller-Rabin
+func IsPrime64(n uint64) bool {
+	switch {
+	case n < 2:
+		return false
+	case n < 4:
+		return true
+	case n%2 == 0:
+		return false
+	}
+	for _, p := range DETERMINISTIC_BASES {
+		if n == p {
+			return true
+		}
+		if n%p == 0 {
+			return false
+		}
+	}
+
+	// Write n-1 as d * 2^s, with d odd
+	d := n - 1
+	s := bits.TrailingZeros64(d)
+	d >>= s
+
+	for _, base := range DETERMINISTIC_BASES {
+		if !millerRabin(n, base, d, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// millerRabin reports whether n (odd, with n-1 = d * 2^s) is a strong
+// probable prime to the base
+func millerRabin(n, base, d uint64, s int) bool {
+	x := powMod(base, d, n)
+	if x == 1 || x == n-1 {
+		return true
+	}
+	for i := 1; i < s; i++ {
+		x = mulMod(x, x, n)
+		if x == n-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// mulMod returns a*b mod m, without overflowing (a, b < m)
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	_, remainder := bits.Div64(hi, lo, m)
+	return remainder
+}
+
+// powMod returns base^exponent mod m
+func powMod(base, exponent, m uint64) uint64 {
+	result := uint64(1)
+	base %= m
+	for exponent > 0 {
+		if exponent&1 == 1 {
+			result = mulMod(result, base, m)
+		}
+		base = mulMod(base, base, m)
+		exponent >>= 1
+	}
+	return result
+}
+
+//
+// === OTHER METHODS === //
+//
+
+// Factorize64 returns the prime factors of n (with repeats, smallest
+// first), using trial division then Pollard's rho. 1 has no factors.
+func Factorize64(n uint64) []uint64 {
+	var factors []uint64
+	if n == 0 {
+		return factors
+	}
+
+	for _, p := range append([]uint64{2}, SMALL_PRIMES...) {
+		for n%p == 0 {
+			factors = append(factors, p)
+			n /= p
+		}
+	}
+	factors = append(factors, splitFactors(n)...)
+
+	slices.Sort(factors)
+	return factors
+}
+
+// splitFactors returns the prime factors of n (with no small factors)
+func splitFactors(n uint64) []uint64 {
+	switch {
+	case n == 1:
+		return nil
+	case IsPrime64(n):
+		return []uint64{n}
+	}
+	d := pollardRho(n)
+	return append(splitFactors(d), splitFactors(n/d)...)
+}
+
+// Differences multiplied together between gcds in pollardRho (a gcd costs
+// as much as dozens of multiplications)
+const RHO_BATCH_SIZE = 128
+
+// pollardRho returns a non-trivial factor of n (odd and composite), using
+// Brent's variant: around n^(1/4) steps, so a few ms at most for 64 bits
+func pollardRho(n uint64) uint64 {
+	// (Try x^2 + c for c = 1, 2, ... until one finds a factor)
+	for c := uint64(1); ; c++ {
+		next := func(x uint64) uint64 {
+			return addMod(mulMod(x, x, n), c, n)
+		}
+
+		x, y, saved := uint64(0), uint64(2), uint64(0)
+		product, d := uint64(1), uint64(1)
+		for steps := 1; d == 1; steps *= 2 {
+			x = y
+			for i := 0; i < steps; i++ {
+				y = next(y)
+			}
+			for done := 0; done < steps && d == 1; done += RHO_BATCH_SIZE {
+				saved = y
+				for i := 0; i < min(RHO_BATCH_SIZE, steps-done); i++ {
+					y = next(y)
+					product = mulMod(product, absDiff(x, y), n)
+				}
+				d = gcd(product, n)
+			}
+		}
+
+		// Overshot (the batch found every factor at once): step through it
+		if d == n {
+			for d = 1; d == 1; {
+				saved = next(saved)
+				d = gcd(absDiff(x, saved), n)
+			}
+		}
+		if d != n {
+			return d
+		}
+	}
+}
+
+func absDiff(a, b uint64) uint64 {
+	return max(a, b) - min(a, b)
+}
+
+// addMod returns a+b mod m, without overflowing (a, b < m)
+func addMod(a, b, m uint64) uint64 {
+	if a >= m-b {
+		return a - (m - b)
+	}
+	return a + b
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// NextPrime returns the smallest prime greater than n, see IsPrime
+// (numbers over 64 bits are probably prime)
+func NextPrime(n *big.Int) *big.Int {
+	if n.Cmp(big.NewInt(2)) < 0 {
+		return big.NewInt(2)
+	}
+
+	// Only odd candidates after 2
+	candidate := new(big.Int).Add(n, big.NewInt(1))
+	if candidate.Bit(0) == 0 {
+		candidate.Add(candidate, big.NewInt(1))
+	}
+	for {
+		if IsPrime(candidate) {
+			return candidate
+		}
+		candidate.Add(candidate, big.NewInt(2))
+	}
+}
+
+// PrimesInRange calls found for each prime from low to high (inclusive),
+// in order, stopping early if found returns false
+func PrimesInRange(low, high uint64, found func(p uint64) bool) {
+	for n := low; n <= high; n++ {
+		if IsPrime64(n) && !found(n) {
+			return
+		}
+		if n == math.MaxUint64 {
+			return
+		}
+	}
+}
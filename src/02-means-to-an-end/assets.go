@@ -0,0 +1,284 @@
+package meanstoanend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Shared assets, for Options.Shared.
+//
+// Clients pick an asset by id (see OP_SELECT_ASSET), and every client on
+// the same id inserts into and queries the same series, one request at a
+// time (queries can run alongside each other, but not alongside changes).
+// Assets are kept until the server stops, so there can only be so many
+// (see Options.MaxAssets), selecting any more is undefined.
+//
+// With Options.DataDir, each asset's changes (inserts and deletes) are
+// also appended to a log file, as the same 9-byte messages, and replayed
+// the first time the asset is selected (so after a restart, the series is
+// as it was, if the duplicate policy hasn't changed since). Log files are
+// named by asset id, opened on the first change, and closed once no client
+// has the asset selected. Writes aren't synced, so a crash could lose the
+// last few (a partly written message at the end is dropped on reload).
+
+// Size of each message, and of each log record
+const MESSAGE_SIZE = 9
+
+// asset is a series, safe for concurrent use (shared by any number of
+// clients, with Options.Shared)
+type asset struct {
+	mu         sync.RWMutex
+	series     *Series
+	duplicates DuplicatePolicy
+	path       string   // log file ("" if not persisted)
+	log        *os.File // open log file (nil until the next change)
+
+	// Loaded from the log on first selection (see Assets.get)
+	loaded  sync.Once
+	loadErr error
+
+	// Clients with the asset selected (guarded by the registry's lock)
+	users int
+}
+
+// newAsset returns an asset that isn't persisted
+func newAsset(duplicates DuplicatePolicy) *asset {
+	return &asset{series: NewSeries(), duplicates: duplicates}
+}
+
+// insert stores a price (and logs it, if persisted and anything changed),
+// returning whether the timestamp already had a price
+func (a *asset) insert(message []byte, timestamp, price int32) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	duplicate := a.series.Insert(timestamp, price, a.duplicates)
+	if duplicate && (a.duplicates == DUPLICATES_KEEP_FIRST || a.duplicates == DUPLICATES_REJECT) {
+		return true, nil // (nothing to log)
+	}
+	return duplicate, a.append(message)
+}
+
+// delete removes the prices in a range (and logs it, if persisted)
+func (a *asset) delete(message []byte, mintime, maxtime int32) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	deleted := a.series.Delete(mintime, maxtime)
+	if deleted == 0 {
+		return 0, nil // (nothing to log)
+	}
+	return deleted, a.append(message)
+}
+
+// totals returns the totals for a range
+func (a *asset) totals(mintime, maxtime int32) Totals {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.series.Totals(mintime, maxtime)
+}
+
+// percentile returns the price at a percentile of a range, see
+// Series.Percentile
+func (a *asset) percentile(mintime, maxtime int32, percentile int) (int32, bool) {
+	// (A write lock, as the series sorts prices in a shared buffer)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.series.Percentile(mintime, maxtime, percentile)
+}
+
+// append adds a change to the log (if persisted), opening it if needed
+func (a *asset) append(message []byte) error {
+	if a.path == "" {
+		return nil
+	}
+	if a.log == nil {
+		file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open log: %w", err)
+		}
+		a.log = file
+	}
+	if _, err := a.log.Write(message); err != nil {
+		return fmt.Errorf("failed to log change: %w", err)
+	}
+	return nil
+}
+
+// closeLog closes the log file, if it's open (it's reopened on the next
+// change)
+func (a *asset) closeLog() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.log == nil {
+		return nil
+	}
+	err := a.log.Close()
+	a.log = nil
+	return err
+}
+
+// replay applies the changes logged in a file, returning how much of it
+// was read (only whole messages)
+func (a *asset) replay(file io.Reader) (int64, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	complete := len(data) - len(data)%MESSAGE_SIZE
+	for offset := 0; offset < complete; offset += MESSAGE_SIZE {
+		message := data[offset : offset+MESSAGE_SIZE]
+		one, two := readInts(message)
+
+		switch message[0] {
+		case OP_INSERT:
+			a.series.Insert(one, two, a.duplicates)
+		case OP_DELETE:
+			a.series.Delete(one, two)
+		default:
+			return 0, fmt.Errorf("unknown change %q at offset %d", message[0], offset)
+		}
+	}
+	return int64(complete), nil
+}
+
+// load replays an asset's log (if it has one), dropping any partly written
+// message at the end, so later appends stay aligned
+func (a *asset) load(id int32) error {
+	file, err := os.OpenFile(a.path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // (a new asset)
+	}
+	if err != nil {
+		return err
+	}
+
+	complete, err := a.replay(file)
+	if err == nil {
+		err = file.Truncate(complete)
+	}
+	if err = errors.Join(err, file.Close()); err != nil {
+		return err
+	}
+
+	if a.series.Len() > 0 {
+		logger.Info("loaded asset", "asset", id, "prices", a.series.Len(), "path", a.path)
+	}
+	return nil
+}
+
+//
+// === REGISTRY === //
+//
+
+// Assets holds the shared assets, by id (see Options.Shared)
+type Assets struct {
+	dir        string // for log files ("" to not persist)
+	duplicates DuplicatePolicy
+	maxAssets  int // (0 for no limit)
+
+	mu     sync.Mutex
+	byID   map[int32]*asset
+	closed bool
+}
+
+// Selecting a new asset would go over Options.MaxAssets
+var ErrTooManyAssets = errors.New("too many assets")
+
+// Selecting an asset after Close
+var ErrAssetsClosed = errors.New("assets closed")
+
+// NewAssets returns an empty registry, persisting to dir (if not ""), with
+// the duplicate policy for every asset, and at most maxAssets of them (0
+// for no limit)
+func NewAssets(dir string, duplicates DuplicatePolicy, maxAssets int) (*Assets, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Assets{dir: dir, duplicates: duplicates, maxAssets: maxAssets, byID: make(map[int32]*asset)}, nil
+}
+
+// get returns the asset with the id for a client (see release), creating
+// it (or loading it from its log) if it's the first time it's been selected
+func (r *Assets) get(id int32) (*asset, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrAssetsClosed
+	}
+	a, ok := r.byID[id]
+	if !ok {
+		if r.maxAssets > 0 && len(r.byID) >= r.maxAssets {
+			r.mu.Unlock()
+			return nil, fmt.Errorf("%w: can't select asset %d, there are already %d", ErrTooManyAssets, id, len(r.byID))
+		}
+		a = newAsset(r.duplicates)
+		if r.dir != "" {
+			// (As hex, so negative ids don't look odd)
+			a.path = filepath.Join(r.dir, fmt.Sprintf("asset-%08x.log", uint32(id)))
+		}
+		r.byID[id] = a
+	}
+	a.users++
+	r.mu.Unlock()
+
+	// Load the log outside the registry's lock, so other assets can be
+	// selected meanwhile (clients selecting this one wait for it)
+	a.loaded.Do(func() {
+		if a.path != "" {
+			a.loadErr = a.load(id)
+		}
+	})
+	if a.loadErr != nil {
+		// (Forget it, so the next selection tries again)
+		r.mu.Lock()
+		if r.byID[id] == a {
+			delete(r.byID, id)
+		}
+		r.mu.Unlock()
+		return nil, fmt.Errorf("failed to load asset %d: %w", id, a.loadErr)
+	}
+	return a, nil
+}
+
+// release is called when a client selects another asset (or disconnects),
+// closing the asset's log if no other client has it selected
+func (r *Assets) release(a *asset) {
+	r.mu.Lock()
+	a.users--
+	idle := a.users == 0
+	r.mu.Unlock()
+
+	if idle {
+		if err := a.closeLog(); err != nil {
+			logger.Warn("failed to close asset log", "path", a.path, "error", err)
+		}
+	}
+}
+
+// Close closes every asset's log, once clients have finished with them
+// (the server calls this after its connections have closed)
+func (r *Assets) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	assets := make([]*asset, 0, len(r.byID))
+	for _, a := range r.byID {
+		assets = append(assets, a)
+	}
+	r.mu.Unlock()
+
+	var errs []error
+	for _, a := range assets {
+		errs = append(errs, a.closeLog())
+	}
+	return errors.Join(errs...)
+}
@@ -1,86 +1,237 @@
-package main
+package meanstoanend
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
 	"net"
-	"os"
 	"strconv"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
-const TCP_PORT = 25565
+// Default tcp port for server
+const DEFAULT_TCP_PORT = 25565
+
+// Problem name, for logs and metrics
+const PROBLEM = "means-to-an-end"
+
+// Logger for this problem
+var logger = logging.Named(PROBLEM)
+
+// Options for the means-to-an-end server
+type Options struct {
+	// Let clients share assets: each client selects an asset first (see
+	// OP_SELECT_ASSET and assets.go), rather than having its own
+	Shared bool
+
+	// Persist shared assets in this directory, reloading them on restart
+	// ("" to keep them in memory)
+	DataDir string
 
-func main() {
-	StartServer(TCP_PORT)
+	// Most shared assets clients can select between them (0 for no limit)
+	MaxAssets int
+
+	// What to do with a price at a timestamp that already has one (the
+	// spec leaves it undefined), overwriting by default
+	Duplicates DuplicatePolicy
+
+	// How to round means, exactly (the spec allows either way), rounding
+	// halves away from zero by default
+	Rounding RoundingPolicy
 }
 
-func StartServer(port int) {
-	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+// Shared assets allowed, unless changed (see -means-max-assets)
+const DEFAULT_MAX_ASSETS = 1000
+
+// RegisterFlags adds -means-shared, -means-data-dir, -means-max-assets,
+// -means-duplicates and -means-rounding to the flag set, returning the
+// options they populate
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	options := &Options{}
+	fs.BoolVar(&options.Shared, "means-shared", false,
+		"means-to-an-end clients select a shared asset (by id) before anything else")
+	fs.StringVar(&options.DataDir, "means-data-dir", "",
+		"persist shared means-to-an-end assets in this `directory` (needs -means-shared)")
+	fs.IntVar(&options.MaxAssets, "means-max-assets", DEFAULT_MAX_ASSETS,
+		"most shared means-to-an-end assets (0 for no limit), selecting more is undefined")
+	fs.Func("means-duplicates", "`policy` for means-to-an-end prices at a timestamp that already has one: "+
+		"overwrite (default), keep-first, reject (disconnecting the client) or store-all",
+		func(s string) (err error) {
+			options.Duplicates, err = ParseDuplicatePolicy(s)
+			return err
+		})
+	fs.Func("means-rounding", "`policy` for rounding means-to-an-end means: half-away (default), half-even, floor or ceil",
+		func(s string) (err error) {
+			options.Rounding, err = ParseRoundingPolicy(s)
+			return err
+		})
+	return options
+}
+
+// StartServer runs the server on the given port, until the context is cancelled
+func StartServer(ctx context.Context, port int, options Options, settings server.Settings) error {
+	srv, err := NewServer(port, options, settings)
 	if err != nil {
-		fmt.Println("listen: ", err.Error())
-		os.Exit(1)
+		return err
 	}
 
-	fmt.Printf("listening on port %d\n", port)
+	return srv.Serve(ctx)
+}
 
-	// Create a goroutine with a connection handler,
-	// for each new connection. (Must handle at least 5)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println("accept: ", err.Error())
-			os.Exit(1)
+// NewServer creates a means-to-an-end server listening on the given port
+// (0 picks a free port, see Addr)
+func NewServer(port int, options Options, settings server.Settings) (*server.Server, error) {
+	var shared *Assets
+	if options.Shared {
+		var err error
+		if shared, err = NewAssets(options.DataDir, options.Duplicates, options.MaxAssets); err != nil {
+			return nil, err
 		}
+	} else if options.DataDir != "" {
+		return nil, errors.New("only shared assets can be persisted")
+	}
+
+	config := server.Config{Name: PROBLEM, Host: "localhost", Port: port, Logger: logger, Settings: settings}
+
+	// Handle each new connection in its own goroutine (must handle at least 5)
+	return server.Listen(config, &handler{options: options, shared: shared})
+}
 
-		fmt.Println("connection from ", conn.RemoteAddr())
+// handler answers each connection, see HandleConnection
+type handler struct {
+	options Options
+	shared  *Assets // (nil if each client has its own asset)
+}
 
-		go HandleConnection(conn)
+// HandleConnection answers a client, with the server's options and assets
+func (h *handler) HandleConnection(conn net.Conn) {
+	HandleConnection(conn, h.options, h.shared)
+}
+
+// Close closes the shared assets' logs, once the server has stopped
+func (h *handler) Close() error {
+	if h.shared == nil {
+		return nil
 	}
+	return h.shared.Close()
 }
 
-func HandleConnection(conn net.Conn) {
+// Request types, the first byte of each message (see handleBytesData)
+const (
+	OP_INSERT         = 'I' // timestamp, price -> nothing
+	OP_MEAN           = 'Q' // mintime, maxtime -> int32
+	OP_MIN            = 'n' // mintime, maxtime -> int32
+	OP_MAX            = 'x' // mintime, maxtime -> int32
+	OP_COUNT          = 'c' // mintime, maxtime -> uint32
+	OP_SUM            = 's' // mintime, maxtime -> int64
+	OP_MEDIAN         = 'm' // mintime, maxtime -> int32
+	OP_PERCENTILE     = 'P' // mintime, maxtime -> int32
+	OP_SET_PERCENTILE = 'p' // percentile, (unused) -> nothing
+	OP_DELETE         = 'D' // mintime, maxtime -> uint32
+	OP_SELECT_ASSET   = 'A' // asset id, (unused) -> nothing
+)
+
+// Size of the buffers for reading messages, and writing responses (per
+// connection)
+const READ_BUFFER_SIZE = 64 << 10
+const WRITE_BUFFER_SIZE = 64 << 10
+
+// Largest response (to OP_SUM)
+const MAX_RESPONSE_SIZE = 8
+
+// Percentile for OP_PERCENTILE, until the client sets another
+const DEFAULT_PERCENTILE = 50
+
+// Response for messages with undefined behaviour
+var UNDEF_RESPONSE = []byte("undef\n")
+
+// client is the state for one connection
+type client struct {
+	asset      *asset  // nil until selected, if shared
+	shared     *Assets // to select from (nil if each client has its own)
+	percentile int     // for OP_PERCENTILE
+	rounding   RoundingPolicy
+}
+
+// HandleConnection answers a client's messages, on its own asset (or on
+// the ones it selects from shared, if not nil)
+func HandleConnection(conn net.Conn, options Options, shared *Assets) {
 	defer conn.Close()
 
+	log := logging.ForConn(logger, conn)
+
 	// Database for this client
-	// (Each client has a different asset)
-	assetDatabase := make(map[int32]int32)
+	// (Each client has a different asset, see series.go, unless shared)
+	session := &client{shared: shared, percentile: DEFAULT_PERCENTILE, rounding: options.Rounding}
+	if shared == nil {
+		session.asset = newAsset(options.Duplicates)
+	} else {
+		defer func() {
+			if session.asset != nil {
+				shared.release(session.asset)
+			}
+		}()
+	}
+
+	// Read as many messages as have arrived at once, and send their
+	// responses together (once there aren't any more to answer)
+	reader := bufio.NewReaderSize(conn, READ_BUFFER_SIZE)
+	writer := bufio.NewWriterSize(conn, WRITE_BUFFER_SIZE)
+	defer writer.Flush()
+
+	// (Reused for every message, so answering them doesn't allocate)
+	var message [MESSAGE_SIZE]byte
+	response := make([]byte, 0, MAX_RESPONSE_SIZE)
+	debug := log.Enabled(context.Background(), slog.LevelDebug)
 
 	// While connection is open, check for data to read
 	for {
-		// Buffer to hold exactly 9 bytes
-		const messageSize = 9
-		buf := make([]byte, messageSize)
+		// Send responses before waiting for more messages
+		if reader.Buffered() < MESSAGE_SIZE {
+			if err := writer.Flush(); err != nil {
+				log.Warn("write error", "error", err)
+				break
+			}
+		}
 
 		// Read exactly 9 bytes
-		_, err := io.ReadFull(conn, buf)
+		_, err := io.ReadFull(reader, message[:])
 		if err != nil {
 			if err == io.EOF {
-				fmt.Println("connection closed by client")
+				log.Info("connection closed by client")
 			} else {
-				fmt.Println("read error:", err.Error())
+				server.LogReadError(log, err)
 			}
 			break
 		}
 
-		// [Debug] Print received data to STDOUT
-		// fmt.Print("received (hex): ")
-		// for _, b := range buf[:] {
-		// 	fmt.Printf("%02x ", b)
-		// }
-		// fmt.Println()
-
 		// Handle the 9-byte message
-		response := handleBytesData(buf, &assetDatabase)
+		start := time.Now()
+		response, err = handleBytesData(message[:], session, response[:0])
+		server.RequestDuration.Since(start, PROBLEM)
+
+		if err != nil {
+			log.Info("disconnecting", "reason", err)
+			break
+		}
 
 		if len(response) > 0 {
-			fmt.Printf("sending response: %s\n",
-				strconv.Quote(string(response)))
+			if debug {
+				log.Debug("sending response", "response", strconv.Quote(string(response)))
+			}
 
-			// Send the response
-			if _, err := conn.Write([]byte(response)); err != nil {
-				fmt.Println("write error:", err.Error())
+			// Queue the response (sent once the buffer fills, or on the next flush)
+			if _, err := writer.Write(response); err != nil {
+				log.Warn("write error", "error", err)
 				break
 			}
 		}
@@ -114,6 +265,7 @@ mintime <= T <= maxtime (i.e. timestamps in closed interval [mintime, maxtime]).
 
 If the mean is not an integer, it is acceptable to round either up or down,
 at the server's discretion.
+(Here, that's up to Options.Rounding, see policies.go)
 
 The server must then send the mean to the client as a single int32.
 
@@ -122,76 +274,166 @@ after maxtime, the value returned must be 0.
 
 Behaviour is undefined if there are multiple prices with the same timestamp from
 the same client.
+(Here, that's up to Options.Duplicates, see policies.go)
 
 Where a client triggers undefined behaviour, the server can do anything it likes
 for that client, but must not adversely affect other clients that did not
 trigger undefined behaviour.
-*/
-func handleBytesData(data []byte, assetDatabase *map[int32]int32) []byte {
 
-	var UNDEF_RESPONSE = []byte("undef\n")
+---
 
-	// Parse and validate operation-type byte char
-	charByte := data[0]
-	if charByte != 'I' && charByte != 'Q' {
-		fmt.Printf("invalid char byte: %02x\n", charByte)
-		return UNDEF_RESPONSE
-	}
+Extensions (not part of the standard protocol, which is unchanged):
 
-	// Convert bytes 1-4 to a signed 32-bit integer
-	intOneValue := int32(binary.BigEndian.Uint32(data[1:5]))
-	// fmt.Printf("1st int32 value is: %d\n", intOneValue)
+The same 9-byte message, with another type char. Each of these takes mintime and
+maxtime (like QUERY), and answers for the prices in [mintime, maxtime]:
 
-	// Convert bytes 1-4 to a signed 32-bit integer
-	intTwoValue := int32(binary.BigEndian.Uint32(data[5:9]))
-	// fmt.Printf("2nd int32 value is: %d\n", intTwoValue)
+	Char | Operation  | Response
+	-----+------------+------------------------------------------------------------
+	`n`  | MIN        | int32, the lowest price
+	`x`  | MAX        | int32, the highest price
+	`c`  | COUNT      | uint32, the number of prices
+	`s`  | SUM        | int64, the sum of the prices (which can't overflow)
+	`m`  | MEDIAN     | int32, the 50th percentile (see PERCENTILE)
+	`P`  | PERCENTILE | int32, the price at the client's percentile (see below)
+	`D`  | DELETE     | uint32, the number of prices deleted (which are removed)
 
-	// Handle INSERT
-	// - Insert a timestamped price
-	if charByte == 'I' {
-		// fmt.Println("command is I for INSERT")
+Percentiles use the nearest rank: the lowest price with at least that percent of
+prices at or below it (so the median of 4 prices is the 2nd lowest).
 
-		timestamp := intOneValue
-		price := intTwoValue
+The percentile (50 to start with) is set for the rest of the connection with:
 
-		// fmt.Printf("inserting price $%d at time %d\n", price, timestamp)
+	`p`  | SET PERCENTILE | (no response)
 
-		(*assetDatabase)[timestamp] = int32(price)
+where the first int32 is the percentile, from 0 to 100 (others are undefined),
+and the second is unused.
 
-		return nil
-	}
+Like QUERY, each response is 0 if there are no prices in the period, or mintime
+comes after maxtime. All integers are in network byte order (big endian).
 
-	// Handle QUERY
-	// - Fetch a mean price across period
-	if charByte == 'Q' {
-		// fmt.Println("command is Q for QUERY")
+With shared assets (-means-shared), clients pick the asset to work on with:
 
-		mintime := intOneValue
-		maxtime := intTwoValue
+	`A`  | SELECT ASSET | (no response)
 
-		// fmt.Printf("querying time range %d - %d\n", mintime, maxtime)
+where the first int32 is the asset id, and the second is unused. Any other
+message before then (or SELECT ASSET without shared assets, or for a new
+asset past -means-max-assets) is undefined. Clients can select another asset
+at any time.
 
-		total := int64(0)
-		count := 0
-		for timestamp, price := range *assetDatabase {
-			if timestamp >= mintime && timestamp <= maxtime {
-				count++
-				total += int64(price)
-			}
+The response (if any) is appended to response. Returns an error if the client
+should be disconnected (see DUPLICATES_REJECT).
+*/
+func handleBytesData(data []byte, session *client, response []byte) ([]byte, error) {
+	// Parse operation-type byte char
+	charByte := data[0]
+
+	// Convert bytes 1-4 and 5-8 to signed 32-bit integers
+	intOneValue, intTwoValue := readInts(data)
+
+	switch charByte {
+	// Handle SELECT ASSET
+	// - Choose the shared asset for later requests
+	case OP_SELECT_ASSET:
+		if session.shared == nil {
+			break
+		}
+		selected, err := session.shared.get(intOneValue)
+		if errors.Is(err, ErrTooManyAssets) {
+			logger.Warn("failed to select asset", "asset", intOneValue, "error", err)
+			return append(response, UNDEF_RESPONSE...), nil
+		}
+		if err != nil {
+			logger.Error("failed to select asset", "asset", intOneValue, "error", err)
+			return append(response, UNDEF_RESPONSE...), nil
 		}
+		if session.asset != nil {
+			session.shared.release(session.asset)
+		}
+		session.asset = selected
+		return response, nil
+
+	// Handle SET PERCENTILE
+	// - Choose the percentile for later PERCENTILE requests
+	case OP_SET_PERCENTILE:
+		if intOneValue < 0 || intOneValue > 100 {
+			logger.Debug("invalid percentile", "percentile", intOneValue)
+			return append(response, UNDEF_RESPONSE...), nil
+		}
+		session.percentile = int(intOneValue)
+		return response, nil
+	}
 
-		mean := int64(0)
-		if count > 0 {
-			mean = int64(math.Round(float64(total) / float64(count)))
+	// Everything else needs an asset
+	assetDatabase := session.asset
+	if assetDatabase == nil {
+		logger.Debug("no asset selected", "byte", fmt.Sprintf("%02x", charByte))
+		return append(response, UNDEF_RESPONSE...), nil
+	}
+
+	switch charByte {
+	// Handle INSERT
+	// - Insert a timestamped price
+	case OP_INSERT:
+		duplicate, err := assetDatabase.insert(data, intOneValue, intTwoValue)
+		if err != nil {
+			logger.Error("failed to persist insert", "error", err)
+		}
+		if duplicate && assetDatabase.duplicates == DUPLICATES_REJECT {
+			return response, fmt.Errorf("%w: %d", ErrDuplicateTimestamp, intOneValue)
 		}
+		return response, nil
 
-		// fmt.Printf("got mean in timerange: %d (%d/%d)\n", mean, total, count)
+	// Handle QUERY
+	// - Fetch a mean price across period
+	case OP_MEAN:
+		totals := assetDatabase.totals(intOneValue, intTwoValue)
+
+		mean := int64(0)
+		if totals.Count > 0 {
+			mean = session.rounding.Mean(totals.Sum, totals.Count)
+		}
+		return binary.BigEndian.AppendUint32(response, uint32(int32(mean))), nil
+
+	// Handle MIN, MAX, COUNT and SUM
+	// - Totals across period
+	case OP_MIN:
+		return binary.BigEndian.AppendUint32(response, uint32(assetDatabase.totals(intOneValue, intTwoValue).Min)), nil
+	case OP_MAX:
+		return binary.BigEndian.AppendUint32(response, uint32(assetDatabase.totals(intOneValue, intTwoValue).Max)), nil
+	case OP_COUNT:
+		count := assetDatabase.totals(intOneValue, intTwoValue).Count
+		return binary.BigEndian.AppendUint32(response, uint32(min(count, math.MaxUint32))), nil
+	case OP_SUM:
+		sum := assetDatabase.totals(intOneValue, intTwoValue).Sum
+		return binary.BigEndian.AppendUint64(response, uint64(sum)), nil
+
+	// Handle MEDIAN and PERCENTILE
+	// - Fetch a price by rank across period (0 if there are none)
+	case OP_MEDIAN, OP_PERCENTILE:
+		percentile := session.percentile
+		if charByte == OP_MEDIAN {
+			percentile = 50
+		}
+		price, _ := assetDatabase.percentile(intOneValue, intTwoValue, percentile)
+		return binary.BigEndian.AppendUint32(response, uint32(price)), nil
 
-		meanBytes := make([]byte, 4)
-		binary.BigEndian.PutUint32(meanBytes, uint32(int32(mean)))
+	// Handle DELETE
+	// - Remove prices across period
+	case OP_DELETE:
+		deleted, err := assetDatabase.delete(data, intOneValue, intTwoValue)
+		if err != nil {
+			logger.Error("failed to persist delete", "error", err)
+		}
+		return binary.BigEndian.AppendUint32(response, uint32(min(deleted, math.MaxUint32))), nil
+	}
 
-		return meanBytes
+	// (Only formatting the byte if it'll be logged, so even nonsense is free)
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Debug("invalid char byte", "byte", fmt.Sprintf("%02x", charByte))
 	}
+	return append(response, UNDEF_RESPONSE...), nil
+}
 
-	return UNDEF_RESPONSE
+// readInts returns a message's two signed 32-bit integers (big endian)
+func readInts(data []byte) (int32, int32) {
+	return int32(binary.BigEndian.Uint32(data[1:5])), int32(binary.BigEndian.Uint32(data[5:9]))
 }
@@ -1,25 +1,46 @@
-package main
+package meanstoanend
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
-const TEST_TCP_PORT = 44444
+// startTestServer starts the server on a free port, returning the address
+// to connect to (the server is stopped when the test completes)
+func startTestServer(t testing.TB, options Options) string {
+	srv, err := NewServer(0, options, server.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	go srv.Serve(context.Background())
+	t.Cleanup(func() { srv.Close() })
 
-var TEST_CONNECT_STR = fmt.Sprintf("localhost:%d", TEST_TCP_PORT)
+	return srv.Addr().String()
+}
 
 func TestEchoServer(t *testing.T) {
-	go StartServer(TEST_TCP_PORT)      // Start the server in a goroutine
-	time.Sleep(time.Millisecond * 500) // (Wait for the server to start)
+	addr := startTestServer(t, Options{})
 
 	// Connect to the server
-	conn, err := net.Dial("tcp", TEST_CONNECT_STR)
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
@@ -65,9 +86,6 @@ func TestEchoServer(t *testing.T) {
 			expected, response,
 		)
 	}
-
-	// Time to allow output to flush
-	time.Sleep(time.Millisecond * 100)
 }
 
 func hexStringToByteArray(hexStr string) ([]byte, error) {
@@ -85,3 +103,640 @@ func hexStringToByteArray(hexStr string) ([]byte, error) {
 
 	return byteArray, nil
 }
+
+func TestSeries(t *testing.T) {
+	series := newSeededSeries(1)
+	model := make(map[int32]int32) // (the simplest thing that works)
+	rng := rand.New(rand.NewSource(1))
+
+	// Timestamps from a small range, so some are overwritten
+	randomTimestamp := func() int32 { return int32(rng.Intn(2000)) - 1000 }
+
+	for i := 0; i < 5000; i++ {
+		timestamp, price := randomTimestamp(), rng.Int31()-math.MaxInt32/2
+		series.Insert(timestamp, price, DUPLICATES_OVERWRITE)
+		model[timestamp] = price
+
+		if series.Len() != len(model) {
+			t.Fatalf("Expected %d prices, got %d", len(model), series.Len())
+		}
+
+		mintime, maxtime := randomTimestamp(), randomTimestamp()
+		expectedCount, expectedSum := 0, int64(0)
+		for timestamp, price := range model {
+			if mintime <= timestamp && timestamp <= maxtime {
+				expectedCount++
+				expectedSum += int64(price)
+			}
+		}
+		if count, sum := series.Range(mintime, maxtime); count != expectedCount || sum != expectedSum {
+			t.Fatalf("Expected %d prices summing to %d from %d to %d, got %d summing to %d",
+				expectedCount, expectedSum, mintime, maxtime, count, sum)
+		}
+		checkRange(t, series, model, mintime, maxtime)
+
+		// Now and then, delete a range (small, so the series keeps growing)
+		if i%10 == 0 {
+			maxtime := mintime + int32(rng.Intn(20))
+			expected := 0
+			for timestamp := range model {
+				if mintime <= timestamp && timestamp <= maxtime {
+					delete(model, timestamp)
+					expected++
+				}
+			}
+			if deleted := series.Delete(mintime, maxtime); deleted != expected {
+				t.Fatalf("Expected to delete %d prices from %d to %d, deleted %d", expected, mintime, maxtime, deleted)
+			}
+		}
+	}
+
+	// The extremes of the timestamp range
+	series.Insert(math.MinInt32, 1, DUPLICATES_OVERWRITE)
+	series.Insert(math.MaxInt32, 2, DUPLICATES_OVERWRITE)
+	if count, sum := series.Range(math.MinInt32, math.MaxInt32); count != len(model)+2 {
+		t.Fatalf("Expected every price in the full range, got %d (sum %d)", count, sum)
+	}
+	if count, sum := series.Range(math.MaxInt32, math.MaxInt32); count != 1 || sum != 2 {
+		t.Fatalf("Expected only the last price, got %d (sum %d)", count, sum)
+	}
+
+	// Each new series has its own priorities (so clients can't predict them)
+	if one, two := NewSeries(), NewSeries(); one.rng == 0 || one.rng == two.rng {
+		t.Fatalf("Expected series to be seeded randomly, got %#x and %#x", one.rng, two.rng)
+	}
+}
+
+// checkRange compares the series' totals and percentiles for a range
+// against the model
+func checkRange(t *testing.T, series *Series, model map[int32]int32, mintime, maxtime int32) {
+	t.Helper()
+
+	var prices []int32
+	for timestamp, price := range model {
+		if mintime <= timestamp && timestamp <= maxtime {
+			prices = append(prices, price)
+		}
+	}
+	slices.Sort(prices)
+
+	totals := series.Totals(mintime, maxtime)
+	if len(prices) == 0 {
+		if totals != (Totals{}) {
+			t.Fatalf("Expected empty totals from %d to %d, got %+v", mintime, maxtime, totals)
+		}
+		if _, ok := series.Percentile(mintime, maxtime, 50); ok {
+			t.Fatalf("Expected no median from %d to %d", mintime, maxtime)
+		}
+		return
+	}
+	if totals.Min != prices[0] || totals.Max != prices[len(prices)-1] {
+		t.Fatalf("Expected prices from %d to %d from %d to %d, got %d to %d",
+			prices[0], prices[len(prices)-1], mintime, maxtime, totals.Min, totals.Max)
+	}
+	for _, percentile := range []int{0, 1, 50, 99, 100} {
+		// (Nearest rank: the lowest price with at least percentile% at or below it)
+		expected := prices[0]
+		for i, price := range prices {
+			if (i+1)*100 >= percentile*len(prices) {
+				expected = price
+				break
+			}
+		}
+		if price, _ := series.Percentile(mintime, maxtime, percentile); price != expected {
+			t.Fatalf("Expected percentile %d from %d to %d to be %d, got %d",
+				percentile, mintime, maxtime, expected, price)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	session := &client{asset: newAsset(""), percentile: DEFAULT_PERCENTILE}
+
+	request := func(op byte, one, two int32) []byte {
+		response, err := handleBytesData(message(op, one, two), session, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error for %c %d %d: %v", op, one, two, err)
+		}
+		return response
+	}
+
+	// Prices 10, 20, 30, 40 and -2147483648 at timestamps 1 to 5
+	for i, price := range []int32{10, 20, 30, 40, math.MinInt32} {
+		if response := request(OP_INSERT, int32(i+1), price); response != nil {
+			t.Fatalf("Expected no response to an insert, got %X", response)
+		}
+	}
+
+	tests := []struct {
+		op       byte
+		one, two int32
+		expected string
+	}{
+		{OP_MEAN, 1, 4, "00 00 00 19"}, // (25)
+		{OP_MIN, 1, 5, "80 00 00 00"},
+		{OP_MAX, 1, 5, "00 00 00 28"},
+		{OP_COUNT, 2, 4, "00 00 00 03"},
+		{OP_SUM, 1, 5, "ff ff ff ff 80 00 00 64"}, // (-2147483548, no overflow)
+		{OP_MEDIAN, 1, 4, "00 00 00 14"},          // (20, the lower of the two)
+		{OP_PERCENTILE, 1, 4, "00 00 00 14"},      // (the median, by default)
+
+		// Empty periods are 0, however wide the response
+		{OP_MIN, 6, 10, "00 00 00 00"},
+		{OP_SUM, 4, 1, "00 00 00 00 00 00 00 00"},
+		{OP_MEDIAN, 6, 10, "00 00 00 00"},
+
+		// Percentiles stick, but not for medians
+		{OP_SET_PERCENTILE, 100, 0, ""},
+		{OP_PERCENTILE, 1, 4, "00 00 00 28"},
+		{OP_MEDIAN, 1, 4, "00 00 00 14"},
+		{OP_SET_PERCENTILE, 101, 0, "75 6e 64 65 66 0a"}, // (undef)
+		{OP_PERCENTILE, 1, 4, "00 00 00 28"},
+
+		// Deleted prices are gone
+		{OP_DELETE, 2, 3, "00 00 00 02"},
+		{OP_DELETE, 2, 3, "00 00 00 00"},
+		{OP_COUNT, 1, 5, "00 00 00 03"},
+		{OP_MEAN, 1, 4, "00 00 00 19"}, // (25 again)
+
+		{'?', 1, 4, "75 6e 64 65 66 0a"},
+	}
+
+	for _, test := range tests {
+		expected, _ := hexStringToByteArray(test.expected)
+		if response := request(test.op, test.one, test.two); !bytes.Equal(response, expected) {
+			t.Fatalf("Expected %X for %c %d %d, got %X", expected, test.op, test.one, test.two, response)
+		}
+	}
+}
+
+// message encodes a 9-byte message
+func message(op byte, one, two int32) []byte {
+	data := binary.BigEndian.AppendUint32([]byte{op}, uint32(one))
+	return binary.BigEndian.AppendUint32(data, uint32(two))
+}
+
+// dialTest connects to the server, sending the messages
+func dialTest(t *testing.T, addr string, messages ...[]byte) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	send(t, conn, messages...)
+	return conn
+}
+
+// send writes the messages to the connection
+func send(t *testing.T, conn net.Conn, messages ...[]byte) {
+	t.Helper()
+	for _, message := range messages {
+		if _, err := conn.Write(message); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+}
+
+// expectResponse reads a response, failing unless it's as expected (hex)
+func expectResponse(t *testing.T, conn net.Conn, expected string) {
+	t.Helper()
+	expectedBytes, _ := hexStringToByteArray(expected)
+	response := make([]byte, len(expectedBytes))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !bytes.Equal(response, expectedBytes) {
+		t.Fatalf("Expected response %X, got %X", expectedBytes, response)
+	}
+}
+
+func TestSharedAssets(t *testing.T) {
+	addr := startTestServer(t, Options{Shared: true})
+
+	// Nothing works until an asset is selected
+	first := dialTest(t, addr, message(OP_INSERT, 1, 100))
+	expectResponse(t, first, "75 6e 64 65 66 0a") // (undef)
+
+	send(t, first, message(OP_SELECT_ASSET, 7, 0), message(OP_INSERT, 1, 100), message(OP_COUNT, 0, 10))
+	expectResponse(t, first, "00 00 00 01") // (so the insert is done)
+	second := dialTest(t, addr, message(OP_SELECT_ASSET, 7, 0), message(OP_INSERT, 2, 200), message(OP_MEAN, 0, 10))
+	expectResponse(t, second, "00 00 00 96") // (150, both clients' prices)
+
+	// Other assets are separate (negative ids too)
+	third := dialTest(t, addr, message(OP_SELECT_ASSET, -7, 0), message(OP_COUNT, 0, 10))
+	expectResponse(t, third, "00 00 00 00")
+
+	// Clients can switch assets
+	send(t, third, message(OP_SELECT_ASSET, 7, 0), message(OP_COUNT, 0, 10))
+	expectResponse(t, third, "00 00 00 02")
+
+	// There can only be so many assets (but existing ones can still be selected)
+	limited := dialTest(t, startTestServer(t, Options{Shared: true, MaxAssets: 2}),
+		message(OP_SELECT_ASSET, 1, 0), message(OP_SELECT_ASSET, 2, 0), message(OP_SELECT_ASSET, 3, 0),
+		message(OP_SELECT_ASSET, 1, 0), message(OP_COUNT, 0, 10))
+	expectResponse(t, limited, "75 6e 64 65 66 0a 00 00 00 00")
+
+	// Without shared assets, there's nothing to select
+	unshared := dialTest(t, startTestServer(t, Options{}), message(OP_SELECT_ASSET, 7, 0))
+	expectResponse(t, unshared, "75 6e 64 65 66 0a")
+
+	if _, err := NewServer(0, Options{DataDir: t.TempDir()}, server.Settings{}); err == nil {
+		t.Fatalf("Expected an error persisting assets that aren't shared")
+	}
+}
+
+func TestSharedAssetsConcurrently(t *testing.T) {
+	addr := startTestServer(t, Options{Shared: true})
+
+	// Several clients insert (and query) at once, each at its own timestamps
+	// (with prices equal to them), so each knows what its queries of its own
+	// timestamps should get, whatever the others are doing
+	const clients, prices = 8, 500
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn := dialTest(t, addr, message(OP_SELECT_ASSET, 1, 0))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			first, last := int32(i*prices), int32((i+1)*prices-1)
+
+			var messages []byte
+			for j := int32(0); j < prices; j++ {
+				messages = append(messages, message(OP_INSERT, first+j, first+j)...)
+				messages = append(messages, message(OP_COUNT, first, last)...)
+				messages = append(messages, message(OP_MEDIAN, first, last)...)
+				messages = append(messages, message(OP_COUNT, 0, math.MaxInt32)...)
+			}
+			messages = append(messages, message(OP_DELETE, first, first)...)
+			if _, err := conn.Write(messages); err != nil {
+				t.Errorf("Client %d failed to send messages: %v", i, err)
+				return
+			}
+
+			response := make([]byte, prices*12+4)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, response); err != nil {
+				t.Errorf("Client %d failed to read responses: %v", i, err)
+				return
+			}
+			for j := int32(0); j < prices; j++ {
+				own := binary.BigEndian.Uint32(response[j*12:])
+				median := int32(binary.BigEndian.Uint32(response[j*12+4:]))
+				total := binary.BigEndian.Uint32(response[j*12+8:])
+
+				// (The median is the lower middle of first..first+j)
+				if own != uint32(j+1) || median != first+j/2 || total < own || total > clients*prices {
+					t.Errorf("Client %d expected %d prices (median %d) of its own after %d inserts, of up to %d in total, got %d (median %d) of %d",
+						i, j+1, first+j/2, j+1, clients*prices, own, median, total)
+					return
+				}
+			}
+			if deleted := binary.BigEndian.Uint32(response[prices*12:]); deleted != 1 {
+				t.Errorf("Client %d expected to delete 1 price, got %d", i, deleted)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	conn := dialTest(t, addr, message(OP_SELECT_ASSET, 1, 0), message(OP_COUNT, 0, math.MaxInt32))
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if count := binary.BigEndian.Uint32(response); count != clients*(prices-1) {
+		t.Fatalf("Expected %d prices, got %d", clients*(prices-1), count)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Shared: true, DataDir: dir}
+
+	srv, err := NewServer(0, options, server.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	go srv.Serve(context.Background())
+
+	conn := dialTest(t, srv.Addr().String(),
+		message(OP_SELECT_ASSET, -1, 0),
+		message(OP_INSERT, 1, 10), message(OP_INSERT, 2, 20), message(OP_INSERT, 3, 30),
+		message(OP_INSERT, 3, 60), message(OP_DELETE, 1, 1), message(OP_DELETE, 5, 9))
+	expectResponse(t, conn, "00 00 00 01 00 00 00 00")
+	conn.Close()
+	srv.Close()
+
+	// A crash part way through writing a message is ignored
+	path := filepath.Join(dir, "asset-ffffffff.log")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Expected a log file: %v", err)
+	}
+	file.Write(message(OP_INSERT, 4, 1000)[:5])
+	file.Close()
+
+	// After a restart, the asset is as it was (and still logging)
+	addr := startTestServer(t, options)
+	conn = dialTest(t, addr, message(OP_SELECT_ASSET, -1, 0), message(OP_SUM, 0, 10), message(OP_INSERT, 4, 40))
+	expectResponse(t, conn, "00 00 00 00 00 00 00 50") // (20 + 60)
+
+	addr = startTestServer(t, options)
+	conn = dialTest(t, addr, message(OP_SELECT_ASSET, -1, 0), message(OP_MEAN, 0, 10))
+	expectResponse(t, conn, "00 00 00 28") // (40)
+
+	// A corrupt log can't be loaded (but other assets are fine)
+	os.WriteFile(filepath.Join(dir, "asset-00000002.log"), []byte("nonsense!"), 0o644)
+	conn = dialTest(t, addr, message(OP_SELECT_ASSET, 2, 0), message(OP_SELECT_ASSET, 3, 0), message(OP_COUNT, 0, 10))
+	expectResponse(t, conn, "75 6e 64 65 66 0a 00 00 00 00")
+}
+
+func TestAssetLogs(t *testing.T) {
+	dir := t.TempDir()
+	assets, err := NewAssets(dir, DUPLICATES_OVERWRITE, 0)
+	if err != nil {
+		t.Fatalf("Failed to create assets: %v", err)
+	}
+
+	// Logs are opened on the first change, and closed once no client has
+	// the asset selected
+	first, _ := assets.get(5)
+	second, _ := assets.get(5)
+	if first != second || first.log != nil {
+		t.Fatalf("Expected one asset, without an open log")
+	}
+	if _, err := first.insert(message(OP_INSERT, 1, 10), 1, 10); err != nil || first.log == nil {
+		t.Fatalf("Expected the log to be open after an insert (%v)", err)
+	}
+	assets.release(first)
+	if first.log == nil {
+		t.Fatalf("Expected the log to stay open while the asset is selected")
+	}
+	assets.release(second)
+	if first.log != nil {
+		t.Fatalf("Expected the log to be closed once the asset isn't selected")
+	}
+
+	// Clients selecting an asset at once share one replay of its log
+	reloaded, _ := NewAssets(dir, DUPLICATES_OVERWRITE, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := reloaded.get(5)
+			if err != nil {
+				t.Errorf("Failed to select asset: %v", err)
+				return
+			}
+			if count := a.totals(0, 10).Count; count != 1 {
+				t.Errorf("Expected the asset to have been loaded with 1 price, got %d", count)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Nothing can be selected once closed
+	if err := reloaded.Close(); err != nil {
+		t.Fatalf("Failed to close assets: %v", err)
+	}
+	if _, err := reloaded.get(5); !errors.Is(err, ErrAssetsClosed) {
+		t.Fatalf("Expected ErrAssetsClosed, got %v", err)
+	}
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	// Prices 10 then 30 at timestamp 1, and 20 at 2
+	tests := map[DuplicatePolicy]struct {
+		count int
+		sum   int64
+	}{
+		"":                    {2, 50}, // (overwriting)
+		DUPLICATES_OVERWRITE:  {2, 50},
+		DUPLICATES_KEEP_FIRST: {2, 30},
+		DUPLICATES_REJECT:     {2, 30},
+		DUPLICATES_STORE_ALL:  {3, 60},
+	}
+
+	for policy, expected := range tests {
+		series := NewSeries()
+		for i, insert := range [][2]int32{{1, 10}, {2, 20}, {1, 30}} {
+			if duplicate := series.Insert(insert[0], insert[1], policy); duplicate != (i == 2) {
+				t.Fatalf("Expected only the last insert to be a duplicate with policy %q", policy)
+			}
+		}
+		if count, sum := series.Range(0, 10); count != expected.count || sum != expected.sum {
+			t.Fatalf("Expected %d prices summing to %d with policy %q, got %d summing to %d",
+				expected.count, expected.sum, policy, count, sum)
+		}
+	}
+
+	// Stored duplicates stay together, however the tree is split
+	series := NewSeries()
+	for i := int32(0); i < 100; i++ {
+		series.Insert(i%10, i, DUPLICATES_STORE_ALL)
+	}
+	if count, _ := series.Range(3, 3); count != 10 {
+		t.Fatalf("Expected 10 prices at one timestamp, got %d", count)
+	}
+	if deleted := series.Delete(3, 4); deleted != 20 || series.Len() != 80 {
+		t.Fatalf("Expected to delete 20 of 100 prices, deleted %d leaving %d", deleted, series.Len())
+	}
+	if series.Insert(5, 0, DUPLICATES_OVERWRITE); series.Len() != 71 {
+		t.Fatalf("Expected overwriting to replace every price at a timestamp, got %d left", series.Len())
+	}
+
+	// Rejected duplicates disconnect the client (and only them)
+	addr := startTestServer(t, Options{Duplicates: DUPLICATES_REJECT})
+	conn := dialTest(t, addr, message(OP_INSERT, 1, 10), message(OP_INSERT, 1, 30), message(OP_MEAN, 0, 10))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// (Closed with the query unread, so possibly reset rather than EOF)
+	if response, err := io.ReadAll(conn); len(response) > 0 || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected to be disconnected without a response, got %X (%v)", response, err)
+	}
+	conn = dialTest(t, addr, message(OP_INSERT, 1, 30), message(OP_MEAN, 0, 10))
+	expectResponse(t, conn, "00 00 00 1e")
+
+	if _, err := ParseDuplicatePolicy("store-all"); err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	if _, err := ParseDuplicatePolicy("average"); err == nil {
+		t.Fatalf("Expected an error for an unknown policy")
+	}
+}
+
+func TestRoundingPolicies(t *testing.T) {
+	tests := []struct {
+		sum                             int64
+		count                           int
+		halfAway, halfEven, floor, ceil int64
+	}{
+		{10, 2, 5, 5, 5, 5},
+		{10, 4, 3, 2, 2, 3},      // 2.5
+		{14, 4, 4, 4, 3, 4},      // 3.5
+		{-10, 4, -3, -2, -3, -2}, // -2.5
+		{-14, 4, -4, -4, -4, -3}, // -3.5
+		{10, 3, 3, 3, 3, 4},      // 3.33...
+		{20, 3, 7, 7, 6, 7},      // 6.66...
+		{-20, 3, -7, -7, -7, -6},
+
+		// Beyond float64 precision: (2^53 + 1) / 2 would be 2^52 as floats
+		{1<<53 + 1, 2, 1<<52 + 1, 1 << 52, 1 << 52, 1<<52 + 1},
+		{math.MaxInt64, 1, math.MaxInt64, math.MaxInt64, math.MaxInt64, math.MaxInt64},
+	}
+
+	for _, test := range tests {
+		for policy, expected := range map[RoundingPolicy]int64{
+			"":              test.halfAway, // (the default)
+			ROUND_HALF_AWAY: test.halfAway,
+			ROUND_HALF_EVEN: test.halfEven,
+			ROUND_FLOOR:     test.floor,
+			ROUND_CEIL:      test.ceil,
+		} {
+			if mean := policy.Mean(test.sum, test.count); mean != expected {
+				t.Fatalf("Expected %d / %d to be %d with policy %q, got %d",
+					test.sum, test.count, expected, policy, mean)
+			}
+		}
+	}
+
+	// Queries use the server's policy
+	addr := startTestServer(t, Options{Rounding: ROUND_FLOOR})
+	conn := dialTest(t, addr, message(OP_INSERT, 1, 1), message(OP_INSERT, 2, 2), message(OP_MEAN, 0, 10))
+	expectResponse(t, conn, "00 00 00 01")
+
+	if _, err := ParseRoundingPolicy("half-even"); err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	if _, err := ParseRoundingPolicy("truncate"); err == nil {
+		t.Fatalf("Expected an error for an unknown policy")
+	}
+}
+
+func TestAllocations(t *testing.T) {
+	session := &client{asset: newAsset(""), percentile: DEFAULT_PERCENTILE}
+	for i := int32(0); i < 1000; i++ {
+		session.asset.insert(message(OP_INSERT, i, i), i, i)
+	}
+
+	// Once warmed up, answering messages doesn't allocate (overwriting
+	// reuses the old node, and percentiles reuse their buffer)
+	response := make([]byte, 0, MAX_RESPONSE_SIZE)
+	for _, data := range [][]byte{
+		message(OP_INSERT, 500, 1),
+		message(OP_MEAN, 0, 1000),
+		message(OP_SUM, 0, 1000),
+		message(OP_MEDIAN, 0, 1000),
+		message(OP_SET_PERCENTILE, 90, 0),
+		message(OP_DELETE, 2000, 3000),
+		message('?', 0, 0),
+	} {
+		handleBytesData(data, session, response[:0])
+		allocs := testing.AllocsPerRun(100, func() {
+			start := time.Now()
+			response, _ = handleBytesData(data, session, response[:0])
+			server.RequestDuration.Since(start, PROBLEM)
+		})
+		if allocs > 0 {
+			t.Fatalf("Expected no allocations answering %c, got %.1f", data[0], allocs)
+		}
+	}
+}
+
+//
+// === BENCHMARKS === //
+//
+
+// SERIES_SIZES are the numbers of prices benchmarked, per client
+var SERIES_SIZES = []int{1_000, 100_000, 1_000_000, 4_000_000}
+
+// randomSeries returns a series of n prices at distinct random timestamps
+func randomSeries(n int) *Series {
+	rng := rand.New(rand.NewSource(1))
+	series := newSeededSeries(1)
+	for _, timestamp := range rng.Perm(n) {
+		series.Insert(int32(timestamp), rng.Int31n(1_000_000), DUPLICATES_OVERWRITE)
+	}
+	return series
+}
+
+// Inserts stay O(log n), however many prices there are
+func BenchmarkInsert(b *testing.B) {
+	for _, size := range SERIES_SIZES {
+		series := randomSeries(size) // (once, not for every b.N tried)
+		b.Run(fmt.Sprintf("prices=%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(2))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				series.Insert(int32(rng.Intn(2*size)), 100, DUPLICATES_OVERWRITE)
+			}
+		})
+	}
+}
+
+// As do queries, however wide the range
+func BenchmarkQuery(b *testing.B) {
+	for _, size := range SERIES_SIZES {
+		series := randomSeries(size) // (once, not for every b.N tried)
+		b.Run(fmt.Sprintf("prices=%d", size), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(2))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mintime := int32(rng.Intn(size))
+				series.Range(mintime, mintime+int32(rng.Intn(size)))
+			}
+		})
+	}
+}
+
+// Frames sent per connection by BenchmarkPipelined
+const PIPELINED_FRAMES = 1_000_000
+
+// Throughput for a client sending all its messages without waiting for
+// responses (each op is a connection sending PIPELINED_FRAMES messages, so
+// allocs/op is the total for that many)
+func BenchmarkPipelined(b *testing.B) {
+	addr := startTestServer(b, Options{})
+
+	// 9 in 10 messages are inserts, and the rest queries (with 4 byte responses)
+	rng := rand.New(rand.NewSource(1))
+	frames := make([]byte, 0, PIPELINED_FRAMES*MESSAGE_SIZE)
+	queries := 0
+	for i := 0; i < PIPELINED_FRAMES; i++ {
+		if i%10 == 9 {
+			mintime := rng.Int31n(PIPELINED_FRAMES)
+			frames = append(frames, message(OP_MEAN, mintime, mintime+1000)...)
+			queries++
+		} else {
+			frames = append(frames, message(OP_INSERT, rng.Int31n(PIPELINED_FRAMES), rng.Int31n(1000))...)
+		}
+	}
+	responses := make([]byte, queries*4)
+
+	b.SetBytes(int64(len(frames)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatalf("Failed to connect to server: %v", err)
+		}
+
+		// (Writing while reading, so neither side's buffers fill up)
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(frames)
+			written <- err
+		}()
+		if _, err := io.ReadFull(conn, responses); err != nil {
+			b.Fatalf("Failed to read responses: %v", err)
+		}
+		if err := <-written; err != nil {
+			b.Fatalf("Failed to send messages: %v", err)
+		}
+		conn.Close()
+	}
+	b.ReportMetric(float64(b.N*PIPELINED_FRAMES)/b.Elapsed().Seconds(), "frames/s")
+}
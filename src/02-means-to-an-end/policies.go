@@ -0,0 +1,92 @@
+package meanstoanend
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Policies for what the spec leaves up to the server: prices inserted at a
+// timestamp that already has one (undefined behaviour), and rounding means
+// that aren't whole numbers (either way is fine).
+
+// DuplicatePolicy decides what happens to a price inserted at a timestamp
+// that already has one
+type DuplicatePolicy string
+
+const (
+	DUPLICATES_OVERWRITE  DuplicatePolicy = "overwrite"  // the new price replaces the old (the default)
+	DUPLICATES_KEEP_FIRST DuplicatePolicy = "keep-first" // the new price is ignored
+	DUPLICATES_REJECT     DuplicatePolicy = "reject"     // the new price is ignored, and the client disconnected
+	DUPLICATES_STORE_ALL  DuplicatePolicy = "store-all"  // both prices are kept (and counted)
+)
+
+// The client was disconnected for inserting a duplicate timestamp (with
+// DUPLICATES_REJECT)
+var ErrDuplicateTimestamp = errors.New("duplicate timestamp")
+
+// ParseDuplicatePolicy reads a duplicate policy by name
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(s); policy {
+	case DUPLICATES_OVERWRITE, DUPLICATES_KEEP_FIRST, DUPLICATES_REJECT, DUPLICATES_STORE_ALL:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q (overwrite, keep-first, reject or store-all)", s)
+}
+
+// RoundingPolicy decides which way to round a mean that isn't whole
+type RoundingPolicy string
+
+const (
+	ROUND_HALF_AWAY RoundingPolicy = "half-away" // to the nearest, halves away from zero (the default)
+	ROUND_HALF_EVEN RoundingPolicy = "half-even" // to the nearest, halves to the even neighbour
+	ROUND_FLOOR     RoundingPolicy = "floor"     // down
+	ROUND_CEIL      RoundingPolicy = "ceil"      // up
+)
+
+// ParseRoundingPolicy reads a rounding policy by name
+func ParseRoundingPolicy(s string) (RoundingPolicy, error) {
+	switch policy := RoundingPolicy(s); policy {
+	case ROUND_HALF_AWAY, ROUND_HALF_EVEN, ROUND_FLOOR, ROUND_CEIL:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown rounding policy %q (half-away, half-even, floor or ceil)", s)
+}
+
+// Mean divides sum by count (which must be positive), rounding exactly
+// (unlike dividing as floats, which loses precision for large sums)
+func (policy RoundingPolicy) Mean(sum int64, count int) int64 {
+	n := int64(count)
+	quotient, remainder := sum/n, sum%n // (rounded towards zero)
+	if remainder == 0 {
+		return quotient
+	}
+
+	// Rounding away from zero is one further from zero
+	away := quotient + 1
+	if sum < 0 {
+		away = quotient - 1
+	}
+
+	switch policy {
+	case ROUND_FLOOR:
+		return min(quotient, away)
+	case ROUND_CEIL:
+		return max(quotient, away)
+	}
+
+	// (|remainder| < n, so doubling it can't overflow)
+	twice := 2 * remainder
+	if twice < 0 {
+		twice = -twice
+	}
+	switch {
+	case twice < n:
+		return quotient
+	case twice > n:
+		return away
+	case policy == ROUND_HALF_EVEN && quotient%2 == 0:
+		return quotient
+	default:
+		return away
+	}
+}
@@ -0,0 +1,301 @@
+package meanstoanend
+
+import (
+	"math/rand"
+	"slices"
+)
+
+// Time series storage for one asset's prices.
+//
+// Prices are kept in a treap (a binary search tree by timestamp, balanced
+// by giving each node a random priority, and keeping the highest priority
+// at the root). Each node also records the number, sum, minimum and maximum
+// of the prices in its subtree, so inserts, deletes and range totals are
+// O(log n), however many prices have been inserted. (Percentiles aren't:
+// they sort the prices in the range, so are O(m log m) in the range size.)
+//
+// With DUPLICATES_STORE_ALL, a timestamp can have several nodes (which
+// split and merge keep together, in the order they were inserted).
+//
+// Nodes live in one slice, and refer to each other by index (0 for none),
+// so a series with millions of prices is only a few allocations. Deleted
+// nodes are reused by later inserts.
+
+// NO_NODE is the index for a missing child (nodes[0] is never used)
+const NO_NODE = 0
+
+// node is one price, and the totals for its subtree
+type node struct {
+	timestamp   int32
+	price       int32
+	priority    uint32
+	left, right int32 // children (NO_NODE for none)
+
+	// Subtree totals, including this node
+	count    int
+	sum      int64
+	min, max int32
+}
+
+// Series holds an asset's prices, by timestamp
+type Series struct {
+	nodes []node
+	root  int32
+	rng   uint64  // state for node priorities
+	free  []int32 // deleted nodes, to reuse
+
+	scratch []int32 // prices being sorted, see Percentile
+}
+
+// Totals are the totals for the prices in a range (Min and Max are 0 if
+// there are none)
+type Totals struct {
+	Count    int
+	Sum      int64
+	Min, Max int32
+}
+
+// add includes a node's subtree (or just the node itself) in the totals
+func (t *Totals) add(n *node, subtree bool) {
+	count, sum, min, max := n.count, n.sum, n.min, n.max
+	if !subtree {
+		count, sum, min, max = 1, int64(n.price), n.price, n.price
+	}
+	if t.Count == 0 || min < t.Min {
+		t.Min = min
+	}
+	if t.Count == 0 || max > t.Max {
+		t.Max = max
+	}
+	t.Count += count
+	t.Sum += sum
+}
+
+// NewSeries returns an empty series, with node priorities seeded randomly
+// (so clients can't pick an insert order that unbalances the tree)
+func NewSeries() *Series {
+	return newSeededSeries(rand.Uint64())
+}
+
+// newSeededSeries returns an empty series with the same node priorities
+// every time, for tests and benchmarks (xorshift's state can't be 0, so a
+// seed of 0 is replaced)
+func newSeededSeries(seed uint64) *Series {
+	if seed == 0 {
+		seed = 0x9E3779B97F4A7C15
+	}
+	return &Series{nodes: make([]node, 1), rng: seed}
+}
+
+// Len returns the number of prices stored
+func (s *Series) Len() int {
+	return s.nodes[s.root].count
+}
+
+// Insert stores a price, returning whether there was already a price at
+// that timestamp (and if so, keeping, replacing or adding to it, depending
+// on the duplicate policy, overwriting by default)
+func (s *Series) Insert(timestamp, price int32, duplicates DuplicatePolicy) (duplicate bool) {
+	// Split out the nodes at the timestamp (if any), then join them back up
+	before, rest := s.split(s.root, timestamp, false)
+	existing, after := s.split(rest, timestamp, true)
+	duplicate = existing != NO_NODE
+
+	switch {
+	case !duplicate:
+		existing = s.newNode(timestamp, price)
+	case duplicates == DUPLICATES_KEEP_FIRST || duplicates == DUPLICATES_REJECT:
+		// (Left as it was)
+	case duplicates == DUPLICATES_STORE_ALL:
+		existing = s.merge(existing, s.newNode(timestamp, price))
+	default:
+		s.release(existing)
+		existing = s.newNode(timestamp, price)
+	}
+	s.root = s.merge(s.merge(before, existing), after)
+	return duplicate
+}
+
+// Range returns the number of prices with timestamps from mintime to
+// maxtime (inclusive), and their sum
+func (s *Series) Range(mintime, maxtime int32) (count int, sum int64) {
+	totals := s.Totals(mintime, maxtime)
+	return totals.Count, totals.Sum
+}
+
+// Totals returns the totals for prices with timestamps from mintime to
+// maxtime (inclusive)
+func (s *Series) Totals(mintime, maxtime int32) Totals {
+	var totals Totals
+	if mintime <= maxtime {
+		s.totals(s.root, mintime, maxtime, false, false, &totals)
+	}
+	return totals
+}
+
+// totals adds up the subtree's prices from mintime to maxtime, where its
+// timestamps are already known to be at least mintime (if aboveMin), and
+// at most maxtime (if belowMax)
+func (s *Series) totals(i, mintime, maxtime int32, aboveMin, belowMax bool, totals *Totals) {
+	for i != NO_NODE {
+		n := &s.nodes[i]
+		switch {
+		case aboveMin && belowMax:
+			totals.add(n, true)
+			return
+		case n.timestamp < mintime:
+			i = n.right
+		case n.timestamp > maxtime:
+			i = n.left
+		default:
+			// (Below here, each side is a single path, adding whole subtrees)
+			totals.add(n, false)
+			s.totals(n.left, mintime, maxtime, aboveMin, true, totals)
+			aboveMin, i = true, n.right
+		}
+	}
+}
+
+// Percentile returns the price at the percentile (0 to 100) of the prices
+// with timestamps from mintime to maxtime, using the nearest rank (so the
+// 50th percentile of 4 prices is the 2nd lowest), or false if there are none
+func (s *Series) Percentile(mintime, maxtime int32, percentile int) (int32, bool) {
+	if mintime > maxtime {
+		return 0, false
+	}
+	s.scratch = s.appendPrices(s.scratch[:0], s.root, mintime, maxtime)
+	if len(s.scratch) == 0 {
+		return 0, false
+	}
+	slices.Sort(s.scratch)
+
+	// (The smallest rank covering the percentile, at least the first)
+	rank := max((percentile*len(s.scratch)+99)/100, 1)
+	return s.scratch[rank-1], true
+}
+
+// appendPrices appends the subtree's prices from mintime to maxtime
+func (s *Series) appendPrices(prices []int32, i, mintime, maxtime int32) []int32 {
+	for i != NO_NODE {
+		n := &s.nodes[i]
+		switch {
+		case n.timestamp < mintime:
+			i = n.right
+		case n.timestamp > maxtime:
+			i = n.left
+		default:
+			prices = s.appendPrices(prices, n.left, mintime, maxtime)
+			prices = append(prices, n.price)
+			i = n.right
+		}
+	}
+	return prices
+}
+
+// Delete removes the prices with timestamps from mintime to maxtime
+// (inclusive), returning how many there were
+func (s *Series) Delete(mintime, maxtime int32) int {
+	if mintime > maxtime {
+		return 0
+	}
+	before, rest := s.split(s.root, mintime, false)
+	deleted, after := s.split(rest, maxtime, true)
+	s.root = s.merge(before, after)
+
+	count := s.nodes[deleted].count
+	s.release(deleted)
+	return count
+}
+
+//
+// === TREAP === //
+//
+
+// newNode adds an unlinked node, returning its index
+func (s *Series) newNode(timestamp, price int32) int32 {
+	// (xorshift64, which is plenty random enough to keep the tree balanced)
+	s.rng ^= s.rng << 13
+	s.rng ^= s.rng >> 7
+	s.rng ^= s.rng << 17
+
+	n := node{
+		timestamp: timestamp,
+		price:     price,
+		priority:  uint32(s.rng),
+		count:     1,
+		sum:       int64(price),
+		min:       price,
+		max:       price,
+	}
+
+	// (Reusing a deleted node, if there are any)
+	if len(s.free) > 0 {
+		i := s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+		s.nodes[i] = n
+		return i
+	}
+	s.nodes = append(s.nodes, n)
+	return int32(len(s.nodes) - 1)
+}
+
+// release frees a (detached) subtree's nodes, for reuse
+func (s *Series) release(i int32) {
+	for i != NO_NODE {
+		s.release(s.nodes[i].left)
+		s.free = append(s.free, i)
+		i = s.nodes[i].right
+	}
+}
+
+// update recalculates a node's subtree totals from its children
+func (s *Series) update(i int32) {
+	n := &s.nodes[i]
+	left, right := &s.nodes[n.left], &s.nodes[n.right]
+	n.count = left.count + right.count + 1
+	n.sum = left.sum + right.sum + int64(n.price)
+
+	n.min, n.max = n.price, n.price
+	if n.left != NO_NODE {
+		n.min, n.max = min(n.min, left.min), max(n.max, left.max)
+	}
+	if n.right != NO_NODE {
+		n.min, n.max = min(n.min, right.min), max(n.max, right.max)
+	}
+}
+
+// split divides a subtree into nodes before the timestamp and the rest
+// (or, if inclusive, nodes up to and including the timestamp and the rest)
+func (s *Series) split(i int32, timestamp int32, inclusive bool) (left, right int32) {
+	if i == NO_NODE {
+		return NO_NODE, NO_NODE
+	}
+	n := &s.nodes[i]
+	if n.timestamp < timestamp || (inclusive && n.timestamp == timestamp) {
+		n.right, right = s.split(n.right, timestamp, inclusive)
+		s.update(i)
+		return i, right
+	}
+	left, n.left = s.split(n.left, timestamp, inclusive)
+	s.update(i)
+	return left, i
+}
+
+// merge joins two subtrees, where every timestamp in left comes before
+// those in right
+func (s *Series) merge(left, right int32) int32 {
+	if left == NO_NODE {
+		return right
+	}
+	if right == NO_NODE {
+		return left
+	}
+	if s.nodes[left].priority > s.nodes[right].priority {
+		s.nodes[left].right = s.merge(s.nodes[left].right, right)
+		s.update(left)
+		return left
+	}
+	s.nodes[right].left = s.merge(left, s.nodes[right].left)
+	s.update(right)
+	return right
+}
@@ -1,3 +1,8 @@
 module github.com/finwarman/protohackers/budgetchat
 
 go 1.21.6
+
+require github.com/finwarman/protohackers v0.0.0-00010101000000-000000000000
+
+// The shared libraries (src/lib) come from the repository's root module
+replace github.com/finwarman/protohackers => ../..
@@ -1,10 +1,20 @@
 package budgetchat
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+
+	"github.com/finwarman/protohackers/src/lib/metrics"
+)
+
+// Joined users, across all rooms in this process
+var roomSize = metrics.NewGauge("protohackers_budgetchat_room_size",
+	"Users currently in the chat room")
 
 // Broadcaster handles sending messages to multiple clients
 type Broadcaster struct {
 	clients map[int]*Client // id -> client
+	mu      sync.RWMutex
 }
 
 // NewBroadcaster creates a new Broadcaster instance
@@ -20,7 +30,13 @@ func (b *Broadcaster) Subscribe(client *Client) (bool, error) {
 		return false, fmt.Errorf("subscription failed: no client provided")
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	// Subscribe client (overwrites if already subscribed)
+	if _, ok := b.clients[client.id]; !ok {
+		roomSize.Inc()
+	}
 	b.clients[client.id] = client
 
 	return true, nil
@@ -32,7 +48,13 @@ func (b *Broadcaster) Unsubscribe(client *Client) (bool, error) {
 		return false, fmt.Errorf("unsubscription failed: no client provided")
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	// Unsubscribe client, safely ignore if client was already unsubscribed
+	if _, ok := b.clients[client.id]; ok {
+		roomSize.Dec()
+	}
 	delete(b.clients, client.id)
 
 	return true, nil
@@ -45,6 +67,12 @@ func (b *Broadcaster) Broadcast(message Message, sourceClient *Client) (bool, er
 		skipID = sourceClient.id
 	}
 
+	// Hold the read lock while queueing, so clients can't be unsubscribed
+	// (and have their message queue closed) mid-broadcast. Queueing never
+	// waits (see QueueMessage), so this doesn't hold up anyone else.
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	for clientID, client := range b.clients {
 		// Don't send message back to source client (if set)
 		if skipID > 0 && clientID == skipID {
@@ -56,3 +84,20 @@ func (b *Broadcaster) Broadcast(message Message, sourceClient *Client) (bool, er
 
 	return true, nil
 }
+
+// Usernames returns the usernames of all subscribed clients, except the given client
+func (b *Broadcaster) Usernames(except *Client) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var usernames []string
+	for _, client := range b.clients {
+		if except != nil && client.id == except.id {
+			continue
+		}
+		if client.username != "" {
+			usernames = append(usernames, client.username)
+		}
+	}
+	return usernames
+}
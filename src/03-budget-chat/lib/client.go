@@ -1,10 +1,15 @@
 package budgetchat
 
 import (
-	"fmt"
+	"log/slog"
 	"net"
+	"sync"
 )
 
+// Most messages queued for a client, before it's disconnected for not
+// keeping up (so one slow reader can't hold up everyone else's broadcasts)
+const MAX_QUEUED_MESSAGES = 256
+
 // Message represents a client message
 type Message struct {
 	data string
@@ -15,31 +20,81 @@ type Client struct {
 	id       int
 	joined   bool
 	username string
-	msgChan  chan Message // message queue
+	msgChan  chan Message  // message queue
+	done     chan struct{} // closed once the message queue is drained
+	log      *slog.Logger  // tagged with client id (and username, once joined)
+
+	// Closed once the message queue overflows
+	overflow     chan struct{}
+	overflowOnce sync.Once
 }
 
-// QueueMessage adds a message to the message queue for a client
+// NewClient creates a new (not yet joined) Client instance
+func NewClient(id int, log *slog.Logger) *Client {
+	return &Client{
+		id:       id,
+		msgChan:  make(chan Message, MAX_QUEUED_MESSAGES),
+		done:     make(chan struct{}),
+		log:      log.With("client_id", id),
+		overflow: make(chan struct{}),
+	}
+}
+
+// QueueMessage adds a message to the message queue for a client, without
+// waiting: if the queue is full, the message is dropped and the client
+// disconnected (see ProcessMessages)
 func (c *Client) QueueMessage(message Message) {
-	// usernameMsg := Colourise("@"+c.username, ColourYellow)
-	// fmt.Printf("%s%s\tqueueing message: '%s'\n", S_PREFIX, usernameMsg, message.data)
+	// c.log.Debug("queueing message", "message", message.data)
 
 	// Push message to this client's message channel
-	c.msgChan <- message
+	select {
+	case c.msgChan <- message:
+	default:
+		c.overflowOnce.Do(func() { close(c.overflow) })
+	}
 }
 
 // ProcessMessages is the client message processing loop
 func (c *Client) ProcessMessages(conn net.Conn) {
-	// Continually read from message channel
-	for msg := range c.msgChan {
-		if len(msg.data) > 0 {
-			usernameMsg := Colourise("@"+c.username, ColourYellow)
-			fmt.Printf("%s%s\tsending message: '%s'\n", S_PREFIX, usernameMsg, msg.data)
+	defer close(c.done)
+
+	// Once a write fails, keep draining the queue (without sending),
+	// so broadcasts to this client don't block until it is unsubscribed
+	failed := false
+
+	// Continually read from message channel, until closed by Stop
+	overflow := c.overflow
+	for {
+		var msg Message
+		select {
+		case m, ok := <-c.msgChan:
+			if !ok {
+				return
+			}
+			msg = m
+		case <-overflow:
+			// Too slow: disconnect (ending its reads, so it's unsubscribed)
+			c.log.Warn("disconnecting", "reason", "message queue full", "max_queued", MAX_QUEUED_MESSAGES)
+			_ = conn.Close()
+			failed, overflow = true, nil
+			continue
+		}
+
+		if len(msg.data) > 0 && !failed {
+			c.log.Debug("sending message", "message", msg.data)
 
 			// Send the response
 			if _, err := conn.Write([]byte(msg.data + MSG_TERM)); err != nil {
-				fmt.Println(S_PREFIX+"write error:", err.Error())
-				break
+				c.log.Warn("write error", "error", err)
+				failed = true
 			}
 		}
 	}
 }
+
+// Stop closes the message queue, and waits for queued messages to be sent.
+// The client must already be unsubscribed from the broadcaster.
+func (c *Client) Stop() {
+	close(c.msgChan)
+	<-c.done
+}
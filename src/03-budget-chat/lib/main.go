@@ -1,12 +1,15 @@
 package budgetchat
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"io"
 	"net"
-	"os"
 	"strings"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/lines"
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
 // Default tcp port for server
@@ -15,44 +18,73 @@ const DEFAULT_TCP_PORT = 25565
 // Character to indicate sent message is terminated
 const MSG_TERM = "\n"
 
-// Run the server
-func StartServer(port int) {
-	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+// Longest message accepted (bytes), see OVERSIZE_POLICY
+const MAX_LINE_LENGTH = 4096
+
+// Oversize messages are truncated, rather than dropping the client
+const OVERSIZE_POLICY = lines.TRUNCATE
+
+// Problem name, for logs and metrics
+const PROBLEM = "budget-chat"
+
+// Logger for this problem
+var logger = logging.Named(PROBLEM)
+
+// System message sent to joined clients when the server stops
+const SHUTDOWN_MSG = "* server shutting down"
+
+// System message sent to clients turned away by the limiter (plus the reason)
+const REJECT_MSG_PREFIX = "* connection refused: "
+
+// Run the server on the given port, until the context is cancelled
+func StartServer(ctx context.Context, port int, settings server.Settings) error {
+	srv, err := NewServer(port, settings)
 	if err != nil {
-		fmt.Println(S_PREFIX+"listen: ", err.Error())
-		os.Exit(1)
+		return err
 	}
 
-	fmt.Printf(S_PREFIX+"listening on port %d\n", port)
+	return srv.Serve(ctx)
+}
 
-	generator := NewIDGenerator()
-	broadcaster := NewBroadcaster()
+// NewServer creates a chat server listening on the given port
+// (0 picks a free port, see Addr)
+func NewServer(port int, settings server.Settings) (*server.Server, error) {
+	handler := &ChatHandler{
+		generator:   NewIDGenerator(),
+		broadcaster: NewBroadcaster(),
+	}
 
-	// Create a goroutine with a connection handler,
-	// for each new connection. (Must handle at least 5)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println(S_PREFIX+"listener accept error: ", err.Error())
-			os.Exit(1)
-		}
+	config := server.Config{Name: PROBLEM, Host: "localhost", Port: port, Logger: logger, Settings: settings}
 
-		fmt.Println(S_PREFIX+"connection from ", conn.RemoteAddr())
+	// Clients over the limits are told why, with a system message
+	config.Reject = func(conn net.Conn, err error) {
+		_, _ = conn.Write([]byte(REJECT_MSG_PREFIX + err.Error() + MSG_TERM))
+	}
+	return server.Listen(config, handler)
+}
 
-		// Create a Client object to represent this connection
-		client := &Client{
-			id:       int(generator.NextID()),
-			joined:   false,
-			username: "",
-			msgChan:  make(chan Message),
-		}
+// ChatHandler handles connections for a single chat room
+type ChatHandler struct {
+	generator   *IDGenerator
+	broadcaster *Broadcaster
+}
 
-		go HandleConnection(conn, broadcaster, client)
-	}
+// HandleConnection creates a Client object to represent the new connection
+func (h *ChatHandler) HandleConnection(conn net.Conn) {
+	client := NewClient(int(h.generator.NextID()), logging.ForConn(logger, conn))
+
+	HandleConnection(conn, h.broadcaster, client)
+}
+
+// NotifyShutdown tells every joined client that the server is going away
+func (h *ChatHandler) NotifyShutdown() {
+	logger.Info("notifying clients of shutdown")
+
+	_, _ = h.broadcaster.Broadcast(Message{data: SHUTDOWN_MSG}, nil)
 }
 
 func HandleConnection(conn net.Conn, broadcaster *Broadcaster, client *Client) {
-	// Close connection and unsubscribe client on disconnect.
+	// Close connection and unsubscribe client on disconnect (or timeout).
 	defer func() {
 		// Broadcast a leaving message
 		if client.joined {
@@ -60,51 +92,54 @@ func HandleConnection(conn net.Conn, broadcaster *Broadcaster, client *Client) {
 		}
 
 		_, _ = broadcaster.Unsubscribe(client)
+
+		// Stop the message processing goroutine, once queued messages are sent
+		// (Only started once the client has joined)
+		if client.joined {
+			client.Stop()
+		}
+
 		conn.Close()
 	}()
 
 	// Initial connection message: get username
 	welcomeMsg := fmt.Sprintf("[id: %d] Welcome to fubChat! What is your username?", client.id)
 	if _, err := conn.Write([]byte(welcomeMsg + MSG_TERM)); err != nil {
-		fmt.Println(S_PREFIX+"write error:", err.Error())
+		client.log.Warn("write error", "error", err)
 		return
 	}
 
-	// Buffer for storing received data
-	reader := bufio.NewReader(conn)
+	// Reads messages, one per line (oversize messages are truncated)
+	reader := lines.NewReader(conn, MAX_LINE_LENGTH, OVERSIZE_POLICY)
 
 	// Initial message is username
 	for !client.joined {
-		// Read data until newline character
-		usernameInput, err := reader.ReadString('\n')
+		usernameInput, err := reader.ReadLine()
 		if err != nil {
-			if err != io.EOF {
-				fmt.Println(S_PREFIX+"read error:", err.Error())
-			}
+			server.LogReadError(client.log, err)
 			break
 		}
 
-		// Trim newline character
-		usernameInput = strings.TrimSuffix(usernameInput, "\n")
-
-		// [Debug] Print received data to STDOUT
-		fmt.Printf(S_PREFIX+"received username: '%s'\n", usernameInput)
+		client.log.Debug("received username", "username", usernameInput)
 
 		if usernameInput != "" {
 			if !IsValidUsername(usernameInput) {
-				fmt.Printf("%sClient #%d: Invalid username '%s'\n", S_PREFIX, client.id, usernameInput)
+				client.log.Info("invalid username", "username", usernameInput)
 				return
 			}
 			client.username = usernameInput
 			client.joined = true
+			client.log = client.log.With("username", client.username)
 		}
 	}
 
 	if client.username == "" {
-		fmt.Printf("got empty username for client #%d\n", client.id)
+		client.log.Info("got empty username")
 		return
 	}
 
+	client.log.Info("joined the room")
+
 	// Start the message processing goroutine
 	go client.ProcessMessages(conn)
 
@@ -112,13 +147,7 @@ func HandleConnection(conn net.Conn, broadcaster *Broadcaster, client *Client) {
 	_, _ = broadcaster.Subscribe(client)
 
 	// Broadcast '* The room contains: ...' to newly joined user
-	var otherClients []string
-	for _, c := range broadcaster.clients {
-		if client.id != c.id && c.username != "" {
-			otherClients = append(otherClients, c.username)
-		}
-	}
-	otherClientsStr := strings.Join(otherClients, ", ")
+	otherClientsStr := strings.Join(broadcaster.Usernames(client), ", ")
 	usersMessage := "* The room contains: " + otherClientsStr
 	client.QueueMessage(Message{data: usersMessage})
 
@@ -128,20 +157,16 @@ func HandleConnection(conn net.Conn, broadcaster *Broadcaster, client *Client) {
 
 	// While connection is open, check for data to read
 	for {
-		// Read data until newline character
-		data, err := reader.ReadString('\n')
+		// (An unterminated message at disconnect isn't sent)
+		data, err := reader.ReadLine()
 		if err != nil {
-			if err != io.EOF {
-				fmt.Println(S_PREFIX+"read error:", err.Error())
-			}
+			server.LogReadError(client.log, err)
 			break
 		}
 
-		// Trim newline character
-		data = strings.TrimSuffix(data, "\n")
+		client.log.Debug("received", "data", data)
 
-		// [Debug] Print received data to STDOUT
-		fmt.Printf(S_PREFIX+"received: '%s'\n", data)
+		start := time.Now()
 
 		messageStr := fmt.Sprintf("[%s] %s", client.username, data)
 		msg := Message{
@@ -149,5 +174,6 @@ func HandleConnection(conn net.Conn, broadcaster *Broadcaster, client *Client) {
 		}
 
 		_, _ = broadcaster.Broadcast(msg, client)
+		server.RequestDuration.Since(start, PROBLEM)
 	}
 }
@@ -2,74 +2,277 @@ package budgetchat
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
-)
 
-const TEST_TCP_PORT = 44444
+	"github.com/finwarman/protohackers/src/lib/limiter"
+	"github.com/finwarman/protohackers/src/lib/server"
+)
 
 // prefix for client log messages
-const C_PREFIX = ColourYellow + "[client]" + ColourReset + " "
+const C_PREFIX = "[client] "
+
+// startTestServer starts the server on a free port, returning the address
+// to connect to, and a func to stop the server (also called on cleanup)
+func startTestServer(t *testing.T) (string, func()) {
+	return startTestServerWith(t, server.Settings{})
+}
+
+// startTestServerWith starts the server with the given settings (timeouts,
+// limits, ...), see startTestServer
+func startTestServerWith(t *testing.T, settings server.Settings) (string, func()) {
+	srv, err := NewServer(0, settings)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		_ = srv.Serve(context.Background())
+		close(stopped)
+	}()
+
+	stop := func() {
+		srv.Close()
+		<-stopped
+	}
+	t.Cleanup(stop)
 
-var TEST_CONNECT_STR = fmt.Sprintf("localhost:%d", TEST_TCP_PORT)
+	return srv.Addr().String(), stop
+}
 
 func TestEchoServer(t *testing.T) {
-	go StartServer(TEST_TCP_PORT)      // Start the server in a goroutine
-	time.Sleep(time.Millisecond * 500) // (Wait for the server to start)
+	addr, _ := startTestServer(t)
 
-	go StartNewClient(t, 1)
+	client1 := StartNewClient(t, addr, 1)
+	client2 := StartNewClient(t, addr, 2)
 
-	time.Sleep(time.Millisecond * 50)
+	// First client is told about the second joining
+	expectMessage(t, client1, "* username2 has entered the room")
 
-	go StartNewClient(t, 2)
+	// Send a message from the second client, received by the first
+	message := "this is my message " + fmt.Sprintf("%d", 2)
+	if _, err := client2.conn.Write([]byte(message + "\n")); err != nil {
+		t.Fatalf(C_PREFIX+"failed to send bytes: %v", err)
+	}
+	expectMessage(t, client1, "[username2] "+message)
+
+	// Leaving is broadcast to remaining clients
+	client2.conn.Close()
+	expectMessage(t, client1, "* username2 has left the room")
+}
 
-	// Time to allow output to flush
-	time.Sleep(time.Millisecond * 500)
+// testClient is a connected (and joined) chat client
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
 }
 
-func StartNewClient(t *testing.T, id int) {
+// StartNewClient connects to the server and joins with username{id}
+func StartNewClient(t *testing.T, addr string, id int) *testClient {
 	// Connect to the server
-	conn, err := net.Dial("tcp", TEST_CONNECT_STR)
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		t.Fatalf(C_PREFIX+"failed to connect to server: %v", err)
 	}
-	defer conn.Close()
+	t.Cleanup(func() { conn.Close() })
 
 	// Buffer for storing received data
-	reader := bufio.NewReader(conn)
+	client := &testClient{conn: conn, reader: bufio.NewReader(conn)}
 
 	// Await username message
-	msg, err := reader.ReadString('\n')
+	msg := readMessage(t, client)
+	fmt.Printf(C_PREFIX+"received: '%s'\n", msg)
+
+	// Send username
+	username := "username" + fmt.Sprintf("%d", id)
+	if _, err := conn.Write([]byte(username + "\n")); err != nil {
+		t.Fatalf(C_PREFIX+"failed to send bytes: %v", err)
+	}
+
+	// Await room contents
+	msg = readMessage(t, client)
+	if !strings.HasPrefix(msg, "* The room contains:") {
+		t.Fatalf(C_PREFIX+"expected room contents, got '%s'", msg)
+	}
+
+	return client
+}
+
+// readMessage reads the next message sent to the client
+func readMessage(t *testing.T, client *testClient) string {
+	t.Helper()
+
+	_ = client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := client.reader.ReadString('\n')
 	if err != nil {
+		t.Fatalf(C_PREFIX+"read error: %v", err)
+	}
+	return strings.TrimSuffix(msg, "\n")
+}
+
+// expectMessage fails the test unless the next message matches
+func expectMessage(t *testing.T, client *testClient, expected string) {
+	t.Helper()
+
+	if msg := readMessage(t, client); msg != expected {
+		t.Fatalf(C_PREFIX+"expected '%s', got '%s'", expected, msg)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	addr, stop := startTestServer(t)
+
+	// Join two clients
+	alice := StartNewClient(t, addr, 1)
+	bob := StartNewClient(t, addr, 2)
+
+	// Read alice's '* username2 has entered the room'
+	expectMessage(t, alice, "* username2 has entered the room")
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	// Each client is told about the shutdown before being disconnected
+	for _, client := range []*testClient{alice, bob} {
+		expectMessage(t, client, SHUTDOWN_MSG)
+
+		// (Discard any leave messages from other clients)
+		var err error
+		for {
+			var msg string
+			msg, err = client.reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if !strings.HasSuffix(msg, "has left the room"+MSG_TERM) {
+				t.Fatalf(C_PREFIX+"unexpected message after shutdown: '%s'", msg)
+			}
+		}
 		if err != io.EOF {
-			fmt.Println(C_PREFIX+"read error:", err.Error())
+			t.Fatalf(C_PREFIX+"expected EOF after shutdown, got %v", err)
 		}
+		client.conn.Close()
 	}
-	msg = strings.TrimSuffix(msg, "\n")
 
-	fmt.Printf(C_PREFIX+"received: '%s'\n", msg)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("server did not stop after shutdown")
+	}
 
-	// Delay
-	time.Sleep(time.Millisecond * 100)
+	// No client handlers or message processing goroutines left behind
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked goroutines: have %d, expected %d",
+				runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
 
-	// Send username
-	username := "username" + fmt.Sprintf("%d", id)
-	if _, err := conn.Write([]byte(username + "\n")); err != nil {
-		t.Fatalf(C_PREFIX+"failed to send bytes: %v", err)
+func TestIdleTimeout(t *testing.T) {
+	settings := server.Settings{Timeouts: server.Timeouts{Idle: 200 * time.Millisecond}}
+	addr, _ := startTestServerWith(t, settings)
+
+	alice := StartNewClient(t, addr, 1)
+
+	// (Join a little later, so alice is the first to go idle)
+	time.Sleep(50 * time.Millisecond)
+	bob := StartNewClient(t, addr, 2)
+	expectMessage(t, alice, "* username2 has entered the room")
+
+	// Idle clients are disconnected, and their leaving is broadcast
+	expectMessage(t, bob, "* username1 has left the room")
+
+	_ = alice.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if msg, err := alice.reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf(C_PREFIX+"expected EOF after idle timeout, got '%s' (%v)", msg, err)
 	}
+}
+
+func TestOversizeMessage(t *testing.T) {
+	addr, _ := startTestServer(t)
 
-	// Delay
-	time.Sleep(time.Millisecond * 500)
+	alice := StartNewClient(t, addr, 1)
+	bob := StartNewClient(t, addr, 2)
+	expectMessage(t, alice, "* username2 has entered the room")
 
-	// Send a message
-	message := "this is my message " + fmt.Sprintf("%d", id)
-	if _, err := conn.Write([]byte(message + "\n")); err != nil {
+	// Oversize messages are truncated, then the next message is sent as normal
+	long := strings.Repeat("x", MAX_LINE_LENGTH+100)
+	if _, err := bob.conn.Write([]byte(long + "\nshort\n")); err != nil {
 		t.Fatalf(C_PREFIX+"failed to send bytes: %v", err)
 	}
+	expectMessage(t, alice, "[username2] "+long[:MAX_LINE_LENGTH])
+	expectMessage(t, alice, "[username2] short")
 }
 
-// TODO - simulate client message processing loop (recieve/send)
+func TestRejectedClient(t *testing.T) {
+	settings := server.Settings{Limits: limiter.Config{MaxTotal: 1}}
+	addr, _ := startTestServerWith(t, settings)
+
+	StartNewClient(t, addr, 1)
+
+	// The room is full, so the next client is told why and disconnected
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(C_PREFIX+"failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	client := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	expectMessage(t, client, REJECT_MSG_PREFIX+limiter.ErrTooManyConnections.Error())
+	if msg, err := client.reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf(C_PREFIX+"expected EOF after rejection, got '%s' (%v)", msg, err)
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	broadcaster := NewBroadcaster()
+	slow := NewClient(1, logger) // (never processing its messages)
+	_, _ = broadcaster.Subscribe(slow)
+
+	// Broadcasts don't wait for a client that isn't keeping up
+	broadcasted := make(chan struct{})
+	go func() {
+		for i := 0; i < MAX_QUEUED_MESSAGES+10; i++ {
+			_, _ = broadcaster.Broadcast(Message{data: "hello"}, nil)
+		}
+		close(broadcasted)
+	}()
+	select {
+	case <-broadcasted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected broadcasts not to block on a slow client")
+	}
+
+	// Once its queue overflows, it's disconnected
+	serverSide, client := net.Pipe()
+	defer client.Close()
+	go slow.ProcessMessages(serverSide)
+
+	reader := bufio.NewReader(client)
+	for i := 0; ; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			if i > MAX_QUEUED_MESSAGES {
+				t.Fatalf("Expected at most %d messages before disconnecting, got %d", MAX_QUEUED_MESSAGES, i)
+			}
+			break
+		}
+	}
+
+	_, _ = broadcaster.Unsubscribe(slow)
+	slow.Stop()
+}
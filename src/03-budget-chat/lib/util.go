@@ -6,25 +6,6 @@ import (
 	"unicode"
 )
 
-//
-// === CONSTANTS === //
-//
-
-// Colours for colourising log messages
-const (
-	ColourReset  = "\033[0m"
-	ColourRed    = "\033[31m"
-	ColourGreen  = "\033[32m"
-	ColourYellow = "\033[33m"
-	ColourBlue   = "\033[34m"
-	ColourPurple = "\033[35m"
-	ColourCyan   = "\033[36m"
-	ColourWhite  = "\033[37m"
-)
-
-// Prefix for server log messages
-const S_PREFIX = ColourCyan + "[server]" + ColourReset + " "
-
 //
 // === STRUCTS === //
 //
@@ -69,8 +50,3 @@ func IsValidUsername(username string) bool {
 func NewIDGenerator() *IDGenerator {
 	return &IDGenerator{}
 }
-
-// Colourise returns a colourised string
-func Colourise(txt string, colourCode string) string {
-	return colourCode + txt + ColourReset
-}
@@ -1,4 +1,4 @@
 # Build for centos8
-GOOS=linux GOARCH=amd64 go build -o 04-udp-db
+GOOS=linux GOARCH=amd64 go build -o 04-udp-db ./cmd
 # Copy to remote
 scp 04-udp-db maughan:~
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+
+	unusualdatabase "github.com/finwarman/protohackers/src/04-unusual-database"
+	"github.com/finwarman/protohackers/src/lib/limiter"
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/metrics"
+	"github.com/finwarman/protohackers/src/lib/server"
+)
+
+const UDP_PORT = unusualdatabase.DEFAULT_UDP_PORT
+
+func main() {
+	logOpts := logging.RegisterFlags(flag.CommandLine)
+	metricsAddr := metrics.RegisterFlags(flag.CommandLine)
+	limits := limiter.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	logging.Setup(*logOpts)
+
+	// Serve until interrupted (SIGINT/SIGTERM)
+	ctx, stop := server.NotifyContext(context.Background())
+	defer stop()
+
+	// Serve metrics over HTTP, if enabled (-metrics-addr)
+	if addr, err := metrics.Start(ctx, *metricsAddr); err != nil {
+		slog.Error("metrics failed", "error", err)
+		os.Exit(1)
+	} else if addr != nil {
+		slog.Info("serving metrics", "addr", "http://"+addr.String()+metrics.METRICS_PATH)
+	}
+
+	if err := unusualdatabase.StartServer(ctx, UDP_PORT, *limits); err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+}
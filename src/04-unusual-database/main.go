@@ -1,12 +1,18 @@
-package main
+package unusualdatabase
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/limiter"
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/metrics"
+	"github.com/finwarman/protohackers/src/lib/server"
 )
 
 // =================================
@@ -30,67 +36,129 @@ import (
 // === CONSTANTS === //
 //
 
-// Prefix for colourised server log messages
-const (
-	ColourReset = "\033[0m"
-	ColourRed   = "\033[31m"
-	ColourCyan  = "\033[36m"
-)
-const S_PREFIX = ColourCyan + "[server]" + ColourReset + " "
-const S_ERROR = ColourRed + "[server]" + ColourReset + " "
+// Problem name, for logs and metrics
+const PROBLEM = "unusual-database"
 
-const UDP_PORT = 25565
+// Logger for this problem
+var logger = logging.Named(PROBLEM)
+
+// Default udp port for server
+const DEFAULT_UDP_PORT = 25565
 
 const MAX_REQ_BYTES = 1000
 const MAX_RES_BYTES = 1000
 
 const VERSION = "FunkyDatabase@v1.0.0"
 
-// key-balue store with a mutex for safe concurrent access
-var DATABASE = make(map[string]string)
-var DB_MUTEX sync.RWMutex
+// Packets handled, by kind: "insert", "retrieve" or "denied" (version updates)
+var packetsTotal = metrics.NewCounter("protohackers_unusualdb_packets_total",
+	"Requests handled, by kind", "kind")
+
+//
+// === STRUCTS === //
+//
+
+// Server is a key-value store, served over UDP
+type Server struct {
+	conn    net.PacketConn
+	limiter *limiter.Limiter // per-IP packet rate limit
+
+	// key-value store with a mutex for safe concurrent access
+	database map[string]string
+	dbMutex  sync.RWMutex
+}
 
 //
 // === METHODS === //
 //
 
-func main() {
-	StartServer(UDP_PORT)
+// StartServer runs the server on the given port, until the context is cancelled
+func StartServer(ctx context.Context, port int, limits limiter.Config) error {
+	srv, err := NewServer(port, limits)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ctx)
 }
 
-func StartServer(port int) {
+// NewServer creates a database server listening on the given UDP port
+// (0 picks a free port, see Addr), limiting packets from each IP
+func NewServer(port int, limits limiter.Config) (*Server, error) {
 	addr := fmt.Sprintf("0.0.0.0:%d", port)
 
 	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
-		fmt.Printf(S_PREFIX+"listen error: on UDP port %d: %v\n", port, err)
-		os.Exit(1)
+		return nil, fmt.Errorf("listen error: on UDP port %d: %w", port, err)
 	}
-	defer conn.Close()
 
-	fmt.Printf("%sUDP: listening on port %d\n", S_PREFIX, port)
+	logger.Info("listening", "protocol", "udp", "addr", conn.LocalAddr().String())
 
-	buffer := make([]byte, MAX_REQ_BYTES)
+	s := &Server{
+		conn:     conn,
+		limiter:  limiter.New(PROBLEM, limits),
+		database: make(map[string]string),
+	}
+	s.database["version"] = VERSION
 
-	DATABASE["version"] = VERSION
+	return s, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// Serve handles incoming packets until the context is cancelled
+// (or Close is called)
+func (s *Server) Serve(ctx context.Context) error {
+	defer s.conn.Close()
+
+	// Stop blocking in ReadFrom once the context is cancelled
+	// (Packets are handled synchronously, so there's nothing to drain)
+	stop := context.AfterFunc(ctx, func() { s.conn.Close() })
+	defer stop()
+
+	buffer := make([]byte, MAX_REQ_BYTES)
 
 	// Handle incoming packets
 	for {
-		n, remoteAddr, err := conn.ReadFrom(buffer)
+		n, remoteAddr, err := s.conn.ReadFrom(buffer)
 		if err != nil {
-			fmt.Println(S_PREFIX+"read error: ", err.Error())
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				logger.Info("shutting down")
+				return nil
+			}
+			logger.Warn("read error", "error", err)
+			continue
+		}
+
+		server.BytesReceived.Add(float64(n), PROBLEM)
+
+		// Drop packets over the rate limit, without replying
+		// (UDP source addresses can be spoofed, so replies could be abused)
+		if err := s.limiter.Allow(remoteAddr); err != nil {
+			logger.Debug("dropped packet", "remote_addr", remoteAddr.String(), "reason", err)
 			continue
 		}
 
 		// Process the received packet
-		handlePacket(conn, remoteAddr, buffer[:n])
+		start := time.Now()
+		s.handlePacket(remoteAddr, buffer[:n])
+		server.RequestDuration.Since(start, PROBLEM)
 	}
 }
 
-func handlePacket(conn net.PacketConn, addr net.Addr, data []byte) {
+func (s *Server) handlePacket(addr net.Addr, data []byte) {
 	input := string(data) // NOTE: don't remove newlines from datagram!
-	fmt.Printf(S_PREFIX+"received from %s: %s\n",
-		addr.String(), strconv.Quote(input))
+
+	log := logger.With("remote_addr", addr.String())
+	log.Debug("received", "data", input)
 
 	switch {
 	case strings.Contains(input, "="):
@@ -102,35 +170,38 @@ func handlePacket(conn net.PacketConn, addr net.Addr, data []byte) {
 
 			// Prevent modification of the 'version' key
 			if key == "version" {
-				fmt.Println(S_PREFIX + "[INSERT] Update to 'version' DENIED")
+				log.Info("[INSERT] update to 'version' DENIED")
+				packetsTotal.Inc("denied")
 				return
 			}
 
-			fmt.Printf(S_PREFIX+"[INSERT]: Set key %s to value %s\n",
-				strconv.Quote(key), strconv.Quote(value))
+			log.Debug("[INSERT] set key", "key", key, "value", value)
+			packetsTotal.Inc("insert")
 
-			DB_MUTEX.Lock()
-			defer DB_MUTEX.Unlock()
-			DATABASE[key] = value
+			s.dbMutex.Lock()
+			defer s.dbMutex.Unlock()
+			s.database[key] = value
 		}
 	default:
 		// RETRIEVE
 		// This also handles empty datagrams, returning '='
 		key := input
-		value, exists := DATABASE[key]
+		s.dbMutex.RLock()
+		value, exists := s.database[key]
+		s.dbMutex.RUnlock()
 		if !exists {
 			value = ""
 		}
 
-		fmt.Printf(S_PREFIX+"[RETRIEVE]: key %s has value %s\n",
-			strconv.Quote(key), strconv.Quote(value))
+		log.Debug("[RETRIEVE] got key", "key", key, "value", value)
+		packetsTotal.Inc("retrieve")
 
 		res := fmt.Sprintf("%s=%s", key, value)
-		sendResponse(conn, addr, res)
+		s.sendResponse(addr, res)
 	}
 }
 
-func sendResponse(conn net.PacketConn, addr net.Addr, res string) {
+func (s *Server) sendResponse(addr net.Addr, res string) {
 	data := []byte(res)
 
 	// Truncate reposnse before sending
@@ -138,8 +209,9 @@ func sendResponse(conn net.PacketConn, addr net.Addr, res string) {
 		data = data[:MAX_RES_BYTES]
 	}
 
-	_, err := conn.WriteTo(data, addr)
+	n, err := s.conn.WriteTo(data, addr)
+	server.BytesSent.Add(float64(n), PROBLEM)
 	if err != nil {
-		fmt.Printf("Couldn't send response %v", err)
+		logger.Warn("couldn't send response", "remote_addr", addr.String(), "error", err)
 	}
 }
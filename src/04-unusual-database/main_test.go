@@ -1,21 +1,26 @@
-package main
+package unusualdatabase
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
 	"time"
-)
-
-const TEST_UDP_PORT = 44444
 
-var TEST_CONNECT_STR = fmt.Sprintf("localhost:%d", TEST_UDP_PORT)
+	"github.com/finwarman/protohackers/src/lib/limiter"
+)
 
 func TestEchoServer(t *testing.T) {
-	go StartServer(TEST_UDP_PORT)      // Start the server in a goroutine
-	time.Sleep(time.Millisecond * 500) // Wait for the server to start
+	srv, err := NewServer(0, limiter.Config{})
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	go srv.Serve(context.Background())
+	defer srv.Close()
 
-	conn, err := net.Dial("udp", TEST_CONNECT_STR)
+	// Server listens on all interfaces, connect over loopback
+	port := srv.Addr().(*net.UDPAddr).Port
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
@@ -158,9 +163,42 @@ func TestEchoServer(t *testing.T) {
 	if response != message {
 		t.Fatalf("Expected response '%s', got '%s'", message, response)
 	}
+}
+
+func TestRateLimit(t *testing.T) {
+	before := limiter.Rejected.Value(PROBLEM, "rate") // (shared by every run)
+	srv, err := NewServer(0, limiter.Config{Rate: 0.001, Burst: 3})
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	go srv.Serve(context.Background())
+	defer srv.Close()
+
+	port := srv.Addr().(*net.UDPAddr).Port
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// Only the first 3 packets (the burst) are handled
+	for i := 0; i < 4; i++ {
+		_, _ = conn.Write([]byte("version"))
+	}
 
-	// ===================================
+	responseBytes := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(responseBytes); err != nil {
+			t.Fatalf("Expected response %d within the burst, got %v", i, err)
+		}
+	}
 
-	// Time to allow output to flush
-	time.Sleep(time.Millisecond * 500)
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(responseBytes); err == nil {
+		t.Fatalf("Expected packet over the limit to be dropped, got '%s'", responseBytes[:n])
+	}
+	if rejected := limiter.Rejected.Value(PROBLEM, "rate") - before; rejected != 1 {
+		t.Fatalf("Expected 1 rejection counted, got %v", rejected)
+	}
 }
@@ -1,107 +1,220 @@
-package main
+package mobinthemiddle
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"regexp"
-	"strconv"
 	"strings"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/lines"
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/metrics"
+	"github.com/finwarman/protohackers/src/lib/proxyproto"
+	"github.com/finwarman/protohackers/src/lib/server"
+	"github.com/finwarman/protohackers/src/lib/tlsutil"
 )
 
-const TCP_PORT = 25565
+// Default tcp port for server
+const DEFAULT_TCP_PORT = 25565
 const UPSTREAM_HOST = "chat.protohackers.com"
 const UPSTREAM_PORT = 16963
 
-func main() {
-	upstream := fmt.Sprintf("%s:%d", UPSTREAM_HOST, UPSTREAM_PORT)
-	StartServer(TCP_PORT, upstream)
+// Default upstream chat server to forward to
+var DEFAULT_UPSTREAM = fmt.Sprintf("%s:%d", UPSTREAM_HOST, UPSTREAM_PORT)
+
+// How long to wait to connect to the upstream server
+const DIAL_TIMEOUT = 10 * time.Second
+
+// Longest message forwarded (either way), see OVERSIZE_POLICY
+const MAX_LINE_LENGTH = lines.DEFAULT_MAX_LENGTH
+
+// Oversize messages drop the connection, rather than forwarding a mangled message
+const OVERSIZE_POLICY = lines.DISCONNECT
+
+// Problem name, for logs and metrics
+const PROBLEM = "mob-in-the-middle"
+
+// Logger for this problem
+var logger = logging.Named(PROBLEM)
+
+// Upstream is the chat server each client is forwarded to
+type Upstream struct {
+	Addr          string      // host:port
+	TLS           *tls.Config // Dial with TLS, nil for plain TCP
+	ProxyProtocol int         // Send a PROXY protocol header (version 1 or 2), 0 for none
 }
 
-func StartServer(port int, upstream string) {
-	fmt.Printf("will forward to upstream: %s\n", upstream)
+// Dial opens a new connection to the upstream server, for a client
+// (whose addresses are sent in the PROXY protocol header, if enabled)
+func (u Upstream) Dial(client net.Conn) (net.Conn, error) {
+	var header []byte
+	if u.ProxyProtocol != 0 {
+		var err error
+		header, err = proxyproto.NewHeader(client.RemoteAddr(), client.LocalAddr()).Format(u.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", u.Addr)
 	if err != nil {
-		fmt.Println("listen: ", err.Error())
-		os.Exit(1)
+		return nil, err
 	}
-	defer ln.Close()
 
-	fmt.Printf("listening on port %d\n", port)
+	// (The header comes first, before any TLS handshake)
+	if header != nil {
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println("accept: ", err.Error())
-			os.Exit(1)
+	if u.TLS != nil {
+		config := u.TLS
+		if config.ServerName == "" {
+			// (The server name is taken from Addr, unless set in the config)
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(u.Addr)
 		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
 
-		fmt.Println("connection from ", conn.RemoteAddr())
+func (u Upstream) String() string {
+	addr := u.Addr
+	if u.TLS != nil {
+		addr = "tls://" + addr
+	}
+	if u.ProxyProtocol != 0 {
+		addr += fmt.Sprintf(" (PROXY protocol v%d)", u.ProxyProtocol)
+	}
+	return addr
+}
+
+// RegisterFlags adds -upstream, -upstream-tls, -upstream-ca and
+// -upstream-proxy-protocol flags to the flag set, returning a func to get
+// the Upstream they describe (after parsing)
+func RegisterFlags(fs *flag.FlagSet) func() (Upstream, error) {
+	addr := fs.String("upstream", DEFAULT_UPSTREAM, "upstream chat server for mob-in-the-middle")
+	useTLS := fs.Bool("upstream-tls", false, "connect to the upstream chat server with TLS")
+	caFile := fs.String("upstream-ca", "", "trust this PEM CA `file` for -upstream-tls (default: system roots)")
+	proxyVersion := fs.Int("upstream-proxy-protocol", 0,
+		"send each client's address upstream in a PROXY protocol header of this `version` (1 or 2, 0 for none)")
+
+	return func() (Upstream, error) {
+		if *proxyVersion < 0 || *proxyVersion > 2 {
+			return Upstream{}, fmt.Errorf("unsupported PROXY protocol version %d", *proxyVersion)
+		}
+		upstream := Upstream{Addr: *addr, ProxyProtocol: *proxyVersion}
+		if *useTLS || *caFile != "" {
+			config, err := tlsutil.ClientConfig(*caFile)
+			if err != nil {
+				return Upstream{}, err
+			}
+			upstream.TLS = config
+		}
+		return upstream, nil
+	}
+}
 
-		go HandleConnection(conn, upstream)
+// StartServer runs the proxy on the given port, until the context is cancelled
+func StartServer(ctx context.Context, port int, upstream Upstream, settings server.Settings) error {
+	srv, err := NewServer(port, upstream, settings)
+	if err != nil {
+		return err
 	}
+
+	return srv.Serve(ctx)
+}
+
+// NewServer creates a proxy listening on the given port (0 picks a free
+// port, see Addr), forwarding each client to the upstream chat server
+func NewServer(port int, upstream Upstream, settings server.Settings) (*server.Server, error) {
+	logger.Info("will forward to upstream", "upstream", upstream.String())
+
+	handler := server.HandlerFunc(func(conn net.Conn) {
+		HandleConnection(conn, upstream)
+	})
+	return server.Listen(server.Config{Name: PROBLEM, Port: port, Logger: logger, Settings: settings}, handler)
 }
 
-func HandleConnection(clientConn net.Conn, upstream string) {
+func HandleConnection(clientConn net.Conn, upstream Upstream) {
 	defer clientConn.Close()
 
+	log := logging.ForConn(logger, clientConn)
+
 	// Connect to upstream server (connection per mitm'd client)
-	upstreamConn, err := net.Dial("tcp", upstream)
+	upstreamConn, err := upstream.Dial(clientConn)
 	if err != nil {
-		fmt.Println("dial upstream: ", err.Error())
+		log.Error("dial upstream", "upstream", upstream.String(), "error", err)
 		return
 	}
 	defer upstreamConn.Close()
 
 	// Channel to communicate closure of either connection
 	// (Disconnect both ends on a closed client)
-	closed := make(chan bool, 1)
+	// Buffered for both forwarders, so neither blocks once we've returned
+	closed := make(chan bool, 2)
 
 	// Async handlers for client and upstream, with message rewriting:
 
 	// Forward messages from client to upstream
+	// (Partial messages, with no newline before disconnecting, aren't sent)
 	go func() {
-		reader := bufio.NewReader(clientConn)
+		reader := lines.NewReader(clientConn, MAX_LINE_LENGTH, OVERSIZE_POLICY)
 		for {
-			message, err := reader.ReadString('\n')
+			message, err := reader.ReadLine()
 			if err != nil {
-				fmt.Println("read from client: ", err.Error())
+				server.LogReadError(log, err)
 				break
 			}
-			message = message[:len(message)-1]
 
-			fmt.Println("Received from client:", strconv.Quote(message)) // Print actual message content
-			rewrittenMessage := RewriteCoins(message)                    // Rewrite the message
+			log.Debug("received from client", "message", message)
+			start := time.Now()
+			rewrittenMessage := RewriteCoins(message) // Rewrite the message
 			_, err = io.WriteString(upstreamConn, rewrittenMessage+"\n")
 			if err != nil {
-				fmt.Println("write to upstream: ", err.Error())
+				log.Warn("write to upstream", "error", err)
 				break
 			}
+			server.RequestDuration.Since(start, PROBLEM)
 		}
 		closed <- true // Signal that client connection closed
 	}()
 
 	// Forward messages from upstream to client
 	go func() {
-		reader := bufio.NewReader(upstreamConn)
+		reader := lines.NewReader(upstreamConn, MAX_LINE_LENGTH, OVERSIZE_POLICY)
 		for {
-			message, err := reader.ReadString('\n')
+			message, err := reader.ReadLine()
 			if err != nil {
-				fmt.Println("read from upstream: ", err.Error())
+				log.Info("read from upstream", "error", err)
 				break
 			}
-			message = message[:len(message)-1]
 
-			fmt.Println("Received from upstream:", strconv.Quote(message)) // Print actual message content
-			rewrittenMessage := RewriteCoins(message)                      // Rewrite the message
+			log.Debug("received from upstream", "message", message)
+			start := time.Now()
+			rewrittenMessage := RewriteCoins(message) // Rewrite the message
 			_, err = io.WriteString(clientConn, rewrittenMessage+"\n")
 			if err != nil {
-				fmt.Println("write to client: ", err.Error())
+				log.Warn("write to client", "error", err)
 				break
 			}
+			server.RequestDuration.Since(start, PROBLEM)
 		}
 		closed <- true // Signal that upstream connection closed
 	}()
@@ -117,18 +230,22 @@ const DUMMY = "_YWHMfk9JZe0LM0g1ZauHuiSxhI"                // starts with '_' no
 var BOGUSCOIN_REGEX = regexp.MustCompile(`(^|[ ])7[0-9a-zA-Z]{25,34}([ ]|$)`)
 var REPLACEMENT_REGEX = regexp.MustCompile(`(^ ` + DUMMY + `)|(` + DUMMY + ` $)`)
 
+// Boguscoin addresses rewritten, in either direction
+var coinsRewritten = metrics.NewCounter("protohackers_mob_coins_rewritten_total",
+	"Boguscoin addresses rewritten to Tony's address")
+
 func RewriteCoins(message string) string {
 	if BOGUSCOIN_REGEX.Match([]byte(message)) {
-		fmt.Println("[REWRITE (matched coin regex)")
-		fmt.Println(" - Original message:", strconv.Quote(message))
+		logger.Debug("rewrite: matched coin regex", "original", message)
 		// Hack to ensure consecutive replacements are achieved
 		replaced := message
 		for i := 0; i < len(message)/26; i++ {
 			replaced = BOGUSCOIN_REGEX.ReplaceAllString(replaced, " "+DUMMY+" ")
 		}
 		replaced = REPLACEMENT_REGEX.ReplaceAllString(replaced, DUMMY)
+		coinsRewritten.Add(float64(strings.Count(replaced, DUMMY)))
 		replaced = strings.ReplaceAll(replaced, DUMMY, TARGET_BOGUS_ADDRESS)
-		fmt.Println(" - Replaced message:", strconv.Quote(string(replaced)))
+		logger.Debug("rewrite: replaced coins", "replaced", replaced)
 		return string(replaced)
 	}
 	return message
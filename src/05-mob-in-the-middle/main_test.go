@@ -1,6 +1,20 @@
-package main
+package mobinthemiddle
 
-import "testing"
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/proxyproto"
+	"github.com/finwarman/protohackers/src/lib/server"
+	"github.com/finwarman/protohackers/src/lib/tlsutil"
+)
 
 func TestRewriting(t *testing.T) {
 
@@ -12,3 +26,192 @@ func TestRewriting(t *testing.T) {
 		t.Fatalf("Fail:\nExpected:\n%s\n\nGot:\n%s\n", expected, result)
 	}
 }
+
+// startTestProxy starts a fake upstream (using TLS if serverTLS is set),
+// and the proxy in front of it (with the upstream's other settings),
+// returning the proxy address and the upstream's accepted connections
+// (for the test to close)
+func startTestProxy(t *testing.T, serverTLS *tls.Config, settings Upstream) (string, chan net.Conn) {
+	upstream, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to start upstream: %v", err)
+	}
+	if serverTLS != nil {
+		upstream = tls.NewListener(upstream, serverTLS)
+	}
+	t.Cleanup(func() { upstream.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			// (Handshake now, so an untrusted proxy isn't left waiting)
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					continue
+				}
+			}
+			accepted <- conn
+		}
+	}()
+
+	settings.Addr = upstream.Addr().String()
+	srv, err := NewServer(0, settings, server.Settings{})
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	go srv.Serve(context.Background())
+	t.Cleanup(func() { srv.Close() })
+
+	return srv.Addr().String(), accepted
+}
+
+func TestUnterminatedMessage(t *testing.T) {
+	addr, accepted := startTestProxy(t, nil, Upstream{})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+
+	// A complete message, then a partial one before disconnecting
+	_, _ = io.WriteString(client, "Send to 7W01NPV8BW4xZnyLOBLlN9eQsNwAekbkI\nSend to 7W01NPV8")
+	client.Close()
+
+	upstream := <-accepted
+	defer upstream.Close()
+	_ = upstream.SetReadDeadline(time.Now().Add(time.Second))
+
+	received, err := io.ReadAll(upstream)
+	if err != nil {
+		t.Fatalf("Failed to read from proxy: %v", err)
+	}
+	expected := "Send to " + TARGET_BOGUS_ADDRESS + "\n"
+	if string(received) != expected {
+		t.Fatalf("Expected only the complete message %q, got %q", expected, received)
+	}
+}
+
+func TestOversizeMessage(t *testing.T) {
+	addr, accepted := startTestProxy(t, nil, Upstream{})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer client.Close()
+
+	upstream := <-accepted
+	defer upstream.Close()
+
+	// Oversize messages drop the client (and nothing is forwarded)
+	go io.WriteString(client, strings.Repeat("x", MAX_LINE_LENGTH+1)+"\n")
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	// (Either EOF, or reset as the rest of the message was never read)
+	if response, err := bufio.NewReader(client).ReadString('\n'); err == nil || os.IsTimeout(err) {
+		t.Fatalf("Expected client to be disconnected, got %q (%v)", response, err)
+	}
+
+	_ = upstream.SetReadDeadline(time.Now().Add(time.Second))
+	if received, _ := io.ReadAll(upstream); len(received) != 0 {
+		t.Fatalf("Expected nothing forwarded upstream, got %d bytes", len(received))
+	}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	ca, err := tlsutil.NewCA("test CA")
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, err := ca.Issue("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+
+	addr, accepted := startTestProxy(t,
+		&tls.Config{Certificates: []tls.Certificate{cert}},
+		Upstream{TLS: &tls.Config{RootCAs: ca.CertPool(), ServerName: "localhost"}})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer client.Close()
+
+	upstream := <-accepted
+	defer upstream.Close()
+
+	// Messages are rewritten over TLS, both ways
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	_ = upstream.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, _ = io.WriteString(client, "Send to 7W01NPV8BW4xZnyLOBLlN9eQsNwAekbkI\n")
+	message, err := bufio.NewReader(upstream).ReadString('\n')
+	if err != nil || message != "Send to "+TARGET_BOGUS_ADDRESS+"\n" {
+		t.Fatalf("Expected rewritten message upstream, got %q (%v)", message, err)
+	}
+
+	_, _ = io.WriteString(upstream, "Pay 7W01NPV8BW4xZnyLOBLlN9eQsNwAekbkI\n")
+	message, err = bufio.NewReader(client).ReadString('\n')
+	if err != nil || message != "Pay "+TARGET_BOGUS_ADDRESS+"\n" {
+		t.Fatalf("Expected rewritten message from upstream, got %q (%v)", message, err)
+	}
+}
+
+func TestUntrustedUpstream(t *testing.T) {
+	cert, err := tlsutil.SelfSigned("localhost")
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+
+	// The proxy only trusts the system roots, so refuses the self-signed upstream
+	addr, _ := startTestProxy(t,
+		&tls.Config{Certificates: []tls.Certificate{cert}},
+		Upstream{TLS: &tls.Config{ServerName: "localhost"}})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer client.Close()
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if received, err := io.ReadAll(client); err != nil || len(received) != 0 {
+		t.Fatalf("Expected client to be disconnected, got %q (%v)", received, err)
+	}
+}
+
+func TestUpstreamProxyProtocol(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		addr, accepted := startTestProxy(t, nil, Upstream{ProxyProtocol: version})
+
+		client, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		defer client.Close()
+		_, _ = io.WriteString(client, "Hi\n")
+
+		upstream := <-accepted
+		defer upstream.Close()
+		_ = upstream.SetReadDeadline(time.Now().Add(time.Second))
+
+		// The client's address comes first, then its messages
+		reader := bufio.NewReader(upstream)
+		header, err := proxyproto.ReadHeader(reader)
+		if err != nil {
+			t.Fatalf("Failed to read v%d header: %v", version, err)
+		}
+		if header.Version != version || header.Source.String() != client.LocalAddr().String() {
+			t.Fatalf("Expected v%d header from %s, got %+v", version, client.LocalAddr(), header)
+		}
+		if message, err := reader.ReadString('\n'); err != nil || message != "Hi\n" {
+			t.Fatalf("Expected message after the header, got %q (%v)", message, err)
+		}
+	}
+}
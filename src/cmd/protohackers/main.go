@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	budgetchat "github.com/finwarman/protohackers/budgetchat/lib"
+	smoketest "github.com/finwarman/protohackers/src/00-smoke-test"
+	primetime "github.com/finwarman/protohackers/src/01-prime-time"
+	meanstoanend "github.com/finwarman/protohackers/src/02-means-to-an-end"
+	unusualdatabase "github.com/finwarman/protohackers/src/04-unusual-database"
+	mobinthemiddle "github.com/finwarman/protohackers/src/05-mob-in-the-middle"
+	"github.com/finwarman/protohackers/src/lib/logging"
+	"github.com/finwarman/protohackers/src/lib/metrics"
+	"github.com/finwarman/protohackers/src/lib/server"
+)
+
+// ================================
+// == Protohackers: all problems ==
+//
+// Runs any number of the solutions side by side, in a single process,
+// sharing logging (see -log-level, -log-format), metrics (-metrics-addr),
+// connection timeouts (-idle-timeout, -session-timeout, -write-timeout),
+// per-IP limits (-rate-limit, -max-conns-per-ip, ...), TLS (-tls-cert,
+// -tls-key or -tls-self-signed), PROXY protocol headers (-proxy-protocol)
+// and shutdown (SIGINT/SIGTERM stops every server).
+//
+// Usage:
+//
+//	protohackers [-config FILE] [-upstream HOST:PORT] [-metrics-addr HOST:PORT] [problem[=port] ...]
+//
+// Problems are given by number or name (e.g. `1`, `01-prime-time` or
+// `prime-time`), or `all`. Without a port, problem N listens on 25565+N.
+//
+// The config file has one `problem [port]` per line, `#` starts a comment:
+//
+//	smoke-test 10000
+//	unusual-database 10004
+//
+// ================================
+
+// Base port, problem N listens on BASE_PORT+N unless told otherwise
+const BASE_PORT = 25565
+
+// Service is a running server for a single problem
+type Service interface {
+	Addr() net.Addr
+	Serve(ctx context.Context) error
+	Close() error
+}
+
+// Problem describes how to start the server for a solution
+type Problem struct {
+	Number   int
+	Name     string
+	Protocol string // "tcp" or "udp", for display only
+	Start    func(port int) (Service, error)
+}
+
+// Echo server options for smoke-test (see -echo-max-bytes)
+var echoOptions = &smoketest.Options{}
+
+// Request handling options for prime-time (see -prime-workers)
+var primeOptions = &primetime.Options{}
+
+// Asset options for means-to-an-end (see -means-shared)
+var meansOptions = &meanstoanend.Options{}
+
+// Timeouts, limits, TLS and PROXY protocol for every server (see
+// -idle-timeout, -rate-limit, -tls-cert, -proxy-protocol, ...)
+var settings server.Settings
+
+// Upstream chat server for mob-in-the-middle (see -upstream)
+var upstream = mobinthemiddle.Upstream{Addr: mobinthemiddle.DEFAULT_UPSTREAM}
+
+// All available problems, in order
+var PROBLEMS = []Problem{
+	{0, "smoke-test", "tcp", func(port int) (Service, error) {
+		return smoketest.NewServer(port, *echoOptions, settings)
+	}},
+	{1, "prime-time", "tcp", func(port int) (Service, error) {
+		return primetime.NewServer(port, *primeOptions, settings)
+	}},
+	{2, "means-to-an-end", "tcp", func(port int) (Service, error) {
+		return meanstoanend.NewServer(port, *meansOptions, settings)
+	}},
+	{3, "budget-chat", "tcp", func(port int) (Service, error) {
+		return budgetchat.NewServer(port, settings)
+	}},
+	{4, "unusual-database", "udp", func(port int) (Service, error) {
+		return unusualdatabase.NewServer(port, settings.Limits)
+	}},
+	{5, "mob-in-the-middle", "tcp", func(port int) (Service, error) {
+		return mobinthemiddle.NewServer(port, upstream, settings)
+	}},
+}
+
+// Spec is a problem to serve, on a given port
+type Spec struct {
+	Problem Problem
+	Port    int
+}
+
+func main() {
+	configFile := flag.String("config", "", "file listing `problem [port]` per line")
+	list := flag.Bool("list", false, "list available problems and exit")
+	logOpts := logging.RegisterFlags(flag.CommandLine)
+	metricsAddr := metrics.RegisterFlags(flag.CommandLine)
+	serverSettings := server.RegisterFlags(flag.CommandLine)
+	echoOptions = smoketest.RegisterFlags(flag.CommandLine)
+	primeOptions = primetime.RegisterFlags(flag.CommandLine)
+	meansOptions = meanstoanend.RegisterFlags(flag.CommandLine)
+	upstreamFlags := mobinthemiddle.RegisterFlags(flag.CommandLine)
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] [problem[=port] ...]\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	logging.Setup(*logOpts)
+
+	var err error
+	if upstream, err = upstreamFlags(); err != nil {
+		slog.Error("invalid upstream", "error", err)
+		os.Exit(1)
+	}
+	if settings, err = serverSettings(); err != nil {
+		slog.Error("invalid server settings", "error", err)
+		os.Exit(1)
+	}
+
+	if *list {
+		for _, p := range PROBLEMS {
+			fmt.Printf("%02d-%s\t%s\tdefault port %d\n", p.Number, p.Name, p.Protocol, BASE_PORT+p.Number)
+		}
+		return
+	}
+
+	// Gather problems from the config file and command line
+	args := flag.Args()
+	if *configFile != "" {
+		lines, err := readConfig(*configFile)
+		if err != nil {
+			slog.Error("config", "error", err)
+			os.Exit(1)
+		}
+		args = append(lines, args...)
+	}
+
+	specs, err := ParseSpecs(args)
+	if err != nil {
+		slog.Error("invalid problem", "error", err)
+		os.Exit(1)
+	}
+	if len(specs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Serve until interrupted (SIGINT/SIGTERM)
+	ctx, stop := server.NotifyContext(context.Background())
+	defer stop()
+
+	// Serve metrics over HTTP, if enabled (-metrics-addr)
+	if addr, err := metrics.Start(ctx, *metricsAddr); err != nil {
+		slog.Error("metrics failed", "error", err)
+		os.Exit(1)
+	} else if addr != nil {
+		slog.Info("serving metrics", "addr", "http://"+addr.String()+metrics.METRICS_PATH)
+	}
+
+	if err := Run(ctx, specs); err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Run starts every problem in the specs, and serves until the context is
+// cancelled or any one of the servers fails (which stops all the others).
+func Run(ctx context.Context, specs []Spec) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Bind everything first, so a bad port fails fast
+	services := make([]Service, 0, len(specs))
+	for _, spec := range specs {
+		srv, err := spec.Problem.Start(spec.Port)
+		if err != nil {
+			for _, s := range services {
+				s.Close()
+			}
+			return fmt.Errorf("[%s] %w", spec.Problem.Name, err)
+		}
+
+		slog.Info("serving", "problem", spec.Problem.Name,
+			"protocol", spec.Problem.Protocol, "addr", srv.Addr().String())
+		services = append(services, srv)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(services))
+
+	for i, srv := range services {
+		wg.Add(1)
+		go func(name string, srv Service) {
+			defer wg.Done()
+
+			if err := srv.Serve(ctx); err != nil {
+				errs <- fmt.Errorf("[%s] %w", name, err)
+				cancel()
+			}
+			slog.Info("stopped", "problem", name)
+		}(specs[i].Problem.Name, srv)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// Report the first failure
+	return <-errs
+}
+
+// ParseSpecs parses `problem[=port]` arguments (or `all`)
+func ParseSpecs(args []string) ([]Spec, error) {
+	var specs []Spec
+	for _, arg := range args {
+		name, portStr, hasPort := strings.Cut(arg, "=")
+
+		if name == "all" {
+			if hasPort {
+				return nil, fmt.Errorf("%s: `all` can't be given a port", arg)
+			}
+			for _, p := range PROBLEMS {
+				specs = append(specs, Spec{p, BASE_PORT + p.Number})
+			}
+			continue
+		}
+
+		p, ok := FindProblem(name)
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown problem (see -list)", arg)
+		}
+
+		port := BASE_PORT + p.Number
+		if hasPort {
+			var err error
+			port, err = strconv.Atoi(portStr)
+			if err != nil || port < 0 || port > 65535 {
+				return nil, fmt.Errorf("%s: invalid port %q", arg, portStr)
+			}
+		}
+
+		specs = append(specs, Spec{p, port})
+	}
+	return specs, nil
+}
+
+// FindProblem looks up a problem by number (`4`, `04`), name
+// (`unusual-database`) or both (`04-unusual-database`)
+func FindProblem(name string) (Problem, bool) {
+	for _, p := range PROBLEMS {
+		switch name {
+		case strconv.Itoa(p.Number),
+			fmt.Sprintf("%02d", p.Number),
+			p.Name,
+			fmt.Sprintf("%02d-%s", p.Number, p.Name):
+			return p, true
+		}
+	}
+	return Problem{}, false
+}
+
+// readConfig reads `problem [port]` lines from a file, as `problem[=port]`
+func readConfig(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var args []string
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			args = append(args, fields[0])
+		case 2:
+			args = append(args, fields[0]+"="+fields[1])
+		default:
+			return nil, fmt.Errorf("%s:%d: expected `problem [port]`", path, lineNum)
+		}
+	}
+	return args, scanner.Err()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSpecs(t *testing.T) {
+	specs, err := ParseSpecs([]string{"0", "01-prime-time=10001", "unusual-database=0"})
+	if err != nil {
+		t.Fatalf("Failed to parse specs: %v", err)
+	}
+
+	expected := []struct {
+		name string
+		port int
+	}{
+		{"smoke-test", BASE_PORT},
+		{"prime-time", 10001},
+		{"unusual-database", 0},
+	}
+	if len(specs) != len(expected) {
+		t.Fatalf("Expected %d specs, got %d", len(expected), len(specs))
+	}
+	for i, e := range expected {
+		if specs[i].Problem.Name != e.name || specs[i].Port != e.port {
+			t.Fatalf("Expected %s on %d, got %s on %d",
+				e.name, e.port, specs[i].Problem.Name, specs[i].Port)
+		}
+	}
+
+	all, err := ParseSpecs([]string{"all"})
+	if err != nil || len(all) != len(PROBLEMS) {
+		t.Fatalf("Expected all %d problems, got %d (%v)", len(PROBLEMS), len(all), err)
+	}
+
+	for _, bad := range []string{"99", "prime-time=abc", "prime-time=70000", "all=1"} {
+		if _, err := ParseSpecs([]string{bad}); err == nil {
+			t.Fatalf("Expected error parsing '%s'", bad)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "problems.conf")
+	config := "# problem port\nsmoke-test 10000\n\n04 # default port\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	args, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if len(args) != 2 || args[0] != "smoke-test=10000" || args[1] != "04" {
+		t.Fatalf("Unexpected config args: %q", args)
+	}
+}
+
+func TestRunSideBySide(t *testing.T) {
+	specs, err := ParseSpecs([]string{"smoke-test=0", "unusual-database=0"})
+	if err != nil {
+		t.Fatalf("Failed to parse specs: %v", err)
+	}
+
+	// Find the ports used, by wrapping the start funcs
+	addrs := make(chan net.Addr, len(specs))
+	for i := range specs {
+		start := specs[i].Problem.Start
+		specs[i].Problem.Start = func(port int) (Service, error) {
+			srv, err := start(port)
+			if err == nil {
+				addrs <- srv.Addr()
+			}
+			return srv, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, specs)
+	}()
+
+	tcpPort := (<-addrs).(*net.TCPAddr).Port
+	udpPort := (<-addrs).(*net.UDPAddr).Port
+
+	// Smoke test echoes over TCP
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	if err != nil {
+		t.Fatalf("Failed to connect to smoke-test: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "hello\n")
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("Expected echo 'hello', got '%s' (%v)", line, err)
+	}
+
+	// Database answers over UDP
+	udp, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+	if err != nil {
+		t.Fatalf("Failed to connect to unusual-database: %v", err)
+	}
+	defer udp.Close()
+	fmt.Fprint(udp, "version")
+	buf := make([]byte, 1000)
+	_ = udp.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := udp.Read(buf); err != nil || n == 0 {
+		t.Fatalf("Expected version response, got %v", err)
+	}
+
+	// Shutdown stops both servers
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected nil error on shutdown, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Servers did not stop after shutdown")
+	}
+}
@@ -0,0 +1,341 @@
+package dispatch
+
+import (
+	"context"
+	encodingjson "encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+
+	"github.com/finwarman/protohackers/src/lib/json"
+)
+
+// Method dispatch for line-delimited JSON request servers (e.g. prime-time).
+//
+// Each request is a JSON object naming its method, plus parameters:
+//
+//	{"method":"isPrime","number":123}
+//
+// Methods are registered by name, with a schema for their parameters.
+// Requests are parsed with lib/json, then checked against the schema
+// (extra fields are ignored) before the handler is called, so handlers
+// only see parameters of the right types. The handler's response is
+// serialised as JSON (see encoding/json, e.g. struct tags for field names).
+//
+// Anything that goes wrong (unparseable requests, unknown methods, schema
+// violations, handler errors) gets the dispatcher's malformed response.
+//
+// How requests are read can be tightened up (see Options): in strict mode,
+// numbers must be written as JSON defines them, and are only integers if
+// written as one (3.0 and 1e3 aren't), and repeated keys can be rejected.
+
+// Parameter types, as checked against the request
+type Type int
+
+const (
+	INTEGER Type = iota // Integers of any size (including e.g. 5.0), see Params.Integer
+	NUMBER              // Any number, see Params.Integer and Params.Float
+	STRING              // See Params.String
+	BOOLEAN             // See Params.Bool
+)
+
+func (t Type) String() string {
+	switch t {
+	case INTEGER:
+		return "integer"
+	case NUMBER:
+		return "number"
+	case STRING:
+		return "string"
+	case BOOLEAN:
+		return "boolean"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Why a request got the malformed response (handler errors are returned as is)
+var (
+	ErrMalformed     = errors.New("malformed request")
+	ErrUnknownMethod = errors.New("unknown method")
+	ErrInvalidParams = errors.New("invalid parameters")
+)
+
+// What to do about a key repeated in a request (see Options.DuplicateKeys)
+type DuplicatePolicy string
+
+const (
+	DUPLICATES_LAST   DuplicatePolicy = "last"   // The last value wins (as with most JSON parsers)
+	DUPLICATES_FIRST  DuplicatePolicy = "first"  // The first value wins
+	DUPLICATES_REJECT DuplicatePolicy = "reject" // The request is malformed
+)
+
+// ParseDuplicatePolicy parses a policy name, e.g. from a flag
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(name); policy {
+	case DUPLICATES_LAST, DUPLICATES_FIRST, DUPLICATES_REJECT:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown duplicate key policy %q (want last, first or reject)", name)
+}
+
+// Options change how requests are read
+type Options struct {
+	// Numbers must be valid JSON (the parser also accepts e.g. 01 and .5),
+	// and are only integers if written without a fraction or exponent
+	Strict bool
+
+	// What to do about repeated keys, DUPLICATES_LAST if empty
+	DuplicateKeys DuplicatePolicy
+}
+
+// Param describes one of a method's parameters
+type Param struct {
+	Name     string
+	Type     Type
+	Optional bool // Can be left out (or null)
+}
+
+// Handler answers a request with a response to serialise, or an error
+// (which gets the malformed response)
+type Handler func(params Params) (any, error)
+
+// Method is a named request handler, with its parameters' schema
+type Method struct {
+	Name    string
+	Params  []Param
+	Handler Handler
+}
+
+// Dispatcher routes requests to the registered methods
+type Dispatcher struct {
+	methods   map[string]Method
+	malformed []byte
+	options   Options
+}
+
+// New creates a dispatcher, with the response for malformed requests
+func New(malformed []byte) *Dispatcher {
+	return &Dispatcher{methods: make(map[string]Method), malformed: malformed}
+}
+
+// WithOptions returns a dispatcher reading requests with the options, which
+// shares this one's methods
+func (d *Dispatcher) WithOptions(options Options) *Dispatcher {
+	copied := *d
+	copied.options = options
+	return &copied
+}
+
+// Register adds methods to the dispatcher. Registering the same name twice
+// is a programming error, so panics.
+func (d *Dispatcher) Register(methods ...Method) {
+	for _, method := range methods {
+		if _, ok := d.methods[method.Name]; ok {
+			panic(fmt.Sprintf("dispatch: method %s already registered", method.Name))
+		}
+		d.methods[method.Name] = method
+	}
+}
+
+// Methods lists the registered method names, sorted
+func (d *Dispatcher) Methods() []string {
+	names := make([]string, 0, len(d.methods))
+	for name := range d.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether a method is registered
+func (d *Dispatcher) Has(name string) bool {
+	_, ok := d.methods[name]
+	return ok
+}
+
+// Handle answers a request (one line, without the newline), returning the
+// response, and the method requested ("" if it couldn't be read). On any
+// error the response is the malformed one.
+func (d *Dispatcher) Handle(data string, log *slog.Logger) (response []byte, method string, err error) {
+	parsed, err := json.ParseJSON(data)
+	if err != nil {
+		return d.malformed, "", fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+
+	// (Only format the parsed tree if it's going to be logged)
+	if log.Enabled(context.Background(), slog.LevelDebug) {
+		log.Debug("parsed JSON value", "value", parsed.String())
+	}
+
+	if parsed.Object == nil {
+		return d.malformed, "", fmt.Errorf("%w: not an object", ErrMalformed)
+	}
+	request, err := d.fields(parsed.Object)
+	if err != nil {
+		return d.malformed, "", err
+	}
+	method, ok := request["method"].(string)
+	if !ok {
+		return d.malformed, "", fmt.Errorf("%w: `/method` not found or not a string", ErrMalformed)
+	}
+
+	registered, ok := d.methods[method]
+	if !ok {
+		return d.malformed, method, fmt.Errorf("%w: %q", ErrUnknownMethod, method)
+	}
+	params, err := validate(request, registered.Params)
+	if err != nil {
+		return d.malformed, method, err
+	}
+
+	result, err := registered.Handler(params)
+	if err != nil {
+		return d.malformed, method, err
+	}
+	response, err = encodingjson.Marshal(result)
+	if err != nil {
+		return d.malformed, method, fmt.Errorf("couldn't serialise response: %w", err)
+	}
+	return response, method, nil
+}
+
+// fields converts a request's fields to native values (see
+// json.ConvertToNative, numbers are converted by validate), following the
+// options
+func (d *Dispatcher) fields(object *json.JSONObject) (map[string]interface{}, error) {
+	fields := make(map[string]interface{}, len(object.Pairs))
+	for _, pair := range object.Pairs {
+		if _, repeated := fields[pair.Key]; repeated {
+			switch d.options.DuplicateKeys {
+			case DUPLICATES_FIRST:
+				continue
+			case DUPLICATES_REJECT:
+				return nil, fmt.Errorf("%w: repeated key %q", ErrMalformed, pair.Key)
+			}
+		}
+
+		if !d.options.Strict {
+			fields[pair.Key] = json.ConvertToNative(pair.Value)
+			continue
+		}
+		if err := checkNumbers(pair.Value); err != nil {
+			return nil, fmt.Errorf("%w: `/%s`: %w", ErrMalformed, pair.Key, err)
+		}
+		fields[pair.Key] = json.ConvertToNative(pair.Value)
+
+		// Only numbers written as integers are integers, e.g. not 3.0
+		// (valid numbers too large for a float64 round to infinity)
+		if number := pair.Value.Number; number != nil && !number.IsIntegerLiteral() {
+			fields[pair.Key], _ = number.Float64()
+		}
+	}
+	return fields, nil
+}
+
+// checkNumbers returns an error if any number in the value isn't valid JSON
+func checkNumbers(value *json.JSONValue) error {
+	switch {
+	case value.Number != nil && !value.Number.Valid():
+		return fmt.Errorf("invalid number %s", *value.Number)
+	case value.Object != nil:
+		for _, pair := range value.Object.Pairs {
+			if err := checkNumbers(pair.Value); err != nil {
+				return err
+			}
+		}
+	case value.Array != nil:
+		for _, element := range value.Array.Values {
+			if err := checkNumbers(element); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks a request against the schema, returning its parameters
+// (with integers as *big.Int)
+func validate(request map[string]interface{}, schema []Param) (Params, error) {
+	params := make(Params, len(schema))
+	for _, param := range schema {
+		value, ok := request[param.Name]
+		if !ok || value == nil {
+			if param.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("%w: `/%s` not found", ErrInvalidParams, param.Name)
+		}
+
+		// (Numbers are only converted once they're known to be parameters,
+		// see json.ConvertToNative)
+		if number, isNumber := value.(json.Number); isNumber {
+			value = number.Native()
+		}
+		if small, isInt := value.(int); isInt {
+			value = big.NewInt(int64(small))
+		}
+
+		ok = false
+		switch param.Type {
+		case INTEGER:
+			_, ok = value.(*big.Int)
+		case NUMBER:
+			switch value.(type) {
+			case *big.Int, float64:
+				ok = true
+			}
+		case STRING:
+			_, ok = value.(string)
+		case BOOLEAN:
+			_, ok = value.(bool)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: `/%s` is not type %s", ErrInvalidParams, param.Name, param.Type)
+		}
+		params[param.Name] = value
+	}
+	return params, nil
+}
+
+// Params are a request's validated parameters, by name. Accessors return
+// the zero value for (optional) parameters that weren't given.
+type Params map[string]interface{}
+
+// Has reports whether a parameter was given
+func (p Params) Has(name string) bool {
+	_, ok := p[name]
+	return ok
+}
+
+// Integer returns an INTEGER or NUMBER parameter, or nil if it wasn't
+// given, or isn't an integer (e.g. 7.5)
+func (p Params) Integer(name string) *big.Int {
+	integer, _ := p[name].(*big.Int)
+	return integer
+}
+
+// Float returns a NUMBER (or INTEGER) parameter, rounded to a float64
+func (p Params) Float(name string) float64 {
+	switch value := p[name].(type) {
+	case float64:
+		return value
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(value).Float64()
+		return f
+	}
+	return 0
+}
+
+// String returns a STRING parameter
+func (p Params) String(name string) string {
+	s, _ := p[name].(string)
+	return s
+}
+
+// Bool returns a BOOLEAN parameter
+func (p Params) Bool(name string) bool {
+	b, _ := p[name].(bool)
+	return b
+}
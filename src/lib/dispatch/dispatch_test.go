@@ -0,0 +1,213 @@
+package dispatch
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type echoResponse struct {
+	Method string   `json:"method"`
+	Number *big.Int `json:"number,omitempty"`
+	Float  float64  `json:"float,omitempty"`
+	Text   string   `json:"text"`
+	Flag   bool     `json:"flag"`
+}
+
+var errHandler = errors.New("handler failed")
+
+func newTestDispatcher() *Dispatcher {
+	d := New([]byte("[]"))
+	d.Register(Method{
+		Name: "echo",
+		Params: []Param{
+			{Name: "integer", Type: INTEGER, Optional: true},
+			{Name: "number", Type: NUMBER, Optional: true},
+			{Name: "text", Type: STRING},
+			{Name: "flag", Type: BOOLEAN, Optional: true},
+		},
+		Handler: func(params Params) (any, error) {
+			response := echoResponse{Method: "echo", Text: params.String("text"), Flag: params.Bool("flag")}
+			if params.Has("integer") {
+				response.Number = params.Integer("integer")
+			}
+			if params.Has("number") {
+				response.Float = params.Float("number")
+			}
+			return response, nil
+		},
+	}, Method{
+		Name:    "fail",
+		Handler: func(Params) (any, error) { return nil, errHandler },
+	})
+	return d
+}
+
+func TestHandle(t *testing.T) {
+	d := newTestDispatcher()
+
+	tests := []struct {
+		request  string
+		expected string
+		err      error
+	}{
+		{`{"method":"echo","text":"hi"}`, `{"method":"echo","text":"hi","flag":false}`, nil},
+		{`{"method":"echo","text":"hi","flag":true,"extra":[1,2]}`, `{"method":"echo","text":"hi","flag":true}`, nil},
+		{`{"method":"echo","text":"hi","integer":123456789012345678901234567890}`,
+			`{"method":"echo","number":123456789012345678901234567890,"text":"hi","flag":false}`, nil},
+		{`{"method":"echo","text":"hi","integer":5.0}`, `{"method":"echo","number":5,"text":"hi","flag":false}`, nil},
+		{`{"method":"echo","text":"hi","number":2.5}`, `{"method":"echo","float":2.5,"text":"hi","flag":false}`, nil},
+		{`{"method":"echo","text":"hi","number":3}`, `{"method":"echo","float":3,"text":"hi","flag":false}`, nil},
+		{`{"method":"echo","text":"hi","flag":null}`, `{"method":"echo","text":"hi","flag":false}`, nil},
+
+		{`{"method":"echo"}`, "[]", ErrInvalidParams},
+		{`{"method":"echo","text":1}`, "[]", ErrInvalidParams},
+		{`{"method":"echo","text":"hi","integer":2.5}`, "[]", ErrInvalidParams},
+		{`{"method":"echo","text":"hi","number":"2"}`, "[]", ErrInvalidParams},
+		{`{"method":"echo","text":"hi","flag":"true"}`, "[]", ErrInvalidParams},
+		{`{"method":"fail"}`, "[]", errHandler},
+		{`{"method":"other"}`, "[]", ErrUnknownMethod},
+		{`{"method":1}`, "[]", ErrMalformed},
+		{`["method","echo"]`, "[]", ErrMalformed},
+		{`{"method":"echo"`, "[]", ErrMalformed},
+	}
+
+	for _, test := range tests {
+		response, _, err := d.Handle(test.request, discard)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("Expected error %v for %s, got %v", test.err, test.request, err)
+		}
+		if string(response) != test.expected {
+			t.Fatalf("Expected %s for %s, got %s", test.expected, test.request, response)
+		}
+	}
+}
+
+func TestHandleMethod(t *testing.T) {
+	d := newTestDispatcher()
+
+	// The method is reported once known, even if the request fails
+	for request, expected := range map[string]string{
+		`{"method":"echo","text":"hi"}`: "echo",
+		`{"method":"fail"}`:             "fail",
+		`{"method":"other"}`:            "other",
+		`{"method":1}`:                  "",
+		`nonsense`:                      "",
+	} {
+		if _, method, _ := d.Handle(request, discard); method != expected {
+			t.Fatalf("Expected method %q for %s, got %q", expected, request, method)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	d := newTestDispatcher()
+
+	if methods := d.Methods(); !reflect.DeepEqual(methods, []string{"echo", "fail"}) {
+		t.Fatalf("Expected the registered methods, got %v", methods)
+	}
+	if !d.Has("echo") || d.Has("other") {
+		t.Fatalf("Expected only registered methods to be found")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected registering a method twice to panic")
+		}
+	}()
+	d.Register(Method{Name: "echo"})
+}
+
+func TestStrict(t *testing.T) {
+	d := newTestDispatcher().WithOptions(Options{Strict: true})
+
+	tests := []struct {
+		request  string
+		expected string
+		err      error
+	}{
+		// Integers only when written as one
+		{`{"method":"echo","text":"hi","integer":5}`, `{"method":"echo","number":5,"text":"hi","flag":false}`, nil},
+		{`{"method":"echo","text":"hi","integer":5.0}`, "[]", ErrInvalidParams},
+		{`{"method":"echo","text":"hi","integer":5e0}`, "[]", ErrInvalidParams},
+		{`{"method":"echo","text":"hi","number":5.0}`, `{"method":"echo","float":5,"text":"hi","flag":false}`, nil},
+
+		// Only JSON numbers, anywhere in the request
+		{`{"method":"echo","text":"hi","number":05}`, "[]", ErrMalformed},
+		{`{"method":"echo","text":"hi","other":[{"n":.5}]}`, "[]", ErrMalformed},
+	}
+
+	for _, test := range tests {
+		response, _, err := d.Handle(test.request, discard)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("Expected error %v for %s, got %v", test.err, test.request, err)
+		}
+		if string(response) != test.expected {
+			t.Fatalf("Expected %s for %s, got %s", test.expected, test.request, response)
+		}
+	}
+
+	// (Without strict mode, these are all fine)
+	for _, request := range []string{
+		`{"method":"echo","text":"hi","integer":5e0}`,
+		`{"method":"echo","text":"hi","number":05}`,
+	} {
+		if _, _, err := newTestDispatcher().Handle(request, discard); err != nil {
+			t.Fatalf("Expected %s to be fine without strict mode, got %v", request, err)
+		}
+	}
+}
+
+func TestHugeExponents(t *testing.T) {
+	d := newTestDispatcher()
+
+	// Short numbers with huge exponents (e.g. 1e99999, 100,000 digits)
+	// aren't expanded, in parameters or in anything else
+	bombs := strings.TrimSuffix(strings.Repeat("1e99999,", 100), ",")
+	request := `{"method":"echo","text":"hi","integer":1e99999,"other":[` + bombs + `]}`
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if _, _, err := d.Handle(request, discard); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("Expected ErrInvalidParams for an integer over MAX_INT_DIGITS, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected requests with huge exponents to be rejected quickly, took %v for 100", elapsed)
+	}
+
+	// (Ignored, they're fine)
+	if _, _, err := d.Handle(`{"method":"echo","text":"hi","other":[`+bombs+`]}`, discard); err != nil {
+		t.Fatalf("Expected huge exponents in other fields to be ignored, got %v", err)
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	request := `{"method":"echo","text":"first","text":"last"}`
+
+	for policy, expected := range map[DuplicatePolicy]string{
+		"":                `{"method":"echo","text":"last","flag":false}`,
+		DUPLICATES_LAST:   `{"method":"echo","text":"last","flag":false}`,
+		DUPLICATES_FIRST:  `{"method":"echo","text":"first","flag":false}`,
+		DUPLICATES_REJECT: "[]",
+	} {
+		response, _, _ := newTestDispatcher().WithOptions(Options{DuplicateKeys: policy}).Handle(request, discard)
+		if string(response) != expected {
+			t.Fatalf("Expected %s with policy %q, got %s", expected, policy, response)
+		}
+	}
+
+	if _, err := ParseDuplicatePolicy("reject"); err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+	if _, err := ParseDuplicatePolicy("random"); err == nil {
+		t.Fatalf("Expected an error for an unknown policy")
+	}
+}
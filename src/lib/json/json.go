@@ -1,10 +1,17 @@
 package json
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
 	"strings"
 
 	participle "github.com/alecthomas/participle/v2"
+
+	"github.com/finwarman/protohackers/src/lib/metrics"
 )
 
 // trunk-ignore-all(golangci-lint/govet)
@@ -19,7 +26,7 @@ type JSONValue struct {
 	Object *JSONObject `@@`
 	Array  *JSONArray  `| @@`
 	Str    *string     `| @String`
-	Number *float64    `| @("-"? Float) | @("-"? Int)`
+	Number *Number     `| @("-"? Float) | @("-"? Int)`
 	Bool   *Boolean    `| @("true" | "false")`
 	Null   *string     `| @"null"`
 }
@@ -40,7 +47,11 @@ type JSONArray struct {
 	Values []*JSONValue `"[" [ @@ { "," @@ } ] "]"`
 }
 
-// JSONArray represents a JSON array.
+// Inputs that failed to parse (as reported by the metrics endpoint)
+var parseFailures = metrics.NewCounter("protohackers_json_parse_failures_total",
+	"Inputs that failed to parse as JSON")
+
+// ParseJSON parses a JSON value from the input string.
 func ParseJSON(input string) (*JSONValue, error) {
 	parser, err := participle.Build[JSONValue](
 		participle.Unquote("String"),
@@ -50,9 +61,15 @@ func ParseJSON(input string) (*JSONValue, error) {
 	}
 
 	value, err := parser.ParseString("", input)
+	if err != nil {
+		parseFailures.Inc()
+	}
 	return value, err
 }
 
+// ConvertToNative converts a parsed value to maps, slices, strings, bools
+// and nil. Numbers are left as a Number, so they're only converted (see
+// Number.Native) if they're used, as converting some is costly.
 func ConvertToNative(j *JSONValue) interface{} {
 	if j == nil {
 		return nil
@@ -75,12 +92,7 @@ func ConvertToNative(j *JSONValue) interface{} {
 		return *j.Str
 	}
 	if j.Number != nil {
-		floatValue := *j.Number
-		// Check if the float is "int-y" (has no fractional part)
-		if floatValue == float64(int(floatValue)) {
-			return int(floatValue) // as integer
-		}
-		return floatValue // as float
+		return *j.Number
 	}
 	if j.Bool != nil {
 		return bool(*j.Bool)
@@ -91,6 +103,123 @@ func ConvertToNative(j *JSONValue) interface{} {
 	return nil
 }
 
+// == Numbers == //
+
+// Most digits Number.Int will produce, so that a short literal with a huge
+// exponent (e.g. 1e99999) can't take up much memory or time. This is a few
+// times prime-time's longest request line (1 KiB), so anything written out
+// in full fits.
+const MAX_INT_DIGITS = 4096
+
+// Errors from Number.Int
+var (
+	ErrNotInteger     = errors.New("not an integer")
+	ErrNumberTooLarge = errors.New("number too large")
+)
+
+// Number is a JSON number, kept as its literal text, so that integers of
+// any size are exact (rather than rounded through a float64)
+type Number string
+
+func (n *Number) Capture(values []string) error {
+	*n = Number(strings.Join(values, "")) // (the sign is a separate token)
+	return nil
+}
+
+func (n Number) String() string {
+	return string(n)
+}
+
+// Numbers as JSON defines them (the lexer is more lenient, see Valid)
+var JSON_NUMBER = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Valid reports whether the literal is a JSON number (the lexer also
+// accepts forms like 01, .5, 5., 0x10 and 1_000)
+func (n Number) Valid() bool {
+	return JSON_NUMBER.MatchString(string(n))
+}
+
+// IsIntegerLiteral reports whether the literal is written as an integer,
+// without a fraction or exponent (so 3 is, but 3.0 and 3e0 aren't)
+func (n Number) IsIntegerLiteral() bool {
+	return !strings.ContainsAny(string(n), ".eE")
+}
+
+// MarshalJSON writes the number as it was written (if it's valid JSON)
+func (n Number) MarshalJSON() ([]byte, error) {
+	if !n.Valid() {
+		return nil, fmt.Errorf("invalid number %q", string(n))
+	}
+	return []byte(n), nil
+}
+
+// Native returns the number as an int, or a *big.Int if it's an integer too
+// big for an int (so integers are exact, up to MAX_INT_DIGITS), or else a
+// float64 (rounded, if need be)
+func (n Number) Native() interface{} {
+	if integer, err := n.Int(); err == nil {
+		if integer.IsInt64() && integer.Int64() >= math.MinInt && integer.Int64() <= math.MaxInt {
+			return int(integer.Int64())
+		}
+		return integer
+	}
+	floatValue, _ := n.Float64()
+	return floatValue
+}
+
+// Float64 returns the number as a float64 (rounded, if need be)
+func (n Number) Float64() (float64, error) {
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// Int returns the number exactly, if it's an integer (including literals
+// like 5.0 or 1e3), or ErrNotInteger
+func (n Number) Int() (*big.Int, error) {
+	literal := string(n)
+	negative := strings.HasPrefix(literal, "-")
+	literal = strings.TrimPrefix(literal, "-")
+
+	// Split into digits and a (base 10) exponent
+	mantissa, exponent := literal, 0
+	if i := strings.IndexAny(literal, "eE"); i >= 0 {
+		e, err := strconv.Atoi(literal[i+1:])
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return nil, ErrNumberTooLarge
+			}
+			return nil, fmt.Errorf("invalid number %q", n)
+		}
+		mantissa, exponent = literal[:i], e
+	}
+	whole, fraction, _ := strings.Cut(mantissa, ".")
+	digits := whole + fraction
+	exponent -= len(fraction)
+
+	// (Trailing zeros after the decimal point don't matter, e.g. 5.000)
+	for exponent < 0 && strings.HasSuffix(digits, "0") {
+		digits = digits[:len(digits)-1]
+		exponent++
+	}
+	if strings.Trim(digits, "0") == "" {
+		return new(big.Int), nil
+	}
+	if exponent < 0 {
+		return nil, ErrNotInteger
+	}
+	if len(digits) > MAX_INT_DIGITS-exponent {
+		return nil, ErrNumberTooLarge
+	}
+
+	integer, ok := new(big.Int).SetString(digits+strings.Repeat("0", exponent), 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", n)
+	}
+	if negative {
+		integer.Neg(integer)
+	}
+	return integer, nil
+}
+
 // Define boolean type to parse booleans - default 'bool' behaviour
 // in participle only indicates that a match occured
 type Boolean bool
@@ -142,13 +271,7 @@ func (j *JSONValue) toString(indent int) string {
 	} else if j.Str != nil {
 		result += fmt.Sprintf("\"%s\"", *j.Str)
 	} else if j.Number != nil {
-		floatValue := *j.Number
-		// Check if the float is "int-y" (has no fractional part)
-		if floatValue == float64(int(floatValue)) {
-			result += fmt.Sprintf("%d", int(floatValue)) // Format as an integer
-		} else {
-			result += fmt.Sprintf("%g", floatValue) // Format as a float
-		}
+		result += j.Number.String() // (as written)
 	} else if j.Bool != nil {
 		result += fmt.Sprintf("%t", *j.Bool)
 	} else if j.Null != nil {
@@ -3,13 +3,15 @@ package json
 import (
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"reflect"
 	"strings"
 	"testing"
 )
 
-func floatPtr(f float64) *float64 {
-	return &f
+func numberPtr(literal string) *Number {
+	number := Number(literal)
+	return &number
 }
 
 func strPtr(s string) *string {
@@ -38,11 +40,11 @@ func TestBasicParsing(t *testing.T) {
 				},
 				{
 					Key:   "number",
-					Value: &JSONValue{Number: floatPtr(970747)},
+					Value: &JSONValue{Number: numberPtr("970747")},
 				},
 				{
 					Key:   "negative",
-					Value: &JSONValue{Number: floatPtr(-100)},
+					Value: &JSONValue{Number: numberPtr("-100")},
 				},
 			},
 		},
@@ -74,7 +76,7 @@ func TestMultilineParsing(t *testing.T) {
 				},
 				{
 					Key:   "number",
-					Value: &JSONValue{Number: floatPtr(-970747)},
+					Value: &JSONValue{Number: numberPtr("970747")},
 				},
 			},
 		},
@@ -120,7 +122,7 @@ func TestNestedArrayObjectParsing(t *testing.T) {
 							},
 							{
 								Key:   "number",
-								Value: &JSONValue{Number: floatPtr(100000)},
+								Value: &JSONValue{Number: numberPtr("100000")},
 							},
 						},
 					},
@@ -136,8 +138,8 @@ func TestNestedArrayObjectParsing(t *testing.T) {
 											Value: &JSONValue{
 												Array: &JSONArray{
 													Values: []*JSONValue{
-														{Number: floatPtr(1)},
-														{Number: floatPtr(2)},
+														{Number: numberPtr("1")},
+														{Number: numberPtr("2")},
 													},
 												},
 											},
@@ -158,10 +160,10 @@ func TestNestedArrayObjectParsing(t *testing.T) {
 								Null: strPtr("null"),
 							},
 							{
-								Number: floatPtr(1234),
+								Number: numberPtr("1234"),
 							},
 							{
-								Number: floatPtr(1000.25),
+								Number: numberPtr("1000.25"),
 							},
 						},
 					},
@@ -215,3 +217,97 @@ func TestNativeObjectConversion(t *testing.T) {
 		t.Fatalf("Generated JSON does not match expected value:\ngot: %s\nexpected (flattened): %s\n", string(prettyJSON), expectedString)
 	}
 }
+
+func TestLargeNumbers(t *testing.T) {
+	huge := "-" + strings.Repeat("9", 100)
+	parsedValue, err := ParseJSON(`{"small":9223372036854775807,"big":18446744073709551617,"huge":` + huge + `}`)
+	if err != nil {
+		t.Fatalf("Parsing Error:\n %v\n\n", err)
+	}
+
+	// Literals are kept as written, and integers converted exactly
+	pairs := parsedValue.Object.Pairs
+	if literal := pairs[2].Value.Number.String(); literal != huge {
+		t.Fatalf("Expected literal %s, got %s", huge, literal)
+	}
+
+	// (Numbers are left as they are, until they're used)
+	native := ConvertToNative(parsedValue).(map[string]interface{})
+	if small, ok := native["small"].(Number); !ok || small.Native() != 9223372036854775807 {
+		t.Fatalf("Expected int 2^63-1, got %#v", native["small"])
+	}
+	for key, expected := range map[string]string{"big": "18446744073709551617", "huge": huge} {
+		number, _ := native[key].(Number)
+		if integer, ok := number.Native().(*big.Int); !ok || integer.String() != expected {
+			t.Fatalf("Expected %s to be *big.Int %s, got %#v", key, expected, native[key])
+		}
+	}
+}
+
+func TestNumberInt(t *testing.T) {
+	tests := []struct {
+		literal  string
+		expected string
+		err      error
+	}{
+		{"0", "0", nil},
+		{"-0", "0", nil},
+		{"42", "42", nil},
+		{"-42", "-42", nil},
+		{"5.0", "5", nil},
+		{"5.000", "5", nil},
+		{"1e3", "1000", nil},
+		{"1.5E3", "1500", nil},
+		{"25e-1", "", ErrNotInteger},
+		{"2500e-2", "25", nil},
+		{"0.0e5", "0", nil},
+		{"0.5", "", ErrNotInteger},
+		{"-7.25", "", ErrNotInteger},
+		{"1e4095", "1" + strings.Repeat("0", 4095), nil}, // (MAX_INT_DIGITS)
+		{"1e4096", "", ErrNumberTooLarge},
+		{"1e99999", "", ErrNumberTooLarge},
+		{"1e999999999", "", ErrNumberTooLarge},
+		{"1e99999999999999999999", "", ErrNumberTooLarge},
+	}
+
+	for _, test := range tests {
+		integer, err := Number(test.literal).Int()
+		if err != test.err {
+			t.Fatalf("Expected error %v for %s, got %v", test.err, test.literal, err)
+		}
+		if err == nil && integer.String() != test.expected {
+			t.Fatalf("Expected %s for %s, got %s", test.expected, test.literal, integer)
+		}
+	}
+}
+
+func TestNumberLiteral(t *testing.T) {
+	tests := []struct {
+		literal string
+		valid   bool
+		integer bool
+	}{
+		{"0", true, true},
+		{"-0", true, true},
+		{"123", true, true},
+		{"-123", true, true},
+		{"3.0", true, false},
+		{"1e3", true, false},
+		{"1E+3", true, false},
+		{"2.5e-1", true, false},
+		{"01", false, true},
+		{".5", false, false},
+		{"5.", false, false},
+		{"0x10", false, true},
+		{"1_000", false, true},
+		{"1e", false, false},
+	}
+
+	for _, test := range tests {
+		n := Number(test.literal)
+		if n.Valid() != test.valid || n.IsIntegerLiteral() != test.integer {
+			t.Fatalf("Expected %s to be valid %t, integer %t, got %t, %t",
+				test.literal, test.valid, test.integer, n.Valid(), n.IsIntegerLiteral())
+		}
+	}
+}
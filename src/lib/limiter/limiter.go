@@ -0,0 +1,212 @@
+package limiter
+
+import (
+	"errors"
+	"flag"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/metrics"
+)
+
+// Per-IP limits on connections (or packets), shared by every server.
+//
+// Each remote IP gets a token bucket, refilled at Rate tokens per second up
+// to Burst: a new connection (or UDP packet) takes a token, and is rejected
+// if there are none left. Concurrent connections are also capped per IP
+// (MaxPerIP) and overall (MaxTotal).
+//
+// What a rejected client is told (if anything) is up to each protocol,
+// see server.Config.Reject.
+
+// How often idle hosts (no connections, full bucket) are forgotten
+const SWEEP_INTERVAL = time.Minute
+
+// Reasons for rejecting a connection or packet
+var (
+	ErrRateLimited        = errors.New("rate limited")
+	ErrTooManyFromIP      = errors.New("too many connections from this address")
+	ErrTooManyConnections = errors.New("too many connections")
+)
+
+// Rejected connections and packets, by problem and reason
+// ("rate", "per_ip" or "total")
+var Rejected = metrics.NewCounter("protohackers_limiter_rejected_total",
+	"Connections or packets rejected by the limiter, by reason", "problem", "reason")
+
+// Config holds the limits, 0 means no limit
+type Config struct {
+	Rate     float64 // Connections (or packets) per second, per IP
+	Burst    int     // Tokens per IP bucket, 0 for ceil(Rate)
+	MaxPerIP int     // Concurrent connections per IP
+	MaxTotal int     // Concurrent connections overall
+}
+
+// RegisterFlags adds -rate-limit, -rate-burst, -max-conns-per-ip and
+// -max-conns flags to the flag set, returning the config they populate
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	config := &Config{}
+	fs.Float64Var(&config.Rate, "rate-limit", 0,
+		"new connections (or UDP packets) per second allowed from each IP (0 for no limit)")
+	fs.IntVar(&config.Burst, "rate-burst", 0,
+		"burst allowed above -rate-limit (0 for the rate, rounded up)")
+	fs.IntVar(&config.MaxPerIP, "max-conns-per-ip", 0,
+		"concurrent connections allowed from each IP (0 for no limit)")
+	fs.IntVar(&config.MaxTotal, "max-conns", 0,
+		"concurrent connections allowed in total (0 for no limit)")
+	return config
+}
+
+// Limiter applies a Config to remote addresses
+type Limiter struct {
+	name   string // problem name, for metrics
+	config Config
+	now    func() time.Time
+
+	mu        sync.Mutex
+	hosts     map[string]*host // IP -> state
+	total     int              // concurrent connections overall
+	lastSweep time.Time
+}
+
+// host is the state for a single remote IP
+type host struct {
+	tokens  float64
+	updated time.Time // last refill
+	conns   int
+}
+
+// New creates a Limiter for a problem (named for metrics)
+func New(name string, config Config) *Limiter {
+	if config.Rate > 0 && config.Burst <= 0 {
+		config.Burst = int(math.Ceil(config.Rate))
+	}
+	return &Limiter{
+		name:   name,
+		config: config,
+		now:    time.Now,
+		hosts:  make(map[string]*host),
+	}
+}
+
+// Acquire admits a new connection from addr, returning a func to call once
+// it closes, or the reason it was rejected
+func (l *Limiter) Acquire(addr net.Addr) (release func(), err error) {
+	if l.config == (Config{}) {
+		return func() {}, nil
+	}
+
+	ip := IP(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(ip)
+	switch {
+	case l.config.MaxTotal > 0 && l.total >= l.config.MaxTotal:
+		return nil, l.reject(ErrTooManyConnections, "total")
+	case l.config.MaxPerIP > 0 && h.conns >= l.config.MaxPerIP:
+		return nil, l.reject(ErrTooManyFromIP, "per_ip")
+	case !l.take(h):
+		return nil, l.reject(ErrRateLimited, "rate")
+	}
+
+	h.conns++
+	l.total++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			h.conns--
+			l.total--
+		})
+	}, nil
+}
+
+// Allow admits a single request (e.g. a UDP packet) from addr, only
+// applying the rate limit, returning the reason if it was rejected
+func (l *Limiter) Allow(addr net.Addr) error {
+	if l.config.Rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.take(l.host(IP(addr))) {
+		return l.reject(ErrRateLimited, "rate")
+	}
+	return nil
+}
+
+// host returns the state for an IP, creating it (with a full bucket) if
+// needed, and forgetting idle hosts every SWEEP_INTERVAL.
+// The caller must hold l.mu.
+func (l *Limiter) host(ip string) *host {
+	now := l.now()
+
+	if now.Sub(l.lastSweep) >= SWEEP_INTERVAL {
+		l.lastSweep = now
+		for key, h := range l.hosts {
+			if h.conns == 0 && (l.config.Rate <= 0 || l.refill(h, now) >= float64(l.config.Burst)) {
+				delete(l.hosts, key)
+			}
+		}
+	}
+
+	h, ok := l.hosts[ip]
+	if !ok {
+		h = &host{tokens: float64(l.config.Burst), updated: now}
+		l.hosts[ip] = h
+	}
+	return h
+}
+
+// take removes a token from the host's bucket, returning false if empty.
+// The caller must hold l.mu.
+func (l *Limiter) take(h *host) bool {
+	if l.config.Rate <= 0 {
+		return true
+	}
+	if l.refill(h, l.now()) < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// refill adds tokens for the time elapsed, returning the tokens available
+func (l *Limiter) refill(h *host, now time.Time) float64 {
+	elapsed := now.Sub(h.updated).Seconds()
+	if elapsed > 0 {
+		h.tokens = math.Min(float64(l.config.Burst), h.tokens+elapsed*l.config.Rate)
+		h.updated = now
+	}
+	return h.tokens
+}
+
+// reject counts a rejection, returning err
+func (l *Limiter) reject(err error, reason string) error {
+	Rejected.Inc(l.name, reason)
+	return err
+}
+
+// IP returns the IP of a remote address, as a string (the whole address,
+// if it isn't an IP address)
+func IP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,137 @@
+package limiter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClock is a controllable time source
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(config Config) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1_000_000, 0)}
+	l := New("test", config)
+	l.now = clock.now
+	return l, clock
+}
+
+func addr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestRateLimit(t *testing.T) {
+	l, clock := newTestLimiter(Config{Rate: 2, Burst: 3})
+	alice, bob := addr("10.0.0.1"), addr("10.0.0.2")
+	before := Rejected.Value("test", "rate") // (shared by every run)
+
+	// A full bucket allows a burst
+	for i := 0; i < 3; i++ {
+		if err := l.Allow(alice); err != nil {
+			t.Fatalf("Expected request %d to be allowed, got %v", i, err)
+		}
+	}
+	if err := l.Allow(alice); err != ErrRateLimited {
+		t.Fatalf("Expected rate limit after burst, got %v", err)
+	}
+
+	// Other addresses have their own bucket
+	if err := l.Allow(bob); err != nil {
+		t.Fatalf("Expected other IP to be allowed, got %v", err)
+	}
+
+	// Tokens refill at the rate
+	clock.advance(500 * time.Millisecond)
+	if err := l.Allow(alice); err != nil {
+		t.Fatalf("Expected a token after refilling, got %v", err)
+	}
+	if err := l.Allow(alice); err != ErrRateLimited {
+		t.Fatalf("Expected only one token after refilling, got %v", err)
+	}
+
+	if rejected := Rejected.Value("test", "rate") - before; rejected != 2 {
+		t.Fatalf("Expected 2 rejections counted, got %v", rejected)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	l, _ := newTestLimiter(Config{MaxPerIP: 2, MaxTotal: 3})
+
+	releaseA1, err := l.Acquire(addr("10.0.0.1"))
+	if err != nil {
+		t.Fatalf("Expected first connection to be allowed, got %v", err)
+	}
+	if _, err := l.Acquire(addr("10.0.0.1")); err != nil {
+		t.Fatalf("Expected second connection to be allowed, got %v", err)
+	}
+	if _, err := l.Acquire(addr("10.0.0.1")); err != ErrTooManyFromIP {
+		t.Fatalf("Expected per-IP limit, got %v", err)
+	}
+
+	if _, err := l.Acquire(addr("10.0.0.2")); err != nil {
+		t.Fatalf("Expected other IP to be allowed, got %v", err)
+	}
+	if _, err := l.Acquire(addr("10.0.0.3")); err != ErrTooManyConnections {
+		t.Fatalf("Expected global limit, got %v", err)
+	}
+
+	// Releasing (even twice) frees a slot for that IP
+	releaseA1()
+	releaseA1()
+	if _, err := l.Acquire(addr("10.0.0.1")); err != nil {
+		t.Fatalf("Expected connection after release, got %v", err)
+	}
+	if _, err := l.Acquire(addr("10.0.0.3")); err != ErrTooManyConnections {
+		t.Fatalf("Expected global limit after double release, got %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l, clock := newTestLimiter(Config{Rate: 1, MaxPerIP: 1})
+
+	release, _ := l.Acquire(addr("10.0.0.1"))
+	_, _ = l.Acquire(addr("10.0.0.2"))
+	release()
+
+	// Hosts with connections, or still refilling, are kept
+	clock.advance(SWEEP_INTERVAL)
+	_ = l.Allow(addr("10.0.0.3"))
+	if len(l.hosts) != 2 {
+		t.Fatalf("Expected 10.0.0.1 to be forgotten, have %d hosts", len(l.hosts))
+	}
+	if _, ok := l.hosts["10.0.0.2"]; !ok {
+		t.Fatalf("Expected connected host to be kept")
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	l, _ := newTestLimiter(Config{})
+
+	for i := 0; i < 1000; i++ {
+		if _, err := l.Acquire(addr("10.0.0.1")); err != nil {
+			t.Fatalf("Expected no limits, got %v", err)
+		}
+		if err := l.Allow(addr("10.0.0.1")); err != nil {
+			t.Fatalf("Expected no limits, got %v", err)
+		}
+	}
+	if len(l.hosts) != 0 {
+		t.Fatalf("Expected no state without limits, have %d hosts", len(l.hosts))
+	}
+}
+
+func TestIP(t *testing.T) {
+	tests := map[net.Addr]string{
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}: "192.0.2.1",
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}: "2001:db8::1",
+		&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}:        "/tmp/socket",
+	}
+	for addr, expected := range tests {
+		if ip := IP(addr); ip != expected {
+			t.Fatalf("Expected %s for %v, got %s", expected, addr, ip)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package lines
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Newline-framed reading, with a limit on line length.
+//
+// bufio.Reader.ReadString('\n') buffers as much as the client sends until a
+// newline turns up, so a client that never sends one can use unbounded
+// memory. Reader stops at MaxLength bytes, and handles the oversize line
+// according to a Policy chosen by each server.
+
+// Default maximum line length (bytes, excluding the newline)
+const DEFAULT_MAX_LENGTH = 64 * 1024
+
+// ErrTooLong is returned (with the line truncated to the maximum length)
+// for oversize lines, under the DISCONNECT and MALFORMED policies
+var ErrTooLong = errors.New("line too long")
+
+// ErrUnterminated is returned (with the partial line) if the input ends
+// without a final newline. It wraps io.ErrUnexpectedEOF.
+var ErrUnterminated = fmt.Errorf("unterminated final line: %w", io.ErrUnexpectedEOF)
+
+// Policy is what to do with a line longer than the maximum length
+type Policy int
+
+const (
+	// Return ErrTooLong straight away, without reading the rest of the
+	// line, the caller should disconnect
+	DISCONNECT Policy = iota
+	// Skip the rest of the line, and return the truncated line as normal
+	TRUNCATE
+	// Skip the rest of the line, and return ErrTooLong (with the truncated
+	// line), the caller should respond as for any malformed request
+	MALFORMED
+)
+
+func (p Policy) String() string {
+	switch p {
+	case DISCONNECT:
+		return "disconnect"
+	case TRUNCATE:
+		return "truncate"
+	case MALFORMED:
+		return "malformed"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Reader reads newline-terminated lines, of up to maxLength bytes
+type Reader struct {
+	r         *bufio.Reader
+	maxLength int
+	policy    Policy
+
+	line []byte // reused between calls
+}
+
+// NewReader creates a Reader with the given maximum line length
+// (0 for DEFAULT_MAX_LENGTH) and oversize policy
+func NewReader(r io.Reader, maxLength int, policy Policy) *Reader {
+	if maxLength <= 0 {
+		maxLength = DEFAULT_MAX_LENGTH
+	}
+	return &Reader{r: bufio.NewReader(r), maxLength: maxLength, policy: policy}
+}
+
+// ReadLine returns the next line, without its newline.
+//
+// Errors:
+//   - io.EOF at the end of the input (with an empty line)
+//   - ErrUnterminated if the input ends part way through a line,
+//     along with the partial line
+//   - ErrTooLong for oversize lines, depending on the Policy
+//   - Any other read error, from the underlying reader
+func (l *Reader) ReadLine() (string, error) {
+	l.line = l.line[:0]
+
+	for {
+		chunk, err := l.r.ReadSlice('\n')
+		terminated := err == nil
+
+		if terminated {
+			chunk = chunk[:len(chunk)-1] // (Trim newline)
+		}
+
+		// Keep at most one byte past the limit, to detect oversize lines
+		room := l.maxLength + 1 - len(l.line)
+		l.line = append(l.line, chunk[:min(len(chunk), room)]...)
+
+		if len(l.line) > l.maxLength {
+			return l.oversize(terminated)
+		}
+
+		switch {
+		case terminated:
+			return string(l.line), nil
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(l.line) > 0:
+			return string(l.line), ErrUnterminated
+		default:
+			return "", err
+		}
+	}
+}
+
+// oversize handles a line over the maximum length, according to the policy.
+// terminated is whether its newline has already been read.
+func (l *Reader) oversize(terminated bool) (string, error) {
+	line := string(l.line[:l.maxLength])
+
+	if l.policy == DISCONNECT {
+		return line, ErrTooLong
+	}
+
+	// Skip the rest of the line
+	if !terminated {
+		if err := l.discardLine(); err != nil {
+			if err == io.EOF {
+				err = ErrUnterminated
+			}
+			return line, err
+		}
+	}
+
+	if l.policy == TRUNCATE {
+		return line, nil
+	}
+	return line, ErrTooLong
+}
+
+// discardLine reads up to and including the next newline
+func (l *Reader) discardLine() error {
+	for {
+		_, err := l.r.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
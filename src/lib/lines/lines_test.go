@@ -0,0 +1,102 @@
+package lines
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// result is a line returned by ReadLine, with its error
+type result struct {
+	line string
+	err  error
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 10_000)
+
+	tests := []struct {
+		name      string
+		input     string
+		maxLength int
+		policy    Policy
+		expected  []result
+	}{
+		{"lines", "hello\n\nworld\n", 10, DISCONNECT, []result{
+			{"hello", nil}, {"", nil}, {"world", nil}, {"", io.EOF},
+		}},
+		{"keeps carriage returns", "hello\r\n", 10, DISCONNECT, []result{
+			{"hello\r", nil}, {"", io.EOF},
+		}},
+		{"exactly max length", "0123456789\n", 10, DISCONNECT, []result{
+			{"0123456789", nil}, {"", io.EOF},
+		}},
+		{"unterminated final line", "hello\nwor", 10, DISCONNECT, []result{
+			{"hello", nil}, {"wor", ErrUnterminated},
+		}},
+		{"longer than the read buffer", long + "\nok\n", len(long), DISCONNECT, []result{
+			{long, nil}, {"ok", nil}, {"", io.EOF},
+		}},
+
+		{"disconnect", "0123456789abc\nok\n", 10, DISCONNECT, []result{
+			{"0123456789", ErrTooLong},
+		}},
+		{"truncate", "0123456789abc\nok\n", 10, TRUNCATE, []result{
+			{"0123456789", nil}, {"ok", nil}, {"", io.EOF},
+		}},
+		{"truncate, spanning reads", long + "\nok\n", 10, TRUNCATE, []result{
+			{"xxxxxxxxxx", nil}, {"ok", nil}, {"", io.EOF},
+		}},
+		{"truncate, unterminated", long, 10, TRUNCATE, []result{
+			{"xxxxxxxxxx", ErrUnterminated},
+		}},
+		{"malformed", "0123456789abc\nok\n", 10, MALFORMED, []result{
+			{"0123456789", ErrTooLong}, {"ok", nil}, {"", io.EOF},
+		}},
+		{"malformed, spanning reads", long + "\nok\n", 10, MALFORMED, []result{
+			{"xxxxxxxxxx", ErrTooLong}, {"ok", nil}, {"", io.EOF},
+		}},
+	}
+
+	for _, test := range tests {
+		reader := NewReader(strings.NewReader(test.input), test.maxLength, test.policy)
+
+		for i, expected := range test.expected {
+			line, err := reader.ReadLine()
+			if line != expected.line || !errors.Is(err, expected.err) {
+				t.Fatalf("%s: line %d: expected %.20q (%v), got %.20q (%v)",
+					test.name, i, expected.line, expected.err, line, err)
+			}
+		}
+	}
+}
+
+func TestUnterminatedIsUnexpectedEOF(t *testing.T) {
+	if !errors.Is(ErrUnterminated, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrUnterminated to wrap io.ErrUnexpectedEOF")
+	}
+}
+
+// endless never sends a newline
+type endless struct{ read int }
+
+func (e *endless) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 'x'
+	}
+	e.read += len(b)
+	return len(b), nil
+}
+
+func TestDisconnectStopsReading(t *testing.T) {
+	input := &endless{}
+	reader := NewReader(input, 100, DISCONNECT)
+
+	if _, err := reader.ReadLine(); err != ErrTooLong {
+		t.Fatalf("Expected ErrTooLong, got %v", err)
+	}
+	if input.read > 64*1024 {
+		t.Fatalf("Expected reading to stop at the limit, read %d bytes", input.read)
+	}
+}
@@ -0,0 +1,308 @@
+package logging
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shared, levelled logging for the protohackers servers (built on log/slog).
+//
+// Output is either human-readable text (coloured only when writing to a
+// terminal) or JSON, one object per line, for machine ingestion:
+//
+//	12:00:00.000 INFO  connection from problem=prime-time remote_addr=127.0.0.1:5000
+//	{"time":"...","level":"INFO","msg":"connection from","problem":"prime-time",...}
+//
+// The level and format are set with -log-level/-log-format (see RegisterFlags),
+// defaulting to the LOG_LEVEL and LOG_FORMAT environment variables.
+
+// Environment variables for the default level and format
+const ENV_LOG_LEVEL = "LOG_LEVEL"
+const ENV_LOG_FORMAT = "LOG_FORMAT"
+
+// Output formats
+const FORMAT_TEXT = "text"
+const FORMAT_JSON = "json"
+
+// Colours for colourising log levels (text output on a terminal only)
+const (
+	ColourReset  = "\033[0m"
+	ColourRed    = "\033[31m"
+	ColourYellow = "\033[33m"
+	ColourCyan   = "\033[36m"
+	ColourGrey   = "\033[90m"
+)
+
+// Options controls the log output
+type Options struct {
+	Level  slog.Level
+	Format string // FORMAT_TEXT or FORMAT_JSON
+	Colour bool   // Colourise text output
+}
+
+// DefaultOptions returns options from the environment, falling back to
+// info-level text output, coloured if stdout is a terminal
+func DefaultOptions() Options {
+	opts := Options{
+		Level:  slog.LevelInfo,
+		Format: FORMAT_TEXT,
+	}
+
+	if env := os.Getenv(ENV_LOG_LEVEL); env != "" {
+		if level, err := ParseLevel(env); err == nil {
+			opts.Level = level
+		}
+	}
+	if env := os.Getenv(ENV_LOG_FORMAT); env == FORMAT_JSON {
+		opts.Format = FORMAT_JSON
+	}
+
+	opts.Colour = IsTerminal(os.Stdout)
+	return opts
+}
+
+// RegisterFlags adds -log-level and -log-format flags to the flag set,
+// returning the options they populate (pass to Setup after parsing)
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	opts := DefaultOptions()
+
+	fs.Func("log-level", "log level: debug, info, warn or error (env "+ENV_LOG_LEVEL+")",
+		func(s string) error {
+			level, err := ParseLevel(s)
+			opts.Level = level
+			return err
+		})
+	fs.Func("log-format", "log format: text or json (env "+ENV_LOG_FORMAT+")",
+		func(s string) error {
+			if s != FORMAT_TEXT && s != FORMAT_JSON {
+				return fmt.Errorf("unknown format %q", s)
+			}
+			opts.Format = s
+			return nil
+		})
+
+	return &opts
+}
+
+// Setup installs the default logger, writing to stdout
+func Setup(opts Options) {
+	slog.SetDefault(New(os.Stdout, opts))
+}
+
+// New creates a logger writing to w with the given options
+func New(w io.Writer, opts Options) *slog.Logger {
+	if opts.Format == FORMAT_JSON {
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: opts.Level}))
+	}
+	return slog.New(&textHandler{
+		w:      w,
+		mu:     &sync.Mutex{},
+		level:  opts.Level,
+		colour: opts.Colour,
+	})
+}
+
+// ParseLevel parses a level name (debug, info, warn or error)
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// IsTerminal reports whether the file is a terminal (character device)
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Named returns a logger for a component (e.g. a problem), tagged with
+// problem=name. It always writes via the current default logger, so it
+// can be created at package init, before Setup is called.
+func Named(name string) *slog.Logger {
+	return slog.New(lazyHandler{}).With("problem", name)
+}
+
+// ForConn returns a logger for a connection, tagged with its remote address
+func ForConn(logger *slog.Logger, conn net.Conn) *slog.Logger {
+	return logger.With("remote_addr", conn.RemoteAddr().String())
+}
+
+//
+// === HANDLERS === //
+//
+
+// lazyHandler resolves the default handler each time it is used
+// (applying any attributes/groups added since), see Named
+type lazyHandler struct {
+	apply func(slog.Handler) slog.Handler
+}
+
+func (h lazyHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h lazyHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.applyTo(slog.Default().Handler()).Handle(ctx, record)
+}
+
+func (h lazyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	parent := h
+	return lazyHandler{apply: func(base slog.Handler) slog.Handler {
+		return parent.applyTo(base).WithAttrs(attrs)
+	}}
+}
+
+func (h lazyHandler) WithGroup(name string) slog.Handler {
+	parent := h
+	return lazyHandler{apply: func(base slog.Handler) slog.Handler {
+		return parent.applyTo(base).WithGroup(name)
+	}}
+}
+
+func (h lazyHandler) applyTo(base slog.Handler) slog.Handler {
+	if h.apply == nil {
+		return base
+	}
+	return h.apply(base)
+}
+
+// textHandler writes records as a single line of text:
+// `time LEVEL message key=value ...`, colourising the level if enabled
+type textHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex // shared by derived handlers, guards w
+	level  slog.Level
+	colour bool
+
+	prefix string // preformatted attributes from WithAttrs
+	group  string // current group prefix for keys, e.g. "req."
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, record slog.Record) error {
+	var sb strings.Builder
+
+	if !record.Time.IsZero() {
+		h.paint(&sb, ColourGrey, record.Time.Format("15:04:05.000"))
+		sb.WriteByte(' ')
+	}
+
+	level := fmt.Sprintf("%-5s", record.Level.String())
+	switch {
+	case record.Level >= slog.LevelError:
+		h.paint(&sb, ColourRed, level)
+	case record.Level >= slog.LevelWarn:
+		h.paint(&sb, ColourYellow, level)
+	case record.Level >= slog.LevelInfo:
+		h.paint(&sb, ColourCyan, level)
+	default:
+		h.paint(&sb, ColourGrey, level)
+	}
+
+	sb.WriteByte(' ')
+	sb.WriteString(record.Message)
+	sb.WriteString(h.prefix)
+
+	record.Attrs(func(attr slog.Attr) bool {
+		writeAttr(&sb, h.group, attr)
+		return true
+	})
+	sb.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, sb.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+	for _, attr := range attrs {
+		writeAttr(&sb, h.group, attr)
+	}
+
+	child := *h
+	child.prefix += sb.String()
+	return &child
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	child := *h
+	child.group += name + "."
+	return &child
+}
+
+// paint writes the text, colourised if enabled
+func (h *textHandler) paint(sb *strings.Builder, colour string, text string) {
+	if h.colour {
+		sb.WriteString(colour + text + ColourReset)
+	} else {
+		sb.WriteString(text)
+	}
+}
+
+// writeAttr writes ` key=value`, quoting the value if needed
+func writeAttr(sb *strings.Builder, group string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			group += attr.Key + "."
+		}
+		for _, a := range attr.Value.Group() {
+			writeAttr(sb, group, a)
+		}
+		return
+	}
+
+	var value string
+	switch attr.Value.Kind() {
+	case slog.KindTime:
+		value = attr.Value.Time().Format(time.RFC3339Nano)
+	default:
+		value = attr.Value.String()
+	}
+	if needsQuoting(value) {
+		value = strconv.Quote(value)
+	}
+
+	sb.WriteByte(' ')
+	sb.WriteString(group + attr.Key)
+	sb.WriteByte('=')
+	sb.WriteString(value)
+}
+
+// needsQuoting reports whether a value is empty, or has spaces,
+// quotes, '=' or non-printable characters
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '"' || r == '=' || !strconv.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
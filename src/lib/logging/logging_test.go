@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestTextOutput(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelInfo, Format: FORMAT_TEXT})
+
+	logger.With("remote_addr", "127.0.0.1:5000").
+		Info("received", "data", "hello world", "count", 3)
+	logger.Debug("hidden below info level")
+
+	got := buf.String()
+	if strings.Count(got, "\n") != 1 {
+		t.Fatalf("Expected exactly one line, got:\n%s", got)
+	}
+	expected := `INFO  received remote_addr=127.0.0.1:5000 data="hello world" count=3`
+	if !strings.Contains(got, expected) {
+		t.Fatalf("Expected output to contain:\n%s\ngot:\n%s", expected, got)
+	}
+	if strings.Contains(got, "\033") {
+		t.Fatalf("Expected no colour codes without a terminal, got %q", got)
+	}
+}
+
+func TestColourOutput(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelInfo, Format: FORMAT_TEXT, Colour: true})
+
+	logger.Error("failed")
+
+	if !strings.Contains(buf.String(), ColourRed+"ERROR"+ColourReset) {
+		t.Fatalf("Expected red error level, got %q", buf.String())
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: slog.LevelDebug, Format: FORMAT_JSON})
+
+	logger.With("client_id", 7).Debug("joined", "username", "alice")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected valid JSON, got %q (%v)", buf.String(), err)
+	}
+	if record["msg"] != "joined" || record["username"] != "alice" || record["client_id"] != 7.0 {
+		t.Fatalf("Unexpected JSON record: %v", record)
+	}
+}
+
+func TestNamedUsesCurrentDefault(t *testing.T) {
+	// Created before the default logger is replaced
+	logger := Named("test-problem").With("client_id", 1)
+
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	var buf bytes.Buffer
+	slog.SetDefault(New(&buf, Options{Level: slog.LevelWarn, Format: FORMAT_TEXT}))
+
+	logger.Info("below warn level")
+	logger.Warn("slow client")
+
+	got := buf.String()
+	if strings.Contains(got, "below warn level") {
+		t.Fatalf("Expected info message to be filtered, got:\n%s", got)
+	}
+	if !strings.Contains(got, "WARN  slow client problem=test-problem client_id=1") {
+		t.Fatalf("Expected tagged warning, got:\n%s", got)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	t.Setenv(ENV_LOG_LEVEL, "warn")
+	t.Setenv(ENV_LOG_FORMAT, "json")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := RegisterFlags(fs)
+	if opts.Level != slog.LevelWarn || opts.Format != FORMAT_JSON {
+		t.Fatalf("Expected options from environment, got %+v", *opts)
+	}
+
+	// Flags override the environment
+	if err := fs.Parse([]string{"-log-level", "debug", "-log-format", "text"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if opts.Level != slog.LevelDebug || opts.Format != FORMAT_TEXT {
+		t.Fatalf("Expected options from flags, got %+v", *opts)
+	}
+
+	if err := fs.Parse([]string{"-log-level", "loud"}); err == nil {
+		t.Fatalf("Expected error for unknown level")
+	}
+}
@@ -0,0 +1,421 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Prometheus-style metrics for the protohackers servers.
+//
+// Counters, gauges and histograms (optionally labelled) are registered
+// once, usually as package variables, and exposed over HTTP in the
+// Prometheus text exposition format:
+//
+//	# HELP protohackers_active_connections Currently open connections
+//	# TYPE protohackers_active_connections gauge
+//	protohackers_active_connections{problem="prime-time"} 3
+//
+// The endpoint is optional, and only started when -metrics-addr is given
+// (see RegisterFlags and Start). Metrics are collected either way.
+
+// Environment variable for the default metrics address
+const ENV_METRICS_ADDR = "METRICS_ADDR"
+
+// Path the metrics are served on
+const METRICS_PATH = "/metrics"
+
+// Content type for the text exposition format
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Default histogram buckets (seconds), for request latencies
+var DEFAULT_BUCKETS = []float64{
+	0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5,
+}
+
+// Metric types, as reported in `# TYPE` lines
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+)
+
+// Registry holds a set of metrics, see Default
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// Default is the registry used by the package-level constructors, and
+// served by Start
+var Default = NewRegistry()
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is a named metric, with a series per set of label values
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // upper bounds, histograms only
+
+	mu     sync.Mutex
+	series map[string]*series // joined label values -> series
+}
+
+// series is a single time series (one set of label values)
+type series struct {
+	labelValues []string
+	value       float64  // counter/gauge value, or histogram sum
+	counts      []uint64 // histogram observations per bucket (+Inf last)
+	count       uint64   // histogram total observations
+}
+
+// register adds a new family to the registry.
+// Registering the same name twice is a programming error, so panics.
+func (r *Registry) register(f *family) *family {
+	for _, label := range f.labels {
+		if label == "le" && f.kind == TYPE_HISTOGRAM {
+			panic("metrics: `le` is reserved for histogram buckets")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.families[f.name]; ok {
+		panic(fmt.Sprintf("metrics: %s already registered", f.name))
+	}
+	f.series = make(map[string]*series)
+	r.families[f.name] = f
+
+	// Unlabelled metrics are always reported, even before first use
+	if len(f.labels) == 0 {
+		f.get(nil)
+	}
+	return f
+}
+
+// get returns the series for the label values, creating it if needed.
+// The caller must hold f.mu (or own f exclusively).
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == TYPE_HISTOGRAM {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// update applies fn to the series for the label values
+func (f *family) update(labelValues []string, fn func(s *series)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fn(f.get(labelValues))
+}
+
+// read returns fn applied to the series for the label values
+func (f *family) read(labelValues []string, fn func(s *series) float64) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return fn(f.get(labelValues))
+}
+
+//
+// === METRIC TYPES === //
+//
+
+// Counter is a value that only goes up (e.g. requests handled)
+type Counter struct{ f *family }
+
+// NewCounter registers a counter, with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, kind: TYPE_COUNTER, labels: labels})}
+}
+
+// Inc adds one to the counter for the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v (which must not be negative) to the counter for the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s can't decrease", c.f.name))
+	}
+	c.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Value returns the current count for the label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.f.read(labelValues, func(s *series) float64 { return s.value })
+}
+
+// Gauge is a value that can go up and down (e.g. open connections)
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge, with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, kind: TYPE_GAUGE, labels: labels})}
+}
+
+// Set sets the gauge for the label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value = v })
+}
+
+// Add adds v (possibly negative) to the gauge for the label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Inc adds one to the gauge for the label values
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts one from the gauge for the label values
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Value returns the current value for the label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.f.read(labelValues, func(s *series) float64 { return s.value })
+}
+
+// Histogram counts observations (e.g. latencies) into buckets
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram with the given bucket upper bounds
+// (nil for DEFAULT_BUCKETS), and label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DEFAULT_BUCKETS
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Histogram{r.register(&family{
+		name: name, help: help, kind: TYPE_HISTOGRAM, labels: labels, buckets: buckets,
+	})}
+}
+
+// Observe records a value for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	// First bucket with an upper bound >= v (+Inf if none)
+	i := sort.SearchFloat64s(h.f.buckets, v)
+
+	h.f.update(labelValues, func(s *series) {
+		s.counts[i]++
+		s.count++
+		s.value += v
+	})
+}
+
+// Since records the time elapsed since start, in seconds
+func (h *Histogram) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count returns the number of observations for the label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	return uint64(h.f.read(labelValues, func(s *series) float64 { return float64(s.count) }))
+}
+
+// NewCounter registers a counter with the Default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewGauge registers a gauge with the Default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram with the Default registry
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+//
+// === EXPOSITION === //
+//
+
+// WriteTo writes every metric in the text exposition format,
+// sorted by name (then label values), so output is stable
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	var sb strings.Builder
+	for _, f := range families {
+		f.write(&sb)
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics, for use as an http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	_, _ = r.WriteTo(w)
+}
+
+// write formats the family (header and every series)
+func (f *family) write(sb *strings.Builder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(sb, "# TYPE %s %s\n", f.name, f.kind)
+
+	// Label names for histogram buckets (copied, to not alias f.labels)
+	bucketNames := append(append([]string(nil), f.labels...), "le")
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		labels := formatLabels(f.labels, s.labelValues)
+
+		if f.kind != TYPE_HISTOGRAM {
+			fmt.Fprintf(sb, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+			continue
+		}
+
+		// Buckets are cumulative, ending with +Inf (== count)
+		cumulative := uint64(0)
+		for i, count := range s.counts {
+			cumulative += count
+
+			le := math.Inf(1)
+			if i < len(f.buckets) {
+				le = f.buckets[i]
+			}
+			bucketValues := append(append([]string(nil), s.labelValues...), formatFloat(le))
+			bucketLabels := formatLabels(bucketNames, bucketValues)
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", f.name, bucketLabels, cumulative)
+		}
+		fmt.Fprintf(sb, "%s_sum%s %s\n", f.name, labels, formatFloat(s.value))
+		fmt.Fprintf(sb, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+// formatLabels formats `{name="value",...}`, or nothing if unlabelled
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escape(values[i], true) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a value as Prometheus expects (e.g. `+Inf`)
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes backslashes and newlines (and quotes, in label values)
+func escape(s string, quotes bool) string {
+	replacer := helpReplacer
+	if quotes {
+		replacer = labelReplacer
+	}
+	return replacer.Replace(s)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+//
+// === HTTP ENDPOINT === //
+//
+
+// RegisterFlags adds a -metrics-addr flag to the flag set, returning the
+// address it populates (pass to Start after parsing)
+func RegisterFlags(fs *flag.FlagSet) *string {
+	return fs.String("metrics-addr", os.Getenv(ENV_METRICS_ADDR),
+		"serve metrics over HTTP on this `host:port`, e.g. :9090 (env "+ENV_METRICS_ADDR+")")
+}
+
+// Start serves the Default registry on addr (at METRICS_PATH) in the
+// background, until the context is cancelled. It returns the bound address,
+// or nil if addr is empty (the endpoint is disabled).
+func Start(ctx context.Context, addr string) (net.Addr, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, Default)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	context.AfterFunc(ctx, func() { srv.Close() })
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			// (Metrics are best-effort, the servers carry on without them)
+			slog.Error("metrics endpoint failed", "error", err)
+		}
+	}()
+
+	return ln.Addr(), nil
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounter("test_requests_total", "Requests handled", "problem")
+	requests.Inc("prime-time")
+	requests.Add(2, "prime-time")
+	requests.Inc("budget-chat")
+
+	rooms := r.NewGauge("test_room_size", "Users in the room\nper server")
+	rooms.Inc()
+	rooms.Inc()
+	rooms.Dec()
+
+	latency := r.NewHistogram("test_latency_seconds", "Request latency", []float64{1, 0.1}, "problem")
+	latency.Observe(0.05, "smoke-test")
+	latency.Observe(0.5, "smoke-test")
+	latency.Observe(2, "smoke-test")
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	expected := `# HELP test_latency_seconds Request latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{problem="smoke-test",le="0.1"} 1
+test_latency_seconds_bucket{problem="smoke-test",le="1"} 2
+test_latency_seconds_bucket{problem="smoke-test",le="+Inf"} 3
+test_latency_seconds_sum{problem="smoke-test"} 2.55
+test_latency_seconds_count{problem="smoke-test"} 3
+# HELP test_requests_total Requests handled
+# TYPE test_requests_total counter
+test_requests_total{problem="budget-chat"} 1
+test_requests_total{problem="prime-time"} 3
+# HELP test_room_size Users in the room\nper server
+# TYPE test_room_size gauge
+test_room_size 1
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected exposition, expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	if requests.Value("prime-time") != 3 || latency.Count("smoke-test") != 3 {
+		t.Fatalf("Unexpected values: requests=%v, observations=%v",
+			requests.Value("prime-time"), latency.Count("smoke-test"))
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Escaping", "value").Inc("a \"quoted\"\\ \nvalue")
+
+	var buf bytes.Buffer
+	_, _ = r.WriteTo(&buf)
+
+	expected := `test_total{value="a \"quoted\"\\ \nvalue"} 1`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Expected %s, got:\n%s", expected, buf.String())
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	expectPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected panic: %s", name)
+			}
+		}()
+		fn()
+	}
+
+	r := NewRegistry()
+	counter := r.NewCounter("test_total", "Test", "problem")
+
+	expectPanic("duplicate name", func() { r.NewGauge("test_total", "Test") })
+	expectPanic("missing label value", func() { counter.Inc() })
+	expectPanic("decreasing counter", func() { counter.Add(-1, "smoke-test") })
+	expectPanic("reserved label", func() { r.NewHistogram("test_seconds", "Test", nil, "le") })
+}
+
+// Counter served by TestEndpoint (registered once, as the default registry
+// is shared by every run)
+var endpointCounter = NewCounter("test_endpoint_total", "Endpoint test")
+
+func TestEndpoint(t *testing.T) {
+	// Disabled without an address
+	if addr, err := Start(context.Background(), ""); addr != nil || err != nil {
+		t.Fatalf("Expected no endpoint, got %v (%v)", addr, err)
+	}
+
+	endpointCounter.Inc()
+	expected := "test_endpoint_total " + formatFloat(endpointCounter.Value()) + "\n"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr, err := Start(ctx, "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to start endpoint: %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr.String() + METRICS_PATH)
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != CONTENT_TYPE {
+		t.Fatalf("Unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), expected) {
+		t.Fatalf("Expected test counter in response, got:\n%s", body)
+	}
+}
@@ -0,0 +1,414 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy's PROXY protocol (v1 and v2), for servers behind a tunnel or load
+// balancer (e.g. `ssh -R`, see the README), where every connection would
+// otherwise appear to come from localhost.
+//
+// The proxy sends a header with the real client's address before any
+// data. With -proxy-protocol, servers expect that header on every
+// connection (and drop connections without one), so client addresses
+// can't be spoofed by connecting directly: only enable it when every
+// connection comes through a trusted proxy.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+// How long a new connection has to send its header
+const HEADER_TIMEOUT = 5 * time.Second
+
+// Longest v1 header, including the CRLF
+const MAX_V1_LENGTH = 107
+
+// Prefixes that start a v1 or v2 header
+const V1_PREFIX = "PROXY "
+const V2_SIGNATURE = "\r\n\r\n\x00\r\nQUIT\n"
+
+// Errors for connections without a (valid) header
+var (
+	ErrNoHeader      = errors.New("no PROXY protocol header")
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+// Options for reading headers on accepted connections
+type Options struct {
+	Enabled bool          // Expect a header on every connection
+	Timeout time.Duration // Time allowed to send the header, 0 for HEADER_TIMEOUT
+}
+
+// RegisterFlags adds a -proxy-protocol flag to the flag set, returning the
+// options it populates
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	options := &Options{}
+	fs.BoolVar(&options.Enabled, "proxy-protocol", false,
+		"expect a PROXY protocol (v1 or v2) header on every TCP connection, only for use behind a trusted proxy")
+	return options
+}
+
+// Command is what the proxy says the connection is for
+type Command byte
+
+const (
+	LOCAL Command = 0x0 // From the proxy itself (e.g. a health check), addresses are unset
+	PROXY Command = 0x1 // On behalf of a client
+)
+
+// Header is a parsed (or to be sent) PROXY protocol header
+type Header struct {
+	Version     int // 1 or 2 (when parsed)
+	Command     Command
+	Source      net.Addr // Client address, nil if unknown
+	Destination net.Addr // Address the client connected to, nil if unknown
+}
+
+// NewHeader returns a header for proxying a client, from source to destination
+func NewHeader(source, destination net.Addr) Header {
+	return Header{Command: PROXY, Source: source, Destination: destination}
+}
+
+//
+// === CONNECTIONS === //
+//
+
+// Conn is a connection that started with a PROXY protocol header,
+// reporting the addresses from the header (if any)
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader // (may have buffered data after the header)
+	header Header
+}
+
+// Accept reads the header from a new connection (within the timeout,
+// 0 for HEADER_TIMEOUT), returning the connection with its addresses
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout <= 0 {
+		timeout = HEADER_TIMEOUT
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	header, err := ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, reader: reader, header: header}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	// (Drop the buffer once it's empty, reading directly after that)
+	if c.reader != nil {
+		if c.reader.Buffered() > 0 {
+			return c.reader.Read(b)
+		}
+		c.reader = nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite shuts down the sending side of the connection, if supported
+func (c *Conn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// Header returns the header the connection started with
+func (c *Conn) Header() Header {
+	return c.header
+}
+
+// RemoteAddr returns the client's address from the header, if known
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, if known
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+//
+// === PARSING === //
+//
+
+// ReadHeader reads a v1 or v2 header from the start of a connection
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	// (Peek a byte at a time, so a short message without a header
+	// fails straight away, rather than waiting for more)
+	for n := 1; n <= len(V2_SIGNATURE); n++ {
+		peeked, err := r.Peek(n)
+		if err != nil {
+			if err == io.EOF && n > 1 {
+				err = io.ErrUnexpectedEOF
+			}
+			return Header{}, err
+		}
+
+		switch {
+		case string(peeked) == V2_SIGNATURE:
+			_, _ = r.Discard(n)
+			return readV2(r)
+		case n == len(V1_PREFIX) && string(peeked) == V1_PREFIX:
+			return readV1(r)
+		case !strings.HasPrefix(V2_SIGNATURE, string(peeked)) &&
+			!strings.HasPrefix(V1_PREFIX, string(peeked)):
+			return Header{}, ErrNoHeader
+		}
+	}
+	return Header{}, ErrNoHeader // (unreachable, the signature is longer)
+}
+
+// readV1 reads a v1 (text) header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(r *bufio.Reader) (Header, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == MAX_V1_LENGTH {
+			return Header{}, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Header{}, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	header := Header{Version: 1, Command: PROXY}
+
+	// (UNKNOWN means the proxy couldn't tell, the rest is ignored)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return Header{}, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+
+	source, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return Header{}, err
+	}
+	destination, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return Header{}, err
+	}
+	header.Source, header.Destination = source, destination
+	return header, nil
+}
+
+// parseV1Addr parses an address from a v1 header, checking it matches
+// the protocol (TCP4 or TCP6)
+func parseV1Addr(protocol, ip, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil || strings.Contains(ip, ":") != (protocol == "TCP6") {
+		return nil, fmt.Errorf("%w: bad %s address %q", ErrInvalidHeader, protocol, ip)
+	}
+	// (Ports are decimal, with no leading zeros)
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (port != "0" && port[0] == '0') {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+}
+
+// Address families and transports in v2 headers
+const (
+	FAMILY_UNSPEC = 0x0
+	FAMILY_INET   = 0x1
+	FAMILY_INET6  = 0x2
+	FAMILY_UNIX   = 0x3
+
+	TRANSPORT_UNSPEC = 0x0
+	TRANSPORT_STREAM = 0x1
+	TRANSPORT_DGRAM  = 0x2
+)
+
+// Length of the addresses for each v2 family (any more is TLVs, ignored)
+var ADDRESS_LENGTHS = map[byte]int{FAMILY_INET: 12, FAMILY_INET6: 36, FAMILY_UNIX: 216}
+
+// readV2 reads a v2 (binary) header, after the signature
+func readV2(r *bufio.Reader) (Header, error) {
+	var fixed [4]byte // version/command, family/transport, length
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return Header{}, unexpected(err)
+	}
+	if fixed[0]>>4 != 2 {
+		return Header{}, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, fixed[0]>>4)
+	}
+	command := Command(fixed[0] & 0xf)
+	if command != LOCAL && command != PROXY {
+		return Header{}, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, command)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Header{}, unexpected(err)
+	}
+
+	header := Header{Version: 2, Command: command}
+	family, transport := fixed[1]>>4, fixed[1]&0xf
+
+	// (Addresses are ignored for LOCAL, and unsupported families)
+	length, ok := ADDRESS_LENGTHS[family]
+	if command == LOCAL || !ok || (transport != TRANSPORT_STREAM && transport != TRANSPORT_DGRAM) {
+		return header, nil
+	}
+	if len(body) < length {
+		return Header{}, fmt.Errorf("%w: %d bytes is too short for the addresses", ErrInvalidHeader, len(body))
+	}
+
+	switch family {
+	case FAMILY_INET, FAMILY_INET6:
+		size := (length - 4) / 2
+		ports := body[2*size:]
+		header.Source = ipAddr(transport, body[:size], binary.BigEndian.Uint16(ports))
+		header.Destination = ipAddr(transport, body[size:2*size], binary.BigEndian.Uint16(ports[2:]))
+	case FAMILY_UNIX:
+		network := map[byte]string{TRANSPORT_STREAM: "unix", TRANSPORT_DGRAM: "unixgram"}[transport]
+		header.Source = &net.UnixAddr{Name: nulTerminated(body[:108]), Net: network}
+		header.Destination = &net.UnixAddr{Name: nulTerminated(body[108:216]), Net: network}
+	}
+	return header, nil
+}
+
+// ipAddr returns a TCP (stream) or UDP (datagram) address
+func ipAddr(transport byte, b []byte, port uint16) net.Addr {
+	ip := net.IP(b).To16() // (a copy, in the same form as net.ParseIP)
+	if transport == TRANSPORT_DGRAM {
+		return &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+// nulTerminated returns the string up to the first NUL byte
+func nulTerminated(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// unexpected turns EOF part way through a header into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//
+// === FORMATTING === //
+//
+
+// Format encodes the header as version 1 or 2. Addresses that can't be
+// represented (e.g. a unix socket in v1) are sent as unknown.
+func (h Header) Format(version int) ([]byte, error) {
+	switch version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2(), nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+}
+
+func (h Header) formatV1() []byte {
+	source, sourceOK := h.Source.(*net.TCPAddr)
+	destination, destinationOK := h.Destination.(*net.TCPAddr)
+	if h.Command == LOCAL || !sourceOK || !destinationOK {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	// (Both addresses must be the same family, so mixed pairs use TCP6)
+	protocol := "TCP6"
+	sourceIP, destinationIP := ipv6String(source.IP), ipv6String(destination.IP)
+	if source.IP.To4() != nil && destination.IP.To4() != nil {
+		protocol = "TCP4"
+		sourceIP, destinationIP = source.IP.String(), destination.IP.String()
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		protocol, sourceIP, destinationIP, source.Port, destination.Port))
+}
+
+// ipv6String formats an IP in IPv6 form (even if it's an IPv4 address)
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h Header) formatV2() []byte {
+	var body []byte
+	family, transport := byte(FAMILY_UNSPEC), byte(TRANSPORT_UNSPEC)
+
+	if h.Command == PROXY {
+		switch source := h.Source.(type) {
+		case *net.TCPAddr:
+			if destination, ok := h.Destination.(*net.TCPAddr); ok {
+				family, body = ipV2(source.IP, destination.IP, source.Port, destination.Port)
+				transport = TRANSPORT_STREAM
+			}
+		case *net.UDPAddr:
+			if destination, ok := h.Destination.(*net.UDPAddr); ok {
+				family, body = ipV2(source.IP, destination.IP, source.Port, destination.Port)
+				transport = TRANSPORT_DGRAM
+			}
+		case *net.UnixAddr:
+			if destination, ok := h.Destination.(*net.UnixAddr); ok && len(source.Name) <= 108 && len(destination.Name) <= 108 {
+				family, transport = FAMILY_UNIX, TRANSPORT_STREAM
+				if source.Net == "unixgram" {
+					transport = TRANSPORT_DGRAM
+				}
+				body = make([]byte, 216)
+				copy(body, source.Name)
+				copy(body[108:], destination.Name)
+			}
+		}
+	}
+
+	header := make([]byte, 0, len(V2_SIGNATURE)+4+len(body))
+	header = append(header, V2_SIGNATURE...)
+	header = append(header, 0x20|byte(h.Command), family<<4|transport)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+// ipV2 encodes a pair of IP addresses and ports, returning the family
+func ipV2(sourceIP, destinationIP net.IP, sourcePort, destinationPort int) (byte, []byte) {
+	family := byte(FAMILY_INET6)
+	source, destination := sourceIP.To16(), destinationIP.To16()
+	if sourceIP.To4() != nil && destinationIP.To4() != nil {
+		family = FAMILY_INET
+		source, destination = sourceIP.To4(), destinationIP.To4()
+	}
+
+	body := append(bytes.Clone(source), destination...)
+	body = binary.BigEndian.AppendUint16(body, uint16(sourcePort))
+	body = binary.BigEndian.AppendUint16(body, uint16(destinationPort))
+	return family, body
+}
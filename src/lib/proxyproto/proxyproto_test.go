@@ -0,0 +1,173 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+// v2 decodes a hex v2 header (after the signature)
+func v2(body string) string {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(body, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return V2_SIGNATURE + string(decoded)
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Header
+		err      error
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello",
+			Header{1, PROXY, tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.1", 443)}, nil},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1 65535\r\n",
+			Header{1, PROXY, tcpAddr("2001:db8::1", 1), tcpAddr("2001:db8::2", 65535)}, nil},
+		{"v1 unknown", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n",
+			Header{1, PROXY, nil, nil}, nil},
+		{"v2 tcp4", v2("21 11 000c c0000201 c6336401 dc04 01bb"),
+			Header{2, PROXY, tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.1", 443)}, nil},
+		{"v2 udp6", v2("21 22 0024 20010db8000000000000000000000001 20010db8000000000000000000000002 0035 0036"),
+			Header{2, PROXY, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53},
+				&net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 54}}, nil},
+		{"v2 with TLVs", v2("21 11 0010 c0000201 c6336401 dc04 01bb 04 0001 00"),
+			Header{2, PROXY, tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.1", 443)}, nil},
+		{"v2 local", v2("20 11 000c c0000201 c6336401 dc04 01bb"),
+			Header{2, LOCAL, nil, nil}, nil},
+		{"v2 unspecified", v2("21 00 0000"),
+			Header{2, PROXY, nil, nil}, nil},
+
+		{"no header", "hello\n", Header{}, ErrNoHeader},
+		{"almost v1", "PROXYTCP4", Header{}, ErrNoHeader},
+		{"almost v2", "\r\n\r\nhello", Header{}, ErrNoHeader},
+		{"empty", "", Header{}, io.EOF},
+		{"partial", "PROXY TCP4 192.0.2.1", Header{}, io.ErrUnexpectedEOF},
+		{"partial v2", v2("21 11 000c c0000201"), Header{}, io.ErrUnexpectedEOF},
+
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", Header{}, ErrInvalidHeader},
+		{"v1 bad protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", Header{}, ErrInvalidHeader},
+		{"v1 wrong family", "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", Header{}, ErrInvalidHeader},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", Header{}, ErrInvalidHeader},
+		{"v1 leading zero", "PROXY TCP4 192.0.2.1 198.51.100.1 056324 443\r\n", Header{}, ErrInvalidHeader},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", Header{}, ErrInvalidHeader},
+		{"v2 bad version", v2("11 11 000c c0000201 c6336401 dc04 01bb"), Header{}, ErrInvalidHeader},
+		{"v2 bad command", v2("22 11 000c c0000201 c6336401 dc04 01bb"), Header{}, ErrInvalidHeader},
+		{"v2 short addresses", v2("21 11 0008 c0000201 c6336401"), Header{}, ErrInvalidHeader},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := ReadHeader(bufio.NewReader(strings.NewReader(test.input)))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if !reflect.DeepEqual(header, test.expected) {
+				t.Fatalf("Expected %+v, got %+v", test.expected, header)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	headers := []Header{
+		NewHeader(tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.1", 443)),
+		NewHeader(tcpAddr("2001:db8::1", 1), tcpAddr("2001:db8::2", 65535)),
+		NewHeader(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}, &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 54}),
+		NewHeader(&net.UnixAddr{Name: "/tmp/client", Net: "unix"}, &net.UnixAddr{Name: "/tmp/server", Net: "unix"}),
+		NewHeader(nil, nil),
+		{Command: LOCAL},
+	}
+
+	// Headers survive a round trip, as far as each version allows
+	for _, version := range []int{1, 2} {
+		for _, header := range headers {
+			formatted, err := header.Format(version)
+			if err != nil {
+				t.Fatalf("Failed to format %+v: %v", header, err)
+			}
+			parsed, err := ReadHeader(bufio.NewReader(strings.NewReader(string(formatted))))
+			if err != nil {
+				t.Fatalf("Failed to parse v%d %q: %v", version, formatted, err)
+			}
+
+			expected := header
+			expected.Version = version
+			if _, ok := header.Source.(*net.TCPAddr); version == 1 && !ok {
+				// (v1 only has TCP addresses, anything else is UNKNOWN)
+				expected = Header{Version: 1, Command: PROXY}
+			}
+			if expected.Command == LOCAL && version == 1 {
+				expected.Command = PROXY
+			}
+			if !reflect.DeepEqual(parsed, expected) {
+				t.Fatalf("Expected v%d %q to parse as %+v, got %+v", version, formatted, expected, parsed)
+			}
+		}
+	}
+
+	// Mixed families are sent as IPv6
+	mixed := NewHeader(tcpAddr("192.0.2.1", 1), tcpAddr("2001:db8::2", 2))
+	if formatted, _ := mixed.Format(1); string(formatted) != "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 1 2\r\n" {
+		t.Fatalf("Expected a TCP6 header, got %q", formatted)
+	}
+
+	if _, err := headers[0].Format(3); err == nil {
+		t.Fatalf("Expected error for an unsupported version")
+	}
+}
+
+func TestAccept(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		header, _ := NewHeader(tcpAddr("192.0.2.1", 56324), tcpAddr("198.51.100.1", 443)).Format(2)
+		_, _ = client.Write(append(header, "hello"...))
+		_, _ = client.Write([]byte(" world"))
+	}()
+
+	conn, err := Accept(server, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Fatalf("Expected the client's address, got %s", addr)
+	}
+	if addr := conn.LocalAddr().String(); addr != "198.51.100.1:443" {
+		t.Fatalf("Expected the proxy's destination address, got %s", addr)
+	}
+
+	// Data after the header is still read (including anything buffered)
+	data := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected data after the header, got %q (%v)", data, err)
+	}
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// (A partial header, then nothing)
+	go func() { _, _ = client.Write([]byte("PROXY TCP4")) }()
+
+	if _, err := Accept(server, 50*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+}
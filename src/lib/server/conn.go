@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Default timeouts for accepted connections (see Timeouts)
+const DEFAULT_IDLE_TIMEOUT = 5 * time.Minute
+const DEFAULT_WRITE_TIMEOUT = 30 * time.Second
+
+// Errors returned by a connection's Read/Write when a deadline fires.
+// They wrap os.ErrDeadlineExceeded, see IsTimeout.
+var (
+	ErrIdleTimeout    = errors.New("idle timeout")
+	ErrSessionTimeout = errors.New("session time limit reached")
+	ErrWriteTimeout   = errors.New("write timeout")
+	ErrShuttingDown   = errors.New("server shutting down")
+)
+
+// Timeouts limit how long a connection can go without sending anything
+// (Idle), how long it can stay connected in total (Session), and how long a
+// single write can block (Write). 0 means no limit.
+//
+// Reads past the session limit fail, but writes are still allowed, so
+// handlers can say goodbye (e.g. prime-time sends a malformed response).
+type Timeouts struct {
+	Idle    time.Duration
+	Session time.Duration
+	Write   time.Duration
+}
+
+// Timeouts from the command line, unless changed (see RegisterFlags)
+var DEFAULT_TIMEOUTS = Timeouts{
+	Idle:  DEFAULT_IDLE_TIMEOUT,
+	Write: DEFAULT_WRITE_TIMEOUT,
+}
+
+// registerTimeoutFlags adds -idle-timeout, -session-timeout and
+// -write-timeout flags to the flag set, returning the timeouts they populate
+func registerTimeoutFlags(fs *flag.FlagSet) *Timeouts {
+	timeouts := DEFAULT_TIMEOUTS
+	fs.DurationVar(&timeouts.Idle, "idle-timeout", timeouts.Idle,
+		"disconnect clients that send nothing for this long (0 for no limit)")
+	fs.DurationVar(&timeouts.Session, "session-timeout", timeouts.Session,
+		"disconnect clients after this long in total (0 for no limit)")
+	fs.DurationVar(&timeouts.Write, "write-timeout", timeouts.Write,
+		"disconnect clients that don't accept writes for this long (0 for no limit)")
+	return &timeouts
+}
+
+// IsTimeout reports whether a read or write failed because the client was
+// idle, ran out of session time or stopped accepting writes (as opposed to
+// disconnecting, or the server shutting down)
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrIdleTimeout) ||
+		errors.Is(err, ErrSessionTimeout) ||
+		errors.Is(err, ErrWriteTimeout)
+}
+
+// LogReadError logs why a connection's read loop ended: timeouts at info
+// level, anything unexpected as a warning (EOF and shutdown aren't logged)
+func LogReadError(log *slog.Logger, err error) {
+	switch {
+	case err == io.EOF, errors.Is(err, ErrShuttingDown):
+		return
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		log.Debug("disconnected part way through a message", "error", err)
+	case IsTimeout(err):
+		log.Info("timed out", "reason", err)
+	default:
+		log.Warn("read error", "error", err)
+	}
+}
+
+// conn wraps each accepted connection, applying Timeouts before every
+// read and write, counting bytes for metrics, and failing reads with
+// ErrShuttingDown once the server is draining
+type conn struct {
+	net.Conn
+	problem    string
+	timeouts   Timeouts
+	sessionEnd time.Time // zero for no session limit
+	release    func()    // frees the connection's place in the limiter
+
+	mu       sync.Mutex // guards draining, and setting the read deadline
+	draining bool
+}
+
+func newConn(c net.Conn, problem string, timeouts Timeouts) *conn {
+	wrapped := &conn{Conn: c, problem: problem, timeouts: timeouts}
+	if timeouts.Session > 0 {
+		wrapped.sessionEnd = time.Now().Add(timeouts.Session)
+	}
+	return wrapped
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.draining {
+		if deadline, ok := c.readDeadline(); ok {
+			_ = c.Conn.SetReadDeadline(deadline)
+		}
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		BytesReceived.Add(float64(n), c.problem)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = c.readTimeoutError(err)
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.timeouts.Write > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(c.timeouts.Write))
+	}
+
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		BytesSent.Add(float64(n), c.problem)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && c.timeouts.Write > 0 {
+		err = fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	}
+	return n, err
+}
+
+// CloseWrite shuts down the sending side of the connection (e.g. once a
+// half-closed client has had everything echoed back), leaving reads open.
+// Connections that can't half-close return errors.ErrUnsupported.
+func (c *conn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// readDeadline returns the deadline for the next read (the sooner of
+// the idle and session limits), or false if there are no limits
+func (c *conn) readDeadline() (time.Time, bool) {
+	deadline := c.sessionEnd
+	if c.timeouts.Idle > 0 {
+		idle := time.Now().Add(c.timeouts.Idle)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// readTimeoutError explains why a read deadline fired
+func (c *conn) readTimeoutError(err error) error {
+	c.mu.Lock()
+	draining := c.draining
+	c.mu.Unlock()
+
+	var reason error
+	switch {
+	case draining:
+		reason = ErrShuttingDown
+	case !c.sessionEnd.IsZero() && !time.Now().Before(c.sessionEnd):
+		reason = ErrSessionTimeout
+	case c.timeouts.Idle > 0:
+		reason = ErrIdleTimeout
+	default:
+		// (A deadline set by the handler itself)
+		return err
+	}
+	return fmt.Errorf("%w: %w", reason, err)
+}
+
+// drain interrupts any pending read, and fails all future reads, so the
+// handler finishes its current request and returns (writes still work)
+func (c *conn) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = true
+	_ = c.Conn.SetReadDeadline(time.Now())
+}
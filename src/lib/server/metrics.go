@@ -0,0 +1,44 @@
+package server
+
+import (
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/metrics"
+)
+
+// Metrics shared by every problem, labelled with problem=Config.Name.
+// The UDP server (04) records bytes and request latency here too.
+
+// Buckets for connection durations (seconds), connections are long-lived
+var CONNECTION_BUCKETS = []float64{0.01, 0.1, 1, 10, 60, 300, 1800}
+
+var (
+	ConnectionsTotal = metrics.NewCounter("protohackers_connections_total",
+		"Connections accepted", "problem")
+	ActiveConnections = metrics.NewGauge("protohackers_active_connections",
+		"Currently open connections", "problem")
+	ConnectionDuration = metrics.NewHistogram("protohackers_connection_duration_seconds",
+		"Time from accepting a connection until its handler returns", CONNECTION_BUCKETS, "problem")
+
+	BytesReceived = metrics.NewCounter("protohackers_received_bytes_total",
+		"Bytes read from clients", "problem")
+	BytesSent = metrics.NewCounter("protohackers_sent_bytes_total",
+		"Bytes written to clients", "problem")
+
+	// Observed by each problem, per request (line, frame, packet, ...)
+	RequestDuration = metrics.NewHistogram("protohackers_request_duration_seconds",
+		"Time taken to handle a single request", nil, "problem")
+)
+
+// opened records a newly accepted connection, returning a func to call
+// once it has been closed
+func opened(problem string) func() {
+	start := time.Now()
+	ConnectionsTotal.Inc(problem)
+	ActiveConnections.Inc(problem)
+
+	return func() {
+		ActiveConnections.Dec(problem)
+		ConnectionDuration.Since(start, problem)
+	}
+}
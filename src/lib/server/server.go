@@ -0,0 +1,484 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/limiter"
+	"github.com/finwarman/protohackers/src/lib/proxyproto"
+)
+
+// A shared TCP server for the protohackers problems.
+//
+// Each problem only needs to provide a Handler, the server takes care of
+// listening (optionally with TLS), accepting (with backoff on temporary errors), limiting the
+// number of concurrent connections, reading PROXY protocol headers (see
+// lib/proxyproto), rejecting clients over the per-IP
+// limits (see lib/limiter), applying per-connection timeouts (see conn.go),
+// recovering from handler panics, draining connections on
+// shutdown and recording metrics (see metrics.go).
+
+// Backoff limits for temporary accept errors (e.g. too many open files)
+const MIN_ACCEPT_BACKOFF = 5 * time.Millisecond
+const MAX_ACCEPT_BACKOFF = 1 * time.Second
+
+// How long to wait for handlers to finish on shutdown, before force-closing
+const DEFAULT_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// How long Config.Reject has to tell a rejected client why
+const REJECT_TIMEOUT = time.Second
+
+// Handler handles a single accepted connection.
+// The connection is closed by the server once HandleConnection returns.
+type Handler interface {
+	HandleConnection(conn net.Conn)
+}
+
+// ShutdownNotifier can be implemented by a Handler to tell its connected
+// clients that the server is going away (e.g. a chat system message).
+// NotifyShutdown is called once, after the server stops accepting.
+type ShutdownNotifier interface {
+	NotifyShutdown()
+}
+
+// Handlers implementing io.Closer are closed once the server has stopped,
+// after every connection has finished (e.g. to close files they share).
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(conn net.Conn)
+
+// HandleConnection calls f(conn)
+func (f HandlerFunc) HandleConnection(conn net.Conn) {
+	f(conn)
+}
+
+// Networks a server can listen on (see Config.Network)
+const NETWORK_TCP = "tcp"
+const NETWORK_UNIX = "unix"
+
+// Config holds the server settings
+type Config struct {
+	Name            string        // Problem name, used to label metrics
+	Network         string        // NETWORK_TCP (the default) or NETWORK_UNIX
+	Host            string        // Address to bind to, empty for all interfaces
+	Port            int           // TCP port to listen on, 0 picks a free port
+	SocketPath      string        // Unix socket to listen on (NETWORK_UNIX only)
+	MaxConnections  int           // Maximum concurrent connections, 0 for no limit
+	ShutdownTimeout time.Duration // Time allowed for draining, 0 for the default
+	Logger          *slog.Logger  // Server log messages, nil for the default logger
+
+	// Timeouts, limits, TLS and PROXY protocol (all off if unset)
+	Settings
+
+	// Reject is called for connections refused by the limiter, before they're
+	// closed, e.g. to send a protocol-appropriate error. nil closes silently.
+	Reject func(conn net.Conn, err error)
+}
+
+// Address returns the listen address in host:port form
+// (or the socket path, for unix sockets)
+func (c Config) Address() string {
+	if c.Network == NETWORK_UNIX {
+		return c.SocketPath
+	}
+	return net.JoinHostPort(c.Host, fmt.Sprintf("%d", c.Port))
+}
+
+// Server accepts connections and dispatches them to a Handler
+type Server struct {
+	config   Config
+	handler  Handler
+	listener net.Listener
+	limiter  *limiter.Limiter
+
+	slots chan struct{} // connection slots, nil if unlimited
+
+	mu       sync.Mutex
+	conns    map[*conn]struct{} // active connections
+	draining bool               // set once shutdown starts draining
+	wg       sync.WaitGroup     // accepted connections, until their handler returns
+
+	serving   atomic.Bool
+	served    chan struct{} // closed once Serve returns
+	closing   chan struct{} // closed by Close
+	closeOnce sync.Once
+
+	handlerClosed sync.Once // see closeHandler
+}
+
+// Listen creates a new Server, listening on the configured address.
+// The listener is bound straight away, so Addr reports the actual address
+// (e.g. when using port 0), but no connections are accepted until Serve.
+func Listen(config Config, handler Handler) (*Server, error) {
+	switch config.Network {
+	case "":
+		config.Network = NETWORK_TCP
+	case NETWORK_TCP:
+	case NETWORK_UNIX:
+		if err := removeStaleSocket(config.SocketPath); err != nil {
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("listen: unsupported network %q", config.Network)
+	}
+
+	ln, err := net.Listen(config.Network, config.Address())
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	config.Logger.Info("listening", "protocol", config.Network, "addr", ln.Addr().String(), "tls", config.TLS != nil,
+		"proxy_protocol", config.ProxyProtocol.Enabled)
+
+	s := &Server{
+		config:   config,
+		handler:  handler,
+		listener: ln,
+		conns:    make(map[*conn]struct{}),
+		served:   make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	if s.config.ShutdownTimeout <= 0 {
+		s.config.ShutdownTimeout = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	s.limiter = limiter.New(config.Name, s.config.Limits)
+
+	if config.MaxConnections > 0 {
+		s.slots = make(chan struct{}, config.MaxConnections)
+	}
+	return s, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server, as if the context passed to Serve was cancelled,
+// and waits for active connections to drain.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+
+	if s.serving.Load() {
+		<-s.served
+		return nil
+	}
+
+	// Not serving (yet), just release the listener (and the handler)
+	return errors.Join(s.listener.Close(), s.closeHandler())
+}
+
+// closeHandler closes the handler (only once), if it's an io.Closer
+func (s *Server) closeHandler() (err error) {
+	closer, ok := s.handler.(io.Closer)
+	if !ok {
+		return nil
+	}
+	s.handlerClosed.Do(func() {
+		if err = closer.Close(); err != nil {
+			s.config.Logger.Warn("failed to close handler", "error", err)
+		}
+	})
+	return err
+}
+
+// Serve accepts connections until the context is cancelled (or Close is
+// called), creating a goroutine with the handler for each new connection.
+// The listener is closed when Serve returns, and Serve only returns once
+// every connection handler has finished (see shutdown).
+func (s *Server) Serve(ctx context.Context) error {
+	if !s.serving.CompareAndSwap(false, true) {
+		return errors.New("server: already serving")
+	}
+	defer close(s.served)
+
+	ln := s.listener
+	defer s.closeHandler()
+	defer s.shutdown()
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Treat Close the same as cancelling the context
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Stop blocking in Accept once the context is cancelled
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	backoff := time.Duration(0)
+	for {
+		// Wait for a free connection slot before accepting
+		if !s.acquire(ctx) {
+			return nil
+		}
+
+		accepted, err := ln.Accept()
+		if err != nil {
+			s.release()
+
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !isTemporary(err) {
+				return fmt.Errorf("accept: %w", err)
+			}
+
+			// Back off on temporary errors, rather than spinning
+			if backoff == 0 {
+				backoff = MIN_ACCEPT_BACKOFF
+			} else {
+				backoff = min(backoff*2, MAX_ACCEPT_BACKOFF)
+			}
+			s.config.Logger.Warn("accept error", "error", err, "retry_in", backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		backoff = 0
+
+		// (Waiting for a PROXY header happens off the accept loop)
+		s.wg.Add(1)
+		go s.admit(ctx, accepted)
+	}
+}
+
+// admit sets up an accepted connection and runs its handler: reading the
+// PROXY protocol header (if enabled), so the real client address is used
+// from then on, turning away clients over the limits, and starting TLS
+func (s *Server) admit(ctx context.Context, accepted net.Conn) {
+	var c net.Conn = accepted
+
+	if s.config.ProxyProtocol.Enabled {
+		// (Stop waiting for the header on shutdown)
+		stop := context.AfterFunc(ctx, func() { _ = accepted.SetReadDeadline(time.Now()) })
+		proxied, err := proxyproto.Accept(accepted, s.config.ProxyProtocol.Timeout)
+		stop()
+		if err != nil {
+			s.config.Logger.Info("invalid proxy protocol header", "remote_addr", accepted.RemoteAddr().String(),
+				"error", err)
+			accepted.Close()
+			s.dismiss()
+			return
+		}
+		c = proxied
+	}
+
+	// (The handshake happens on the first read or write, in the handler)
+	if s.config.TLS != nil {
+		c = tls.Server(c, s.config.TLS)
+	}
+
+	s.config.Logger.Info("connection from", "remote_addr", c.RemoteAddr().String())
+
+	// Turn away clients over the per-IP (or overall) limits
+	release, err := s.limiter.Acquire(c.RemoteAddr())
+	if err != nil {
+		s.config.Logger.Info("rejected connection", "remote_addr", c.RemoteAddr().String(),
+			"reason", err)
+		s.reject(c, err)
+		s.dismiss()
+		return
+	}
+
+	// (Apply timeouts, and count bytes in and out)
+	conn := newConn(c, s.config.Name, s.config.Timeouts)
+	conn.release = release
+
+	s.track(conn)
+	s.handle(conn)
+}
+
+// shutdown drains active connections once the server stops accepting:
+//   - Handlers implementing ShutdownNotifier are told to notify clients
+//   - Pending reads are interrupted (failing with ErrShuttingDown), so
+//     handlers finish their current request and return (writes still work)
+//   - After ShutdownTimeout, any remaining connections are force-closed
+func (s *Server) shutdown() {
+	deadline := time.NewTimer(s.config.ShutdownTimeout)
+	defer deadline.Stop()
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	if notifier, ok := s.handler.(ShutdownNotifier); ok {
+		notified := make(chan struct{})
+		go func() {
+			notifier.NotifyShutdown()
+			close(notified)
+		}()
+
+		select {
+		case <-notified:
+		case <-deadline.C:
+			s.closeAll()
+			<-drained
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.draining = true
+	active := len(s.conns)
+	for conn := range s.conns {
+		conn.drain()
+	}
+	s.mu.Unlock()
+
+	if active > 0 {
+		s.config.Logger.Info("draining connections", "active", active)
+	}
+
+	select {
+	case <-drained:
+	case <-deadline.C:
+		s.closeAll()
+		<-drained
+	}
+}
+
+// closeAll force-closes all active connections
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.config.Logger.Warn("force-closing connections", "active", len(s.conns))
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// track registers an admitted connection as active (draining it straight
+// away if shutdown has already started)
+func (s *Server) track(conn *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = struct{}{}
+	if s.draining {
+		conn.drain()
+	}
+}
+
+// untrack removes a connection once its handler has returned
+func (s *Server) untrack(conn *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// handle runs the handler for a connection, recovering from any panic
+// so that one misbehaving client can't take down the whole server.
+func (s *Server) handle(conn *conn) {
+	defer s.release()
+	defer s.untrack(conn)
+	defer opened(s.config.Name)()
+	defer conn.release()
+	defer conn.Close()
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.config.Logger.Error("panic in handler", "remote_addr", conn.RemoteAddr().String(),
+				"panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	s.handler.HandleConnection(conn)
+}
+
+// dismiss releases an accepted connection that was never handled
+func (s *Server) dismiss() {
+	s.wg.Done()
+	s.release()
+}
+
+// reject closes a connection refused by the limiter, after letting
+// Config.Reject tell the client why (within REJECT_TIMEOUT)
+func (s *Server) reject(conn net.Conn, err error) {
+	defer conn.Close()
+
+	if s.config.Reject != nil {
+		_ = conn.SetDeadline(time.Now().Add(REJECT_TIMEOUT))
+		s.config.Reject(conn, err)
+	}
+}
+
+// acquire takes a connection slot, returning false if the context
+// was cancelled while waiting.
+func (s *Server) acquire(ctx context.Context) bool {
+	if s.slots == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a connection slot
+func (s *Server) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// removeStaleSocket removes a unix socket left behind by a previous run
+// (listeners remove their socket on Close, but not if the process dies),
+// so long as nothing is still listening on it
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		// (Anything else is left for Listen to complain about)
+		return nil
+	}
+	if conn, err := net.Dial(NETWORK_UNIX, path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// isTemporary reports whether an accept error is worth retrying
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// NotifyContext returns a context that is cancelled on SIGINT or SIGTERM,
+// for use as the lifetime of a server.
+func NotifyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+}
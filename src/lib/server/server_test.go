@@ -0,0 +1,711 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/finwarman/protohackers/src/lib/limiter"
+	"github.com/finwarman/protohackers/src/lib/proxyproto"
+	"github.com/finwarman/protohackers/src/lib/tlsutil"
+)
+
+// startTestServer serves the handler on a free localhost port,
+// returning the address to dial and a func to stop the server
+func startTestServer(t *testing.T, config Config, handler Handler) (string, func() error) {
+	config.Host = "localhost"
+
+	srv, err := Listen(config, handler)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(context.Background())
+	}()
+
+	stop := func() error {
+		if err := srv.Close(); err != nil {
+			return err
+		}
+		return <-done
+	}
+	return srv.Addr().String(), stop
+}
+
+// checkGoroutines fails the test if the number of goroutines doesn't
+// return to the baseline (allowing a moment for them to exit)
+func checkGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("Leaked goroutines: have %d, expected %d\n%s",
+				runtime.NumGoroutine(), baseline, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEchoHandler(t *testing.T) {
+	addr, stop := startTestServer(t, Config{}, HandlerFunc(func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	message := "Hello, server!\n"
+	if _, err := io.WriteString(conn, message); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read from connection: %v", err)
+	}
+	if response != message {
+		t.Fatalf("Expected '%s', got '%s'", message, response)
+	}
+
+	// Cancelling the context stops the server cleanly
+	if err := stop(); err != nil {
+		t.Fatalf("Expected nil error on shutdown, got %v", err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	srv, err := Listen(Config{Host: "localhost"}, HandlerFunc(func(conn net.Conn) {}))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ctx)
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected nil error on cancel, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after context was cancelled")
+	}
+
+	// Listener is released once stopped
+	if _, err := net.Dial("tcp", srv.Addr().String()); err == nil {
+		t.Fatalf("Expected connection refused after shutdown")
+	}
+
+	// Close after stopping is a no-op
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Expected nil error from Close, got %v", err)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	addr, stop := startTestServer(t, Config{}, HandlerFunc(func(conn net.Conn) {
+		panic("handler panic")
+	}))
+	defer stop()
+
+	// Connection is closed after the panic, and the server keeps serving
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected EOF after handler panic, got %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	release := make(chan struct{})
+	addr, stop := startTestServer(t, Config{MaxConnections: 1}, HandlerFunc(func(conn net.Conn) {
+		_, _ = conn.Write([]byte("hello\n"))
+		<-release
+	}))
+	defer stop()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer first.Close()
+
+	if _, err := bufio.NewReader(first).ReadString('\n'); err != nil {
+		t.Fatalf("Expected greeting on first connection, got %v", err)
+	}
+
+	// Second connection waits in the backlog until a slot is free
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer second.Close()
+
+	secondReader := bufio.NewReader(second)
+	_ = second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := secondReader.ReadString('\n'); err == nil {
+		t.Fatalf("Expected second connection to wait for a free slot")
+	}
+
+	// Free the slot, second connection should now be handled
+	close(release)
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := secondReader.ReadString('\n'); err != nil {
+		t.Fatalf("Expected greeting on second connection, got %v", err)
+	}
+}
+
+// lineHandler echoes lines, and sends a goodbye message on shutdown
+type lineHandler struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+
+	closed      int // times Close was called
+	openAtClose int // connections still being handled then
+}
+
+func (h *lineHandler) HandleConnection(conn net.Conn) {
+	h.mu.Lock()
+	h.conns[conn] = true
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.conns, conn)
+		h.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, line); err != nil {
+			return
+		}
+	}
+}
+
+func (h *lineHandler) NotifyShutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for conn := range h.conns {
+		_, _ = io.WriteString(conn, "goodbye\n")
+	}
+}
+
+func (h *lineHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed++
+	h.openAtClose = len(h.conns)
+	return nil
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	handler := &lineHandler{conns: make(map[net.Conn]bool)}
+	addr, stop := startTestServer(t, Config{}, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// Make sure the connection is being handled before shutting down
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "ping\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("Expected 'ping', got '%s' (%v)", line, err)
+	}
+
+	start := time.Now()
+	if err := stop(); err != nil {
+		t.Fatalf("Expected nil error on shutdown, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected connections to drain quickly, took %v", elapsed)
+	}
+
+	// Client is told about the shutdown, then disconnected
+	if line, err := reader.ReadString('\n'); err != nil || line != "goodbye\n" {
+		t.Fatalf("Expected 'goodbye', got '%s' (%v)", line, err)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected EOF after shutdown, got %v", err)
+	}
+
+	// The handler is closed once, after its connections have finished
+	if handler.closed != 1 || handler.openAtClose != 0 {
+		t.Fatalf("Expected the handler to be closed once with no connections, got %d times with %d",
+			handler.closed, handler.openAtClose)
+	}
+
+	conn.Close()
+	checkGoroutines(t, baseline)
+}
+
+func TestForceCloseAfterTimeout(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	// Handler ignores read deadlines, so must be force-closed
+	config := Config{ShutdownTimeout: 100 * time.Millisecond}
+	addr, stop := startTestServer(t, config, HandlerFunc(func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for {
+			_, err := conn.Read(buf)
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+		}
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// Give the server a moment to accept the connection
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := stop(); err != nil {
+		t.Fatalf("Expected nil error on shutdown, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < config.ShutdownTimeout {
+		t.Fatalf("Expected shutdown to wait for the timeout, took %v", elapsed)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected EOF after force-close, got %v", err)
+	}
+
+	conn.Close()
+	checkGoroutines(t, baseline)
+}
+
+func TestMetrics(t *testing.T) {
+	const name = "test-metrics"
+
+	// (The metrics are shared by every run, so compare against before)
+	active, in, out := ActiveConnections.Value(name), BytesReceived.Value(name), BytesSent.Value(name)
+	durations, total := ConnectionDuration.Count(name), ConnectionsTotal.Value(name)
+
+	release := make(chan struct{})
+	addr, stop := startTestServer(t, Config{Name: name}, HandlerFunc(func(conn net.Conn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = io.WriteString(conn, line+line)
+		<-release
+	}))
+	defer stop()
+
+	// (Deferred after stop, so it runs first, and a failure can't leave the
+	// handler blocked)
+	releaseHandler := sync.OnceFunc(func() { close(release) })
+	defer releaseHandler()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// 6 bytes in, 12 bytes out
+	_, _ = io.WriteString(conn, "hello\n")
+	if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	if delta := ActiveConnections.Value(name) - active; delta != 1 {
+		t.Fatalf("Expected 1 more active connection, got %v", delta)
+	}
+	if deltaIn, deltaOut := BytesReceived.Value(name)-in, BytesSent.Value(name)-out; deltaIn != 6 || deltaOut != 12 {
+		t.Fatalf("Expected 6 more bytes in and 12 out, got %v and %v", deltaIn, deltaOut)
+	}
+
+	releaseHandler()
+
+	// Recorded once the handler returns
+	deadline := time.Now().Add(time.Second)
+	for ConnectionDuration.Count(name) != durations+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection duration not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if delta := ActiveConnections.Value(name) - active; delta != 0 {
+		t.Fatalf("Expected no more active connections, got %v", delta)
+	}
+	if delta := ConnectionsTotal.Value(name) - total; delta != 1 {
+		t.Fatalf("Expected 1 more connection in total, got %v", delta)
+	}
+}
+
+// timeoutHandler echoes lines, and says why it stopped reading
+type timeoutHandler struct {
+	errs chan error
+}
+
+func (h *timeoutHandler) HandleConnection(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			h.errs <- err
+			if IsTimeout(err) {
+				_, _ = io.WriteString(conn, "goodbye\n")
+			}
+			return
+		}
+		_, _ = io.WriteString(conn, line)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	handler := &timeoutHandler{errs: make(chan error, 1)}
+	timeouts := Timeouts{Idle: 100 * time.Millisecond}
+
+	addr, stop := startTestServer(t, Config{Settings: Settings{Timeouts: timeouts}}, handler)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Activity resets the idle timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(conn, "ping\n")
+		if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+			t.Fatalf("Expected echo before idle timeout, got %q (%v)", line, err)
+		}
+	}
+
+	// Then going quiet times out, with a goodbye
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || line != "goodbye\n" {
+		t.Fatalf("Expected goodbye after idle timeout, got %q (%v)", line, err)
+	}
+	if err := <-handler.errs; !errors.Is(err, ErrIdleTimeout) || !IsTimeout(err) {
+		t.Fatalf("Expected idle timeout error, got %v", err)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	handler := &timeoutHandler{errs: make(chan error, 1)}
+	timeouts := Timeouts{Idle: time.Second, Session: 150 * time.Millisecond}
+
+	addr, stop := startTestServer(t, Config{Settings: Settings{Timeouts: timeouts}}, handler)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// Keep busy, until disconnected
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	start := time.Now()
+	for {
+		_, _ = io.WriteString(conn, "ping\n")
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected goodbye before disconnect, got %v", err)
+		}
+		if line == "goodbye\n" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected session timeout, not idle timeout (after %v)", elapsed)
+	}
+	if err := <-handler.errs; !errors.Is(err, ErrSessionTimeout) {
+		t.Fatalf("Expected session timeout error, got %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	timeouts := Timeouts{Write: 100 * time.Millisecond}
+
+	addr, stop := startTestServer(t, Config{Settings: Settings{Timeouts: timeouts}}, HandlerFunc(func(conn net.Conn) {
+		// Write far more than the socket buffers hold, to a client that never reads
+		_, err := conn.Write(make([]byte, 64<<20))
+		errs <- err
+	}))
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrWriteTimeout) {
+			t.Fatalf("Expected write timeout error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Write did not time out")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	config := Config{
+		Name:     "test-limits",
+		Settings: Settings{Limits: limiter.Config{MaxPerIP: 1}},
+		Reject: func(conn net.Conn, err error) {
+			_, _ = io.WriteString(conn, "rejected: "+err.Error()+"\n")
+		},
+	}
+	addr, stop := startTestServer(t, config, HandlerFunc(func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	}))
+	defer stop()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer first.Close()
+
+	// (Make sure the first connection has been accepted)
+	_, _ = io.WriteString(first, "hello\n")
+	if _, err := bufio.NewReader(first).ReadString('\n'); err != nil {
+		t.Fatalf("Failed to read from connection: %v", err)
+	}
+
+	// A second connection from the same IP is turned away
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer second.Close()
+
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := io.ReadAll(second)
+	if err != nil {
+		t.Fatalf("Failed to read rejection: %v", err)
+	}
+	if expected := "rejected: " + limiter.ErrTooManyFromIP.Error() + "\n"; string(response) != expected {
+		t.Fatalf("Expected '%s', got '%s'", expected, response)
+	}
+
+	// Once the first disconnects, there's room again
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for ActiveConnections.Value("test-limits") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("First connection not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	third, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer third.Close()
+
+	_, _ = io.WriteString(third, "hello again\n")
+	_ = third.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(third).ReadString('\n'); err != nil || line != "hello again\n" {
+		t.Fatalf("Expected echo after first disconnected, got %q (%v)", line, err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca, err := tlsutil.NewCA("test CA")
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, err := ca.Issue("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+
+	config := Config{Settings: Settings{TLS: &tls.Config{Certificates: []tls.Certificate{cert}}}}
+	addr, stop := startTestServer(t, config, HandlerFunc(func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	}))
+	defer stop()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.CertPool()})
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	message := "Hello, TLS!\n"
+	_, _ = io.WriteString(conn, message)
+	if response, err := bufio.NewReader(conn).ReadString('\n'); err != nil || response != message {
+		t.Fatalf("Expected '%s', got '%s' (%v)", message, response, err)
+	}
+
+	// Plain TCP clients don't get an echo
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer plain.Close()
+
+	_, _ = io.WriteString(plain, message)
+	_ = plain.SetReadDeadline(time.Now().Add(time.Second))
+	if response, _ := bufio.NewReader(plain).ReadString('\n'); response == message {
+		t.Fatalf("Expected no echo without TLS")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	config := Config{
+		Name: "test-proxy-protocol",
+		Settings: Settings{
+			ProxyProtocol: proxyproto.Options{Enabled: true, Timeout: 200 * time.Millisecond},
+			Limits:        limiter.Config{MaxPerIP: 1},
+		},
+	}
+	addr, stop := startTestServer(t, config, HandlerFunc(func(conn net.Conn) {
+		// (Tell the client what address it came from, then echo)
+		_, _ = io.WriteString(conn, conn.RemoteAddr().String()+"\n")
+		_, _ = io.Copy(conn, conn)
+	}))
+	defer stop()
+
+	// dial connects through a "proxy" for the client address
+	dial := func(client string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+		source, _ := net.ResolveTCPAddr("tcp", client)
+		header, _ := proxyproto.NewHeader(source, conn.RemoteAddr()).Format(1)
+		_, _ = conn.Write(header)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	// The handler sees the client's address, not the proxy's
+	alice, reader := dial("192.0.2.1:1234")
+	defer alice.Close()
+	if response, err := reader.ReadString('\n'); err != nil || response != "192.0.2.1:1234\n" {
+		t.Fatalf("Expected the client's address, got '%s' (%v)", response, err)
+	}
+	_, _ = io.WriteString(alice, "hello\n")
+	if response, err := reader.ReadString('\n'); err != nil || response != "hello\n" {
+		t.Fatalf("Expected an echo, got '%s' (%v)", response, err)
+	}
+
+	// Limits apply per client, so other clients (via the same proxy) get in
+	bob, reader := dial("192.0.2.2:1234")
+	defer bob.Close()
+	if response, err := reader.ReadString('\n'); err != nil || response != "192.0.2.2:1234\n" {
+		t.Fatalf("Expected the other client's address, got '%s' (%v)", response, err)
+	}
+
+	// But not the same client twice
+	again, reader := dial("192.0.2.1:5678")
+	defer again.Close()
+	if response, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("Expected the same client to be rejected, got '%s'", response)
+	}
+
+	// Connections without a header are dropped, as are ones too slow to send it
+	for _, prefix := range []string{"hello\n", "PROXY TCP4 192.0.2.3"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+		defer conn.Close()
+
+		_, _ = io.WriteString(conn, prefix)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if response, err := io.ReadAll(conn); err != nil || len(response) != 0 {
+			t.Fatalf("Expected connection starting '%s' to be dropped, got '%s' (%v)", prefix, response, err)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+
+	// A socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := Config{Network: NETWORK_UNIX, SocketPath: path}
+	_, stop := startTestServer(t, config, HandlerFunc(func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	}))
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	message := "Hello, socket!\n"
+	_, _ = io.WriteString(conn, message)
+	if response, err := bufio.NewReader(conn).ReadString('\n'); err != nil || response != message {
+		t.Fatalf("Expected '%s', got '%s' (%v)", message, response, err)
+	}
+	conn.Close()
+
+	// But not one that's still in use
+	if _, err := Listen(config, HandlerFunc(func(conn net.Conn) {})); err == nil {
+		t.Fatalf("Expected error listening on a socket in use")
+	}
+
+	// The socket is removed once the server stops
+	if err := stop(); err != nil {
+		t.Fatalf("Failed to stop server: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected socket to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"crypto/tls"
+	"flag"
+
+	"github.com/finwarman/protohackers/src/lib/limiter"
+	"github.com/finwarman/protohackers/src/lib/proxyproto"
+	"github.com/finwarman/protohackers/src/lib/tlsutil"
+)
+
+// Settings are what the command line chooses for every server in a process
+// (see RegisterFlags), passed to each one explicitly, so a server (or test)
+// can always use its own. The zero value is plain TCP, with no timeouts or
+// limits.
+type Settings struct {
+	Timeouts      Timeouts           // Per-connection timeouts
+	Limits        limiter.Config     // Per-IP limits
+	TLS           *tls.Config        // Serve TLS, nil for plain TCP
+	ProxyProtocol proxyproto.Options // Expect a PROXY protocol header (before any TLS)
+}
+
+// RegisterFlags adds the timeout (-idle-timeout, ...), limiter (see
+// limiter.RegisterFlags), TLS (see tlsutil.RegisterFlags) and
+// -proxy-protocol flags to the flag set, returning a func to get the
+// Settings they describe (after parsing, loading any certificate)
+func RegisterFlags(fs *flag.FlagSet) func() (Settings, error) {
+	timeouts := registerTimeoutFlags(fs)
+	limits := limiter.RegisterFlags(fs)
+	tlsOptions := tlsutil.RegisterFlags(fs)
+	proxyOptions := proxyproto.RegisterFlags(fs)
+
+	return func() (Settings, error) {
+		tlsConfig, err := tlsOptions.ServerConfig()
+		if err != nil {
+			return Settings{}, err
+		}
+		return Settings{Timeouts: *timeouts, Limits: *limits, TLS: tlsConfig, ProxyProtocol: *proxyOptions}, nil
+	}
+}
@@ -0,0 +1,235 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// TLS for the TCP servers (and mob-in-the-middle's upstream connections).
+//
+// Servers use a certificate and key from files (-tls-cert, -tls-key), or
+// generate a self-signed certificate at startup (-tls-self-signed), which
+// is only meant for development. Without either, servers use plain TCP.
+//
+// CA generates certificates in-process, for tests (and self-signed certs).
+
+// How long generated certificates are valid for
+const CERT_VALIDITY = 365 * 24 * time.Hour
+
+// Hosts a self-signed certificate is valid for (plus the machine's hostname)
+var SELF_SIGNED_HOSTS = []string{"localhost", "127.0.0.1", "::1"}
+
+// Options selects the server certificate, TLS is off if all are unset
+type Options struct {
+	CertFile   string // PEM certificate (chain) file
+	KeyFile    string // PEM private key file
+	SelfSigned bool   // Generate a self-signed certificate instead (for dev)
+}
+
+// RegisterFlags adds -tls-cert, -tls-key and -tls-self-signed flags to
+// the flag set, returning the options they populate
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	options := &Options{}
+	fs.StringVar(&options.CertFile, "tls-cert", "",
+		"serve TLS with this PEM certificate `file` (requires -tls-key)")
+	fs.StringVar(&options.KeyFile, "tls-key", "",
+		"PEM private key `file` for -tls-cert")
+	fs.BoolVar(&options.SelfSigned, "tls-self-signed", false,
+		"serve TLS with a generated self-signed certificate (for development)")
+	return options
+}
+
+// Enabled reports whether the options turn on TLS
+func (o Options) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != "" || o.SelfSigned
+}
+
+// ServerConfig loads (or generates) the certificate, returning nil if TLS
+// isn't enabled
+func (o Options) ServerConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+
+	switch {
+	case !o.Enabled():
+		return nil, nil
+	case o.SelfSigned && (o.CertFile != "" || o.KeyFile != ""):
+		return nil, errors.New("tls: use either a self-signed certificate, or a certificate and key")
+	case o.SelfSigned:
+		hosts := SELF_SIGNED_HOSTS
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts[:len(hosts):len(hosts)], hostname)
+		}
+		cert, err = SelfSigned(hosts...)
+	case o.CertFile == "" || o.KeyFile == "":
+		return nil, errors.New("tls: both a certificate and key file are needed")
+	default:
+		cert, err = tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientConfig returns the config for dialing a TLS server, trusting the
+// CAs in caFile (PEM), or the system roots if empty
+func ClientConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls: no certificates found in %s", caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+//
+// === CERTIFICATE GENERATION === //
+//
+
+// CA is a certificate authority, generated in-process
+type CA struct {
+	Cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// NewCA generates a new CA, with the given common name
+func NewCA(name string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, key: key}, nil
+}
+
+// Issue generates a server certificate for the hosts (names or IPs),
+// signed by the CA
+func (ca *CA) Issue(hosts ...string) (tls.Certificate, error) {
+	return issue(hosts, ca.Cert, ca.key)
+}
+
+// CertPool returns a pool trusting only this CA (for client RootCAs)
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// SelfSigned generates a certificate for the hosts, signed by itself
+func SelfSigned(hosts ...string) (tls.Certificate, error) {
+	return issue(hosts, nil, nil)
+}
+
+// issue generates a certificate for the hosts (at least one), signed by the
+// parent, or self-signed if parent is nil
+func issue(hosts []string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return tls.Certificate{}, errors.New("tls: a certificate needs at least one host")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template, err := newTemplate(hosts[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newTemplate returns a certificate template with a random serial number
+func newTemplate(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"protohackers"}},
+		NotBefore:    now.Add(-time.Hour), // (allow for clock skew)
+		NotAfter:     now.Add(CERT_VALIDITY),
+	}, nil
+}
+
+// WritePEM writes a certificate and its private key to PEM files
+func WritePEM(cert tls.Certificate, certFile, keyFile string) error {
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0o600)
+}
@@ -0,0 +1,160 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// handshake serves a TLS echo with the server config, and dials it with the
+// client config, returning the echoed message (or the client's error)
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) (string, error) {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, _ = io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func TestCA(t *testing.T) {
+	ca, err := NewCA("test CA")
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, err := ca.Issue("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if _, err := ca.Issue(); err == nil {
+		t.Fatalf("Expected an error issuing a certificate without hosts")
+	}
+
+	// Trusted via the CA, by IP and name
+	for _, name := range []string{"127.0.0.1", "localhost"} {
+		client := &tls.Config{RootCAs: ca.CertPool(), ServerName: name}
+		if echo, err := handshake(t, server, client); err != nil || echo != "hello" {
+			t.Fatalf("Expected handshake with %s to succeed, got %q (%v)", name, echo, err)
+		}
+	}
+
+	// Not trusted for other names
+	client := &tls.Config{RootCAs: ca.CertPool(), ServerName: "example.com"}
+	if _, err := handshake(t, server, client); err == nil {
+		t.Fatalf("Expected handshake to fail for the wrong host")
+	}
+
+	// Nor by a different CA
+	other, _ := NewCA("other CA")
+	client = &tls.Config{RootCAs: other.CertPool(), ServerName: "localhost"}
+	if _, err := handshake(t, server, client); err == nil {
+		t.Fatalf("Expected handshake to fail with an untrusted CA")
+	}
+}
+
+func TestSelfSigned(t *testing.T) {
+	server, err := Options{SelfSigned: true}.ServerConfig()
+	if err != nil {
+		t.Fatalf("Failed to generate self-signed config: %v", err)
+	}
+
+	// Trust the certificate itself
+	leaf, err := x509.ParseCertificate(server.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	client := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if echo, err := handshake(t, server, client); err != nil || echo != "hello" {
+		t.Fatalf("Expected handshake to succeed, got %q (%v)", echo, err)
+	}
+
+	// Certificates are for at least one host
+	if _, err := SelfSigned(); err == nil {
+		t.Fatalf("Expected an error for a certificate without hosts")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	ca, _ := NewCA("test CA")
+	cert, _ := ca.Issue("localhost")
+	if err := WritePEM(cert, certFile, keyFile); err != nil {
+		t.Fatalf("Failed to write PEM files: %v", err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	server, err := Options{CertFile: certFile, KeyFile: keyFile}.ServerConfig()
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	client, err := ClientConfig(caFile)
+	if err != nil {
+		t.Fatalf("Failed to load CA: %v", err)
+	}
+	client.ServerName = "localhost"
+
+	if echo, err := handshake(t, server, client); err != nil || echo != "hello" {
+		t.Fatalf("Expected handshake to succeed, got %q (%v)", echo, err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	if config, err := (Options{}).ServerConfig(); config != nil || err != nil {
+		t.Fatalf("Expected no TLS without options, got %v (%v)", config, err)
+	}
+
+	invalid := []Options{
+		{CertFile: "cert.pem"},
+		{KeyFile: "key.pem"},
+		{CertFile: "cert.pem", KeyFile: "key.pem", SelfSigned: true},
+		{CertFile: "missing.pem", KeyFile: "missing.pem"},
+	}
+	for _, opts := range invalid {
+		if _, err := opts.ServerConfig(); err == nil || !strings.HasPrefix(err.Error(), "tls: ") {
+			t.Fatalf("Expected error for %+v, got %v", opts, err)
+		}
+	}
+
+	if _, err := ClientConfig(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Fatalf("Expected error for missing CA file")
+	}
+}